@@ -0,0 +1,141 @@
+// Copyright (C) 2014 Daniel Harrison
+
+// Command hfile inspects HFiles from the command line:
+//
+//	hfile info FILE         header, data index and meta block names
+//	hfile fileinfo FILE     FileInfo entries
+//	hfile dump FILE         every key and value, in key order
+//	hfile get FILE KEY      the first value stored under KEY
+//	hfile verify FILE       check every block, as Reader.Validate does
+//
+// Keys and values are printed Go-quoted; with -hex they are printed, and KEY
+// is read, as hex instead.
+package main
+
+import "github.com/paperstreet/gohfile/hfile"
+import "encoding/hex"
+import "flag"
+import "fmt"
+import "os"
+import "sort"
+
+var useHex = flag.Bool("hex", false, "read and print keys and values as hex")
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: hfile [-hex] info|fileinfo|dump|verify FILE")
+	fmt.Fprintln(os.Stderr, "       hfile [-hex] get FILE KEY")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func format(b []byte) string {
+	if *useHex {
+		return hex.EncodeToString(b)
+	}
+	return fmt.Sprintf("%q", b)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 {
+		usage()
+	}
+
+	cmd, path := args[0], args[1]
+	if (cmd == "get") != (len(args) == 3) || len(args) > 3 {
+		usage()
+	}
+
+	var run func(r *hfile.Reader) error
+	switch cmd {
+	case "info":
+		run = info
+	case "fileinfo":
+		run = fileInfo
+	case "dump":
+		run = dump
+	case "verify":
+		run = verify
+	case "get":
+		key := []byte(args[2])
+		if *useHex {
+			var err error
+			if key, err = hex.DecodeString(args[2]); err != nil {
+				fmt.Fprintln(os.Stderr, "bad hex key:", err)
+				os.Exit(2)
+			}
+		}
+		run = func(r *hfile.Reader) error { return get(r, key) }
+	default:
+		usage()
+	}
+
+	r, err := hfile.NewReaderFromPath(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer r.Close()
+	if err := run(r); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func info(r *hfile.Reader) error {
+	r.PrintDebugInfo(os.Stdout)
+	names, err := r.MetaBlockNames()
+	if err != nil {
+		return err
+	}
+	fmt.Println("meta blocks: ", len(names))
+	for _, name := range names {
+		fmt.Printf("\t%s\n", name)
+	}
+	return nil
+}
+
+func fileInfo(r *hfile.Reader) error {
+	info := r.FileInfo()
+	keys := make([]string, 0, len(info))
+	for k := range info {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("%s\t%s\n", k, format(info[k]))
+	}
+	return nil
+}
+
+func dump(r *hfile.Reader) error {
+	it := r.NewIterator()
+	it.ReuseBuffers(true)
+	for it.Next() {
+		fmt.Printf("%s\t%s\n", format(it.Key()), format(it.Value()))
+	}
+	return it.Err()
+}
+
+func verify(r *hfile.Reader) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	fmt.Printf("ok: %d entries in %d blocks\n", r.EntryCount(), r.BlockCount())
+	return nil
+}
+
+func get(r *hfile.Reader, key []byte) error {
+	s := hfile.NewScanner(r)
+	value, err, ok := s.GetFirst(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("key %s not found", format(key))
+	}
+	fmt.Println(format(value))
+	return nil
+}
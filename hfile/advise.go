@@ -0,0 +1,77 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// Advice tells the kernel how a mapped file will be read, so it can size its
+// readahead to suit.
+type Advice int
+
+const (
+	AdviceNormal     Advice = iota // the kernel's default readahead
+	AdviceSequential               // scanned front to back: read ahead aggressively
+	AdviceRandom                   // point lookups: read only the pages touched
+	AdviceWillNeed                 // start reading the whole file in now
+)
+
+// Advise passes advice on to the kernel for the reader's mapping. It does
+// nothing for readers that are not backed by a mapping, nor on platforms
+// without madvise.
+func (r *Reader) Advise(advice Advice) error {
+	if !r.mapped || r.closed || len(r.mmap) == 0 {
+		return nil
+	}
+	return madvise(r.mmap, advice)
+}
+
+// Preload pages the whole mapping into memory, so that lookups made after it
+// do not stall on page faults the first time they touch a part of the file.
+// It asks the kernel to start reading the file in, then touches every page
+// in order, returning once they are all resident; the kernel may still
+// evict them later under memory pressure, unless the mapping was locked. It
+// does nothing for readers that are not backed by a mapping.
+func (r *Reader) Preload() error {
+	if r.closed {
+		return ErrClosed
+	}
+	if !r.mapped || len(r.mmap) == 0 {
+		return nil
+	}
+	if err := madvise(r.mmap, AdviceWillNeed); err != nil {
+		r.logf("[Reader.Preload] %s: ignoring madvise error: %s\n", r.name, err)
+	}
+
+	var sum byte
+	for i := 0; i < len(r.mmap); i += os.Getpagesize() {
+		sum += r.mmap[i]
+	}
+	runtime.KeepAlive(sum)
+	return nil
+}
+
+// PreloadBlocks decodes every data block into the block cache, so that
+// lookups after it neither read nor decompress. Blocks beyond the cache's
+// budget evict the ones before them, so it is most useful with a budget that
+// holds the whole file, as CachedBytes in Stats shows afterwards. It fails
+// if SetBlockCacheBytes has not turned the cache on, and at the first block
+// that cannot be decoded.
+func (r *Reader) PreloadBlocks() error {
+	if r.closed {
+		return ErrClosed
+	}
+	if r.cache == nil {
+		return errors.New("block cache is off")
+	}
+	for i := range r.index {
+		if _, err := r.GetBlock(i); err != nil {
+			return fmt.Errorf("block %d: %s", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import "syscall"
+
+func madvise(b []byte, advice Advice) error {
+	var flag int
+	switch advice {
+	case AdviceSequential:
+		flag = syscall.MADV_SEQUENTIAL
+	case AdviceRandom:
+		flag = syscall.MADV_RANDOM
+	case AdviceWillNeed:
+		flag = syscall.MADV_WILLNEED
+	default:
+		flag = syscall.MADV_NORMAL
+	}
+	return syscall.Madvise(b, flag)
+}
@@ -0,0 +1,10 @@
+// Copyright (C) 2014 Daniel Harrison
+
+//go:build !linux
+// +build !linux
+
+package hfile
+
+func madvise(b []byte, advice Advice) error {
+	return nil
+}
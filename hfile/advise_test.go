@@ -0,0 +1,99 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// openMapped writes entries to a file and maps it.
+func openMapped(t *testing.T, opts WriterOptions, entries []testEntry) *Reader {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(path, writeEntries(t, opts, entries), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReaderFromPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestAdvise(t *testing.T) {
+	entries := sequentialEntries(100)
+	r := openMapped(t, WriterOptions{BlockSize: 256}, entries)
+	defer r.Close()
+	for _, advice := range []Advice{AdviceSequential, AdviceRandom, AdviceWillNeed, AdviceNormal} {
+		if err := r.Advise(advice); err != nil {
+			t.Errorf("advice %d: %s", advice, err)
+		}
+	}
+	if got := readAll(t, r); !reflect.DeepEqual(got, entries) {
+		t.Errorf("read %d entries, want %d", len(got), len(entries))
+	}
+
+	// Without a mapping there is nothing to advise.
+	if err := parseEntries(t, WriterOptions{}, entries).Advise(AdviceRandom); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPreload(t *testing.T) {
+	entries := sequentialEntries(300)
+	r := openMapped(t, WriterOptions{Compression: "snappy", BlockSize: 256}, entries)
+	if err := r.Preload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.PreloadBlocks(); err == nil {
+		t.Error("PreloadBlocks without a block cache got no error")
+	}
+
+	r.SetBlockCacheBytes(1 << 20)
+	if err := r.PreloadBlocks(); err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for i := range r.index {
+		block, err := r.BlockBytes(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += int64(len(block))
+	}
+	if got := r.CachedBytes(); got != size {
+		t.Errorf("got %d bytes cached, blocks decode to %d", got, size)
+	}
+	// Lookups after it decode nothing.
+	decoded := 0
+	r.onBlockDecoded = func(int, []byte) { decoded++ }
+	s := NewScanner(r)
+	for _, e := range entries {
+		if _, err, ok := s.GetFirst([]byte(e.key)); err != nil || !ok {
+			t.Fatalf("%s: got %v, %v", e.key, err, ok)
+		}
+	}
+	if decoded != 0 {
+		t.Errorf("decoded %d blocks after PreloadBlocks", decoded)
+	}
+
+	r.Close()
+	if err := r.Preload(); err != ErrClosed {
+		t.Errorf("Preload after Close: got %v, want %v", err, ErrClosed)
+	}
+	if err := r.PreloadBlocks(); err != ErrClosed {
+		t.Errorf("PreloadBlocks after Close: got %v, want %v", err, ErrClosed)
+	}
+
+	// It stops at a block that cannot be decoded.
+	r = parseEntries(t, WriterOptions{Compression: "snappy", BlockSize: 256}, entries)
+	r.SetBlockCacheBytes(1 << 20)
+	r.index[3].size++
+	if err := r.PreloadBlocks(); err == nil || !strings.HasPrefix(err.Error(), "block 3:") {
+		t.Errorf("got %v, want an error in block 3", err)
+	}
+}
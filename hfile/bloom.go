@@ -0,0 +1,194 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// bloomFilter is the ByteBloomFilter HBase writes into v1 files as two meta
+// blocks: BLOOM_FILTER_META holds its parameters and BLOOM_FILTER_DATA the
+// bits.
+type bloomFilter struct {
+	bits      []byte
+	hashCount int
+	hash      func(data []byte, seed uint32) uint32
+	rows      bool // keys are KeyValue keys, and the filter holds their rows
+}
+
+// loadBloomFilter reads the file's row bloom filter, if it has one. A filter
+// that is missing, of another kind or unreadable leaves lookups unfiltered.
+func (r *Reader) loadBloomFilter() {
+	if string(r.fileInfo["BLOOM_FILTER_TYPE"]) != "ROW" {
+		return
+	}
+	meta, ok := r.MetaBlock("BLOOM_FILTER_META")
+	if !ok {
+		return
+	}
+	bits, ok := r.MetaBlock("BLOOM_FILTER_DATA")
+	if !ok {
+		return
+	}
+
+	bloom, err := newBloomFilter(meta, bits)
+	if err != nil {
+		r.logf("[Reader.loadBloomFilter] %s: ignoring bloom filter: %s\n", r.name, err)
+		return
+	}
+	if class, ok := r.ComparatorClass(); ok && keyValueComparator(class) {
+		bloom.rows = true
+	}
+	r.bloom = bloom
+}
+
+func newBloomFilter(meta, bits []byte) (*bloomFilter, error) {
+	if len(meta) < 20 {
+		return nil, errors.New("truncated bloom filter meta")
+	}
+	version := binary.BigEndian.Uint32(meta[0:4])
+	byteSize := binary.BigEndian.Uint32(meta[4:8])
+	hashCount := binary.BigEndian.Uint32(meta[8:12])
+	hashType := binary.BigEndian.Uint32(meta[12:16])
+
+	if version != 1 {
+		return nil, fmt.Errorf("unknown bloom filter version %d", version)
+	}
+	if byteSize == 0 || byteSize > 1<<28 || uint64(byteSize) != uint64(len(bits)) {
+		return nil, fmt.Errorf("bloom filter is %d bytes, meta says %d", len(bits), byteSize)
+	}
+	if hashCount == 0 || hashCount > 64 {
+		return nil, fmt.Errorf("bad bloom filter hash count %d", hashCount)
+	}
+
+	bloom := &bloomFilter{bits: bits, hashCount: int(hashCount)}
+	switch hashType {
+	case 0:
+		bloom.hash = jenkinsHash
+	case 1:
+		bloom.hash = murmurHash
+	default:
+		return nil, fmt.Errorf("unknown bloom filter hash type %d", hashType)
+	}
+	return bloom, nil
+}
+
+// mightContain reports whether key may be in the file. It mirrors
+// ByteBloomFilter.contains, including its signed 32 bit arithmetic.
+func (b *bloomFilter) mightContain(key []byte) bool {
+	if b.rows {
+		if row, _, _, _, _, ok := splitKeyValueKey(key); ok {
+			key = row
+		}
+	}
+	bitSize := int32(len(b.bits) * 8)
+	hash1 := int32(b.hash(key, 0))
+	hash2 := int32(b.hash(key, uint32(hash1)))
+
+	composite := hash1
+	for i := 0; i < b.hashCount; i++ {
+		loc := composite % bitSize
+		if loc < 0 {
+			loc = -loc
+		}
+		composite += hash2
+		if b.bits[loc>>3]&(1<<uint(loc&7)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// murmurHash is HBase's MurmurHash, which is MurmurHash2 except that it sign
+// extends the trailing bytes.
+func murmurHash(data []byte, seed uint32) uint32 {
+	const m = 0x5bd1e995
+	h := seed ^ uint32(len(data))
+
+	n := len(data) &^ 3
+	for i := 0; i < n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> 24
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	switch len(data) - n {
+	case 3:
+		h ^= uint32(int32(int8(data[n+2])) << 16)
+		fallthrough
+	case 2:
+		h ^= uint32(int32(int8(data[n+1])) << 8)
+		fallthrough
+	case 1:
+		h ^= uint32(int32(int8(data[n])))
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+// jenkinsHash is Bob Jenkins' lookup3 hashlittle, as HBase's JenkinsHash
+// implements it.
+func jenkinsHash(data []byte, seed uint32) uint32 {
+	rot := func(x uint32, k uint) uint32 { return x<<k | x>>(32-k) }
+
+	a := 0xdeadbeef + uint32(len(data)) + seed
+	b, c := a, a
+	for ; len(data) > 12; data = data[12:] {
+		a += binary.LittleEndian.Uint32(data[0:4])
+		b += binary.LittleEndian.Uint32(data[4:8])
+		c += binary.LittleEndian.Uint32(data[8:12])
+
+		a -= c
+		a ^= rot(c, 4)
+		c += b
+		b -= a
+		b ^= rot(a, 6)
+		a += c
+		c -= b
+		c ^= rot(b, 8)
+		b += a
+		a -= c
+		a ^= rot(c, 16)
+		c += b
+		b -= a
+		b ^= rot(a, 19)
+		a += c
+		c -= b
+		c ^= rot(b, 4)
+		b += a
+	}
+	if len(data) == 0 {
+		return c
+	}
+
+	var tail [12]byte
+	copy(tail[:], data)
+	a += binary.LittleEndian.Uint32(tail[0:4])
+	b += binary.LittleEndian.Uint32(tail[4:8])
+	c += binary.LittleEndian.Uint32(tail[8:12])
+
+	c ^= b
+	c -= rot(b, 14)
+	a ^= c
+	a -= rot(c, 11)
+	b ^= a
+	b -= rot(a, 25)
+	c ^= b
+	c -= rot(b, 16)
+	a ^= c
+	a -= rot(c, 4)
+	b ^= a
+	b -= rot(a, 14)
+	c ^= b
+	c -= rot(b, 24)
+	return c
+}
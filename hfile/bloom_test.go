@@ -0,0 +1,135 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+func TestJenkinsHash(t *testing.T) {
+	// From the driver in Bob Jenkins' lookup3.c.
+	for _, test := range []struct {
+		data string
+		seed uint32
+		want uint32
+	}{
+		{"", 0, 0xdeadbeef},
+		{"", 0xdeadbeef, 0xbd5b7dde},
+		{"Four score and seven years ago", 0, 0x17770551},
+		{"Four score and seven years ago", 1, 0xcd628161},
+	} {
+		if got := jenkinsHash([]byte(test.data), test.seed); got != test.want {
+			t.Errorf("%q, %d: got %#x, want %#x", test.data, test.seed, got, test.want)
+		}
+	}
+}
+
+// addToBloom sets key's bits in b, as ByteBloomFilter.add does.
+func addToBloom(b *bloomFilter, key []byte) {
+	bitSize := int32(len(b.bits) * 8)
+	hash1 := int32(b.hash(key, 0))
+	hash2 := int32(b.hash(key, uint32(hash1)))
+	composite := hash1
+	for i := 0; i < b.hashCount; i++ {
+		loc := composite % bitSize
+		if loc < 0 {
+			loc = -loc
+		}
+		composite += hash2
+		b.bits[loc>>3] |= 1 << uint(loc&7)
+	}
+}
+
+// writeBloomEntries writes entries with a row bloom filter of the given hash
+// type holding them.
+func writeBloomEntries(t *testing.T, hashType uint32, entries []testEntry) []byte {
+	t.Helper()
+	bloom := &bloomFilter{bits: make([]byte, 256), hashCount: 3, hash: []func([]byte, uint32) uint32{jenkinsHash, murmurHash}[hashType]}
+	for _, e := range entries {
+		addToBloom(bloom, []byte(e.key))
+	}
+	meta := make([]byte, 20)
+	binary.BigEndian.PutUint32(meta[0:4], 1)
+	binary.BigEndian.PutUint32(meta[4:8], uint32(len(bloom.bits)))
+	binary.BigEndian.PutUint32(meta[8:12], uint32(bloom.hashCount))
+	binary.BigEndian.PutUint32(meta[12:16], hashType)
+	binary.BigEndian.PutUint32(meta[16:20], uint32(len(entries)))
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, WriterOptions{BlockSize: 256, FileInfo: map[string][]byte{"BLOOM_FILTER_TYPE": []byte("ROW")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if err := w.Add([]byte(e.key), []byte(e.value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.flushBlock(); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []struct {
+		name string
+		data []byte
+	}{{"BLOOM_FILTER_META", meta}, {"BLOOM_FILTER_DATA", bloom.bits}} {
+		blk := Block{offset: w.offset, firstKeyBytes: []byte(b.name)}
+		blk.size = w.writeBlock(append([]byte("METABLKc"), b.data...))
+		w.metaIndex = append(w.metaIndex, blk)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBloomFilter(t *testing.T) {
+	var entries []testEntry
+	for i := 0; i < 100; i += 2 {
+		entries = append(entries, testEntry{fmt.Sprintf("key%06d", i), "value"})
+	}
+	for _, hashType := range []uint32{0, 1} {
+		r, err := Parse(writeBloomEntries(t, hashType, entries))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.bloom == nil {
+			t.Fatalf("hash %d: no bloom filter loaded", hashType)
+		}
+		decoded := 0
+		r.onBlockDecoded = func(int, []byte) { decoded++ }
+
+		// No false negatives.
+		s := NewScanner(r)
+		for _, e := range entries {
+			if _, err, ok := s.GetFirst([]byte(e.key)); err != nil || !ok {
+				t.Errorf("hash %d: %s: got %v, %v", hashType, e.key, err, ok)
+			}
+		}
+
+		// Missing keys mostly decode nothing: a 2048 bit filter of 50 keys has
+		// a false positive rate of well under 1%.
+		s = NewScanner(r)
+		decoded = 0
+		for i := 1; i < 100; i += 2 {
+			if _, err, ok := s.GetFirst([]byte(fmt.Sprintf("key%06d", i))); err != nil || ok {
+				t.Errorf("hash %d: key%06d: got %v, %v", hashType, i, err, ok)
+			}
+		}
+		if decoded > 5 {
+			t.Errorf("hash %d: decoded %d blocks for 50 missing keys", hashType, decoded)
+		}
+
+		r.UseBloomFilter(false)
+		s = NewScanner(r)
+		decoded = 0
+		for i := 1; i < 100; i += 2 {
+			s.GetFirst([]byte(fmt.Sprintf("key%06d", i)))
+		}
+		if decoded == 0 {
+			t.Errorf("hash %d: the filter was still used after UseBloomFilter(false)", hashType)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"container/list"
+	"sync"
+)
+
+// blockCache holds decoded data blocks by offset, evicting the least recently
+// used once together they take up more than its budget of bytes. It is safe
+// for concurrent use, and lookups that miss on the same block at once share
+// a single decode of it.
+type blockCache struct {
+	lock    sync.Mutex
+	budget  int
+	used    int
+	lru     *list.List // of *cachedBlock, most recently used at the front
+	blocks  map[uint64]*list.Element
+	loading map[uint64]*loadingBlock
+
+	hits, misses uint64
+}
+
+type cachedBlock struct {
+	offset uint64
+	data   []byte
+}
+
+// loadingBlock is a block being decoded by the first lookup to miss on it.
+// done is closed once data and err are set.
+type loadingBlock struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func newBlockCache(budget int) *blockCache {
+	return &blockCache{
+		budget:  budget,
+		lru:     list.New(),
+		blocks:  make(map[uint64]*list.Element),
+		loading: make(map[uint64]*loadingBlock),
+	}
+}
+
+// load returns the block at offset, calling decode for it unless it is
+// cached or another lookup is already decoding it, in which case it waits
+// for that decode and returns its result. Only blocks that decode without
+// error are cached. Waiting on another lookup's decode counts as a hit.
+func (c *blockCache) load(offset uint64, decode func() ([]byte, error)) ([]byte, error) {
+	c.lock.Lock()
+	if elem, ok := c.blocks[offset]; ok {
+		c.hits += 1
+		c.lru.MoveToFront(elem)
+		c.lock.Unlock()
+		return elem.Value.(*cachedBlock).data, nil
+	}
+	if l, ok := c.loading[offset]; ok {
+		c.hits += 1
+		c.lock.Unlock()
+		<-l.done
+		return l.data, l.err
+	}
+	c.misses += 1
+	l := &loadingBlock{done: make(chan struct{})}
+	c.loading[offset] = l
+	c.lock.Unlock()
+
+	l.data, l.err = decode()
+
+	c.lock.Lock()
+	delete(c.loading, offset)
+	if l.err == nil {
+		c.add(offset, l.data)
+	}
+	c.lock.Unlock()
+	close(l.done)
+	return l.data, l.err
+}
+
+// add caches data as the block at offset. A block bigger than the whole
+// budget is not cached at all. c.lock must be held.
+func (c *blockCache) add(offset uint64, data []byte) {
+	if len(data) > c.budget {
+		return
+	}
+	c.blocks[offset] = c.lru.PushFront(&cachedBlock{offset, data})
+	c.used += len(data)
+	for c.used > c.budget {
+		oldest := c.lru.Remove(c.lru.Back()).(*cachedBlock)
+		delete(c.blocks, oldest.offset)
+		c.used -= len(oldest.data)
+	}
+}
+
+// remove drops the block at offset from the cache, if it is there.
+func (c *blockCache) remove(offset uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.blocks[offset]; ok {
+		c.lru.Remove(elem)
+		delete(c.blocks, offset)
+		c.used -= len(elem.Value.(*cachedBlock).data)
+	}
+}
+
+func (c *blockCache) stats() (uint64, uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.hits, c.misses
+}
+
+func (c *blockCache) size() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.used
+}
@@ -0,0 +1,155 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBlockCache(t *testing.T) {
+	c := newBlockCache(30)
+	decodes := 0
+	load := func(offset uint64, size int) {
+		t.Helper()
+		data, err := c.load(offset, func() ([]byte, error) {
+			decodes++
+			return make([]byte, size), nil
+		})
+		if err != nil || len(data) != size {
+			t.Fatalf("block %d: got %d bytes, %v", offset, len(data), err)
+		}
+	}
+
+	load(0, 10)
+	load(1, 10)
+	load(0, 10) // a hit, which makes 1 the least recently used
+	load(2, 10)
+	if decodes != 3 || c.size() != 30 {
+		t.Fatalf("got %d decodes and %d bytes, want 3 and 30", decodes, c.size())
+	}
+	load(3, 10) // evicts 1
+	load(0, 10)
+	load(2, 10)
+	if decodes != 4 {
+		t.Errorf("got %d decodes, want 4", decodes)
+	}
+	load(1, 10)
+	if decodes != 5 {
+		t.Errorf("got %d decodes, want block 1 decoded again", decodes)
+	}
+
+	load(4, 31) // bigger than the budget, so not cached
+	load(4, 31)
+	if decodes != 7 || c.size() != 30 {
+		t.Errorf("got %d decodes and %d bytes, want 7 and 30", decodes, c.size())
+	}
+	if hits, misses := c.stats(); hits != 3 || misses != 7 {
+		t.Errorf("got %d hits and %d misses, want 3 and 7", hits, misses)
+	}
+
+	// Failed decodes are not cached.
+	failed := errors.New("failed")
+	if _, err := c.load(5, func() ([]byte, error) { return nil, failed }); err != failed {
+		t.Errorf("got %v, want %v", err, failed)
+	}
+	load(5, 10)
+	if decodes != 8 {
+		t.Errorf("got %d decodes, want block 5 decoded after its failure", decodes)
+	}
+}
+
+// TestBlockCacheSharedDecode checks that lookups missing on a block at once
+// wait for one decode of it.
+func TestBlockCacheSharedDecode(t *testing.T) {
+	c := newBlockCache(1 << 10)
+	release := make(chan struct{})
+	var decodes int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := c.load(0, func() ([]byte, error) {
+				atomic.AddInt32(&decodes, 1)
+				<-release
+				return []byte("block"), nil
+			})
+			if err != nil || string(data) != "block" {
+				t.Errorf("got %q, %v", data, err)
+			}
+		}()
+	}
+	// Let every goroutine reach the cache before the decode finishes.
+	for {
+		c.lock.Lock()
+		waiting := c.hits + c.misses
+		c.lock.Unlock()
+		if waiting == 8 {
+			break
+		}
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+	if decodes != 1 {
+		t.Errorf("got %d decodes, want 1", decodes)
+	}
+}
+
+func TestScanMemoryBudget(t *testing.T) {
+	entries := sequentialEntries(1000)
+	data := writeEntries(t, WriterOptions{Compression: "snappy", BlockSize: 256}, entries)
+	for _, readahead := range []int{0, 4} {
+		r, err := NewReaderAtWithOptions(bytes.NewReader(data), int64(len(data)), ReaderOptions{
+			BlockCacheBytes:  1 << 20,
+			ScanMemoryBudget: 1024,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.index) < 20 {
+			t.Fatalf("got %d blocks, want many", len(r.index))
+		}
+		// A block a lookup cached before the scan stays cached after it.
+		s := NewScanner(r)
+		hot := entries[len(entries)/2].key
+		if _, err, ok := s.GetFirst([]byte(hot)); err != nil || !ok {
+			t.Fatalf("got %v, %v", err, ok)
+		}
+		hotBytes := r.CachedBytes()
+
+		it := r.NewIterator()
+		it.Readahead(readahead)
+		var got []testEntry
+		for it.Next() {
+			got = append(got, testEntry{string(it.Key()), string(it.Value())})
+			if cached := r.CachedBytes(); cached > hotBytes+1024+int64(readahead)*512 {
+				t.Fatalf("readahead %d: %d bytes cached during the scan", readahead, cached)
+			}
+		}
+		if it.Err() != nil || !reflect.DeepEqual(got, entries) {
+			t.Errorf("readahead %d: got %d entries, %v", readahead, len(got), it.Err())
+		}
+		if cached := r.CachedBytes(); cached <= hotBytes || cached > hotBytes+1024 {
+			t.Errorf("readahead %d: got %d bytes cached, want the scan's last blocks within the budget", readahead, cached)
+		}
+		misses := r.Stats().BlockCacheMisses
+		if _, err, ok := s.GetFirst([]byte(hot)); err != nil || !ok || r.Stats().BlockCacheMisses != misses {
+			t.Errorf("readahead %d: the scan evicted the lookup's block", readahead)
+		}
+	}
+
+	// Without a budget, the scan fills the cache.
+	r := parseEntries(t, WriterOptions{Compression: "snappy", BlockSize: 256}, entries)
+	r.SetBlockCacheBytes(1 << 20)
+	readAll(t, r)
+	if r.CachedBytes() < int64(r.UncompressedSize()) {
+		t.Errorf("got %d bytes cached, want every block", r.CachedBytes())
+	}
+}
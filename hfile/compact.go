@@ -0,0 +1,127 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// CompactOptions configures Compact.
+type CompactOptions struct {
+	// Writer configures the output file.
+	Writer WriterOptions
+
+	// Deduplicate keeps only the first of each key's entries: the first
+	// value of the input file that wins, as a MultiReader orders them.
+	// Otherwise every entry of every input is kept.
+	Deduplicate bool
+}
+
+// Compact merges inputs, listed newest first as for NewMultiReader, into a
+// single file written to out, in key order. The inputs must be sorted
+// bytewise, as Writer requires.
+func Compact(out io.Writer, inputs []*Reader, opts CompactOptions) error {
+	its := make([]KVIterator, len(inputs))
+	for i, r := range inputs {
+		its[i] = r.NewIterator()
+	}
+	return CompactIterators(out, its, opts)
+}
+
+// CompactIterators is Compact for inputs that need not be files: any sorted
+// streams of entries, listed newest first, such as a mix of Iterators and
+// entries generated on the fly.
+func CompactIterators(out io.Writer, inputs []KVIterator, opts CompactOptions) error {
+	w, err := NewWriter(out, opts.Writer)
+	if err != nil {
+		return err
+	}
+	if err := addMerged(w, inputs, opts.Deduplicate); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// addMerged adds the entries of inputs to w, merged as CompactIterators does.
+func addMerged(w *Writer, inputs []KVIterator, deduplicate bool) error {
+	it := MergeIterators(nil, inputs...)
+	var last []byte
+	for n := 0; it.Next(); n++ {
+		if deduplicate && n > 0 && bytes.Equal(it.Key(), last) {
+			continue
+		}
+		if err := w.Add(it.Key(), it.Value()); err != nil {
+			return err
+		}
+		last = append(last[:0], it.Key()...) // inputs may reuse their key buffers
+	}
+	return it.Err()
+}
+
+// KeyValue is an entry, as Writer.Add takes one.
+type KeyValue struct {
+	Key, Value []byte
+}
+
+// MergeInto adds base's entries to dst with updates merged in, in key order,
+// as a lighter upsert than compacting whole files. A key in updates replaces
+// every one of base's entries under it with every one of its own; base's
+// other keys are kept as they are. updates must be sorted bytewise, with any
+// several entries for a key in the order they are to be written. dst is left
+// open, for the caller to Close.
+func MergeInto(dst *Writer, base *Reader, updates []KeyValue) error {
+	for i := 1; i < len(updates); i++ {
+		if bytes.Compare(updates[i-1].Key, updates[i].Key) > 0 {
+			return fmt.Errorf("update %d key %v sorts before update %d's %v", i, updates[i].Key, i-1, updates[i-1].Key)
+		}
+	}
+	if base.closed {
+		return ErrClosed
+	}
+	kept := &overriddenIterator{it: base.NewIterator(), updates: updates}
+	return addMerged(dst, []KVIterator{&keyValueIterator{kvs: updates}, kept}, false)
+}
+
+// keyValueIterator walks a slice of entries.
+type keyValueIterator struct {
+	kvs []KeyValue
+	i   int // one past the current entry
+}
+
+func (it *keyValueIterator) Next() bool {
+	if it.i >= len(it.kvs) {
+		return false
+	}
+	it.i += 1
+	return true
+}
+
+func (it *keyValueIterator) Key() []byte   { return it.kvs[it.i-1].Key }
+func (it *keyValueIterator) Value() []byte { return it.kvs[it.i-1].Value }
+func (it *keyValueIterator) Err() error    { return nil }
+
+// overriddenIterator walks the entries of it whose keys are not in updates.
+type overriddenIterator struct {
+	it      *Iterator
+	updates []KeyValue
+	u       int // the first update not sorting before the current entry
+}
+
+func (o *overriddenIterator) Next() bool {
+	for o.it.Next() {
+		for o.u < len(o.updates) && bytes.Compare(o.updates[o.u].Key, o.it.Key()) < 0 {
+			o.u += 1
+		}
+		if o.u < len(o.updates) && bytes.Equal(o.updates[o.u].Key, o.it.Key()) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func (o *overriddenIterator) Key() []byte   { return o.it.Key() }
+func (o *overriddenIterator) Value() []byte { return o.it.Value() }
+func (o *overriddenIterator) Err() error    { return o.it.Err() }
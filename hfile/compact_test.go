@@ -0,0 +1,149 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func keyValues(entries []testEntry) []KeyValue {
+	kvs := make([]KeyValue, len(entries))
+	for i, e := range entries {
+		kvs[i] = KeyValue{[]byte(e.key), []byte(e.value)}
+	}
+	return kvs
+}
+
+func TestMergeInto(t *testing.T) {
+	base := parseEntries(t, WriterOptions{BlockSize: 16}, []testEntry{
+		{"a", "base"}, {"b", "base1"}, {"b", "base2"}, {"c", "base"}, {"e", "base1"}, {"e", "base2"},
+	})
+	updates := keyValues([]testEntry{
+		{"0", "new"}, {"b", "new"}, {"d", "new1"}, {"d", "new2"}, {"e", "new"}, {"f", "new"},
+	})
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, WriterOptions{BlockSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := MergeInto(w, base, updates); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Parse(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []testEntry{
+		{"0", "new"}, {"a", "base"}, {"b", "new"}, {"c", "base"}, {"d", "new1"}, {"d", "new2"}, {"e", "new"}, {"f", "new"},
+	}
+	if got := readAll(t, r); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+}
+
+func TestMergeIntoRejectsUnsortedUpdates(t *testing.T) {
+	base := parseEntries(t, WriterOptions{}, []testEntry{{"a", "base"}})
+	w, err := NewWriter(&bytes.Buffer{}, WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = MergeInto(w, base, keyValues([]testEntry{{"c", "new"}, {"b", "new"}}))
+	if err == nil {
+		t.Fatal("merged unsorted updates")
+	}
+}
+
+// TestCompact compacts three files sharing some keys, newest first, with and
+// without deduplication.
+func TestCompact(t *testing.T) {
+	newest := parseEntries(t, WriterOptions{BlockSize: 32}, []testEntry{
+		{"b", "new"}, {"d", "new1"}, {"d", "new2"}, {"g", "new"},
+	})
+	middle := parseEntries(t, WriterOptions{Compression: "snappy", BlockSize: 32}, []testEntry{
+		{"a", "mid"}, {"b", "mid"}, {"e", "mid"}, {"g", "mid"},
+	})
+	oldest := parseEntries(t, WriterOptions{Compression: "lz4", BlockSize: 32}, []testEntry{
+		{"a", "old"}, {"c", "old"}, {"d", "old"}, {"e", "old"}, {"f", "old"},
+	})
+	inputs := []*Reader{newest, middle, oldest}
+
+	for _, test := range []struct {
+		deduplicate bool
+		want        []testEntry
+	}{
+		{true, []testEntry{
+			{"a", "mid"}, {"b", "new"}, {"c", "old"}, {"d", "new1"}, {"e", "mid"}, {"f", "old"}, {"g", "new"},
+		}},
+		{false, []testEntry{
+			{"a", "mid"}, {"a", "old"}, {"b", "new"}, {"b", "mid"}, {"c", "old"},
+			{"d", "new1"}, {"d", "new2"}, {"d", "old"}, {"e", "mid"}, {"e", "old"},
+			{"f", "old"}, {"g", "new"}, {"g", "mid"},
+		}},
+	} {
+		var buf bytes.Buffer
+		opts := CompactOptions{Writer: WriterOptions{BlockSize: 20}, Deduplicate: test.deduplicate}
+		if err := Compact(&buf, inputs, opts); err != nil {
+			t.Fatal(err)
+		}
+		r, err := Parse(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Validate(); err != nil {
+			t.Errorf("deduplicate=%v: %s", test.deduplicate, err)
+		}
+		if got := readAll(t, r); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("deduplicate=%v: got %v, want %v", test.deduplicate, got, test.want)
+		}
+		if got := r.Stats().Entries; got != uint64(len(test.want)) {
+			t.Errorf("deduplicate=%v: trailer counts %d entries, want %d", test.deduplicate, got, len(test.want))
+		}
+
+		// Each entry is 8+1+3 to 8+1+4 bytes, so blocks of 20 hold two.
+		if want := (len(test.want) + 1) / 2; len(r.index) != want {
+			t.Errorf("deduplicate=%v: got %d blocks, want %d", test.deduplicate, len(r.index), want)
+			continue
+		}
+		for i, blk := range r.index {
+			if got, want := string(blk.firstKeyBytes), test.want[2*i].key; got != want {
+				t.Errorf("deduplicate=%v: block %d starts with %q, want %q", test.deduplicate, i, got, want)
+			}
+		}
+	}
+}
+
+// TestCompactIteratorsReusedBuffers deduplicates inputs that decode every key
+// into the same buffer, so the last key written must be a copy.
+func TestCompactIteratorsReusedBuffers(t *testing.T) {
+	newer := parseEntries(t, WriterOptions{BlockSize: 32}, []testEntry{{"a", "new"}, {"c", "new"}, {"d", "new"}})
+	older := parseEntries(t, WriterOptions{BlockSize: 32}, []testEntry{{"a", "old"}, {"b", "old"}, {"c", "old"}, {"e", "old"}})
+	var inputs []KVIterator
+	for _, r := range []*Reader{newer, older} {
+		it := r.NewIterator()
+		it.ReuseBuffers(true)
+		inputs = append(inputs, it)
+	}
+
+	var buf bytes.Buffer
+	if err := CompactIterators(&buf, inputs, CompactOptions{Deduplicate: true}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Parse(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []testEntry{{"a", "new"}, {"b", "old"}, {"c", "new"}, {"d", "new"}, {"e", "old"}}
+	if got := readAll(t, r); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Cursor is a position in the file that can be moved to a key and stepped
+// either way from it, for access patterns that mix them: SeekGE then Next
+// covers Ceiling and range scans, SeekLE then Prev covers Floor and
+// descending ones. Like ReverseIterator it keeps where each entry of its
+// current block starts, 8 bytes an entry, so that it can step back as
+// cheaply as forward. Once a move takes it past either end of the file it is
+// no longer Valid, and only First, Last or a Seek place it again. Like an
+// Iterator, it is not safe for concurrent use.
+type Cursor struct {
+	hfile    *Reader
+	blockIdx int
+	block    *bytes.Reader
+	offsets  []int64
+	pos      int // into offsets
+	key      []byte
+	value    []byte
+	valid    bool
+	err      error
+	scratch  []byte
+}
+
+func (hfile *Reader) NewCursor() *Cursor {
+	return &Cursor{hfile: hfile}
+}
+
+// First moves to the first entry in the file, returning false if it has none.
+func (c *Cursor) First() bool {
+	if !c.reset() {
+		return false
+	}
+	if !c.load(0) {
+		return false
+	}
+	c.pos = 0
+	return c.forward()
+}
+
+// Last moves to the last entry in the file, returning false if it has none.
+func (c *Cursor) Last() bool {
+	if !c.reset() {
+		return false
+	}
+	if !c.load(len(c.hfile.index) - 1) {
+		return false
+	}
+	c.pos = len(c.offsets) - 1
+	return c.backward()
+}
+
+// SeekGE moves to the first entry with a key >= key, returning false if
+// every key is smaller. Where key has several entries, it is the first.
+func (c *Cursor) SeekGE(key []byte) bool {
+	if !c.reset() {
+		return false
+	}
+	// As for Iterator.Seek, key's entries may start in the block before
+	// the first one starting at or after key.
+	idx := sort.Search(len(c.hfile.index), func(i int) bool {
+		return c.hfile.compareKeys(c.hfile.index[i].firstKeyBytes, key) >= 0
+	})
+	if idx > 0 {
+		idx -= 1
+	}
+	if !c.load(idx) {
+		return false
+	}
+	c.pos = sort.Search(len(c.offsets), func(i int) bool {
+		return c.hfile.compareKeys(c.keyAt(c.offsets[i]), key) >= 0
+	})
+	return c.forward()
+}
+
+// SeekLE moves to the last entry with a key <= key, returning false if
+// every key is larger. Where key has several entries, it is the last.
+func (c *Cursor) SeekLE(key []byte) bool {
+	if !c.reset() {
+		return false
+	}
+	idx := sort.Search(len(c.hfile.index), func(i int) bool {
+		return c.hfile.blockIsAfter(i, key)
+	}) - 1
+	if idx < 0 {
+		return false
+	}
+	if !c.load(idx) {
+		return false
+	}
+	c.pos = sort.Search(len(c.offsets), func(i int) bool {
+		return c.hfile.compareKeys(c.keyAt(c.offsets[i]), key) > 0
+	}) - 1
+	return c.backward()
+}
+
+// Next moves to the following entry, returning false at the end of the file.
+func (c *Cursor) Next() bool {
+	if !c.valid {
+		return false
+	}
+	c.pos += 1
+	return c.forward()
+}
+
+// Prev moves to the entry before, returning false at the start of the file.
+func (c *Cursor) Prev() bool {
+	if !c.valid {
+		return false
+	}
+	c.pos -= 1
+	return c.backward()
+}
+
+// Valid reports whether the cursor is at an entry.
+func (c *Cursor) Valid() bool {
+	return c.valid
+}
+
+func (c *Cursor) Key() []byte {
+	return c.key
+}
+
+func (c *Cursor) Value() []byte {
+	return c.value
+}
+
+// Err returns the error that left the cursor invalid, or nil if it simply
+// moved past an end of the file or found no key to seek to. It is cleared by
+// the next First, Last or Seek.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// reset clears the cursor before it is placed anew, reporting false if the
+// reader cannot be read from.
+func (c *Cursor) reset() bool {
+	c.valid, c.key, c.value, c.err = false, nil, nil, nil
+	if c.hfile.closed {
+		c.err = ErrClosed
+		return false
+	}
+	return len(c.hfile.index) > 0
+}
+
+// load makes block i the current one.
+func (c *Cursor) load(i int) bool {
+	block, offsets, err := c.hfile.loadEntryOffsets(i)
+	if err != nil {
+		c.valid, c.key, c.value, c.err = false, nil, nil, err
+		return false
+	}
+	c.blockIdx, c.block, c.offsets = i, block, offsets
+	return true
+}
+
+// forward reads the entry at pos, or if pos is past the end of its block the
+// first entry of the next block that has one.
+func (c *Cursor) forward() bool {
+	for c.pos >= len(c.offsets) {
+		if c.blockIdx+1 >= len(c.hfile.index) {
+			c.valid, c.key, c.value = false, nil, nil
+			return false
+		}
+		if !c.load(c.blockIdx + 1) {
+			return false
+		}
+		c.pos = 0
+	}
+	return c.read()
+}
+
+// backward reads the entry at pos, or if pos is before the start of its block
+// the last entry of the previous block that has one.
+func (c *Cursor) backward() bool {
+	for c.pos < 0 {
+		if c.blockIdx == 0 {
+			c.valid, c.key, c.value = false, nil, nil
+			return false
+		}
+		if !c.load(c.blockIdx - 1) {
+			return false
+		}
+		c.pos = len(c.offsets) - 1
+	}
+	return c.read()
+}
+
+func (c *Cursor) read() bool {
+	c.block.Seek(c.offsets[c.pos], 0)
+	keyLen, valLen, _ := readEntryLengths(c.block) // checked by loadEntryOffsets
+	key := make([]byte, keyLen)
+	value := make([]byte, valLen)
+	if err := readEntry(c.block, key, value); err != nil {
+		c.valid, c.key, c.value, c.err = false, nil, nil, fmt.Errorf("block %d: %s", c.blockIdx, err)
+		return false
+	}
+	c.valid, c.key, c.value = true, key, value
+	return true
+}
+
+// keyAt returns the key of the entry starting at off in the current block,
+// valid until the next call.
+func (c *Cursor) keyAt(off int64) []byte {
+	var keyLen [4]byte
+	c.block.ReadAt(keyLen[:], off)
+	c.scratch = resize(c.scratch, binary.BigEndian.Uint32(keyLen[:]))
+	c.block.ReadAt(c.scratch, off+8)
+	return c.scratch
+}
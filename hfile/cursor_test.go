@@ -0,0 +1,103 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// cursorEntries are even keys, with a run of one of them across blocks.
+func cursorEntries() []testEntry {
+	var entries []testEntry
+	for i := 0; i < 200; i += 2 {
+		entries = append(entries, testEntry{fmt.Sprintf("key%06d", i), fmt.Sprintf("value%d", i)})
+		if i == 100 {
+			for j := 0; j < 20; j++ {
+				entries = append(entries, testEntry{fmt.Sprintf("key%06d", i), fmt.Sprintf("run%d", j)})
+			}
+		}
+	}
+	return entries
+}
+
+func cursorEntry(c *Cursor) testEntry {
+	return testEntry{string(c.Key()), string(c.Value())}
+}
+
+func TestCursorWalk(t *testing.T) {
+	entries := cursorEntries()
+	r := parseEntries(t, WriterOptions{Compression: "snappy", BlockSize: 128}, entries)
+	c := r.NewCursor()
+
+	var got []testEntry
+	for ok := c.First(); ok; ok = c.Next() {
+		got = append(got, cursorEntry(c))
+	}
+	if c.Err() != nil || c.Valid() || !reflect.DeepEqual(got, entries) {
+		t.Errorf("forward: got %d entries, %v", len(got), c.Err())
+	}
+	got = got[:0]
+	for ok := c.Last(); ok; ok = c.Prev() {
+		got = append(got, cursorEntry(c))
+	}
+	for i, j := 0, len(got)-1; i < j; i, j = i+1, j-1 {
+		got[i], got[j] = got[j], got[i]
+	}
+	if c.Err() != nil || c.Valid() || !reflect.DeepEqual(got, entries) {
+		t.Errorf("backward: got %d entries, %v", len(got), c.Err())
+	}
+
+	// Stepping past an end leaves the cursor there.
+	if !c.Last() || c.Next() || c.Prev() {
+		t.Error("Prev placed the cursor again after Next went past the end")
+	}
+
+	if c := parseEntries(t, WriterOptions{}, nil).NewCursor(); c.First() || c.Last() || c.SeekGE(nil) || c.Err() != nil {
+		t.Errorf("empty file: got %v", c.Err())
+	}
+	r.Close()
+	if c.First() || c.Err() != ErrClosed {
+		t.Errorf("after Close: got %v, want %v", c.Err(), ErrClosed)
+	}
+}
+
+func TestCursorSeek(t *testing.T) {
+	entries := cursorEntries()
+	r := parseEntries(t, WriterOptions{BlockSize: 128}, entries)
+	c := r.NewCursor()
+	for i := -1; i <= 200; i++ {
+		key := fmt.Sprintf("key%06d", i)
+
+		// The first entry >= key, then the rest of the file after it.
+		ge := 0
+		for ge < len(entries) && entries[ge].key < key {
+			ge++
+		}
+		if ok := c.SeekGE([]byte(key)); ok != (ge < len(entries)) || ok && cursorEntry(c) != entries[ge] {
+			t.Errorf("SeekGE(%s): got %v at %v, want %d", key, ok, cursorEntry(c), ge)
+			continue
+		}
+		for j := ge + 1; j < ge+3 && j < len(entries); j++ {
+			if !c.Next() || cursorEntry(c) != entries[j] {
+				t.Errorf("SeekGE(%s) then Next: got %v, want %v", key, cursorEntry(c), entries[j])
+			}
+		}
+
+		// The last entry <= key, then the file before it.
+		le := len(entries) - 1
+		for le >= 0 && entries[le].key > key {
+			le--
+		}
+		if ok := c.SeekLE([]byte(key)); ok != (le >= 0) || ok && cursorEntry(c) != entries[le] {
+			t.Errorf("SeekLE(%s): got %v at %v, want %d", key, ok, cursorEntry(c), le)
+			continue
+		}
+		for j := le - 1; j > le-3 && j >= 0; j-- {
+			if !c.Prev() || cursorEntry(c) != entries[j] {
+				t.Errorf("SeekLE(%s) then Prev: got %v, want %v", key, cursorEntry(c), entries[j])
+			}
+		}
+	}
+}
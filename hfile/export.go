@@ -0,0 +1,45 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// Export writes every entry in the file to w in key order, for tools that do
+// not read HFiles. Each entry is written as
+//
+//	key length (4) | key | value length (4) | value
+//
+// with the lengths big-endian, and nothing before, between or after the
+// entries, so the output ends where the last value does. Entries are decoded
+// a block at a time and written through a buffer, so memory use does not
+// grow with the file. If a block cannot be decoded, the entries before it
+// will already have been written.
+func (r *Reader) Export(w io.Writer) error {
+	if r.closed {
+		return ErrClosed
+	}
+
+	out := bufio.NewWriter(w)
+	it := r.NewIterator()
+	it.ReuseBuffers(true)
+	var length [4]byte
+	for it.Next() {
+		binary.BigEndian.PutUint32(length[:], uint32(len(it.Key())))
+		out.Write(length[:])
+		out.Write(it.Key())
+		binary.BigEndian.PutUint32(length[:], uint32(len(it.Value())))
+		out.Write(length[:])
+		if _, err := out.Write(it.Value()); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		out.Flush()
+		return err
+	}
+	return out.Flush()
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// readExport parses Export's output back into entries.
+func readExport(t *testing.T, data []byte) []testEntry {
+	t.Helper()
+	var entries []testEntry
+	buf := bytes.NewReader(data)
+	field := func() string {
+		var length [4]byte
+		if _, err := io.ReadFull(buf, length[:]); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, binary.BigEndian.Uint32(length[:]))
+		if _, err := io.ReadFull(buf, b); err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	for buf.Len() > 0 {
+		key := field()
+		entries = append(entries, testEntry{key, field()})
+	}
+	return entries
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestExport(t *testing.T) {
+	entries := append(sequentialEntries(500), testEntry{"z", ""}, testEntry{"z", "again"})
+	r := parseEntries(t, WriterOptions{Compression: "snappy", BlockSize: 256}, entries)
+	var out bytes.Buffer
+	if err := r.Export(&out); err != nil {
+		t.Fatal(err)
+	}
+	if got := readExport(t, out.Bytes()); !reflect.DeepEqual(got, entries) {
+		t.Errorf("got %d entries, want %d", len(got), len(entries))
+	}
+
+	if err := r.Export(failingWriter{}); err == nil || err.Error() != "disk full" {
+		t.Errorf("got %v, want the writer's error", err)
+	}
+
+	out.Reset()
+	if err := parseEntries(t, WriterOptions{}, nil).Export(&out); err != nil || out.Len() != 0 {
+		t.Errorf("empty file: got %d bytes, %v", out.Len(), err)
+	}
+}
+
+func TestExportError(t *testing.T) {
+	entries := sequentialEntries(500)
+	data := writeEntries(t, WriterOptions{BlockSize: 256}, entries)
+	r, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Block 4's first value runs past the end of the block.
+	binary.BigEndian.PutUint32(data[r.index[4].offset+12:], 1<<20)
+	first := string(r.index[4].firstKeyBytes)
+
+	var out bytes.Buffer
+	if err := r.Export(&out); err == nil {
+		t.Error("got no error")
+	}
+	// The entries before the bad block were written out.
+	got := readExport(t, out.Bytes())
+	if len(got) == 0 || len(got) >= len(entries) || entries[len(got)].key != first || !reflect.DeepEqual(got, entries[:len(got)]) {
+		t.Errorf("got %d entries, want those before %s", len(got), first)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// testEntry is a key and value for building fixture files.
+type testEntry struct {
+	key, value string
+}
+
+// sequentialEntries returns n entries with distinct keys in ascending order.
+func sequentialEntries(n int) []testEntry {
+	entries := make([]testEntry, n)
+	for i := range entries {
+		entries[i] = testEntry{fmt.Sprintf("key%06d", i), fmt.Sprintf("value%d", i)}
+	}
+	return entries
+}
+
+// writeEntries writes entries, which must be in key order, to a new file.
+func writeEntries(t testing.TB, opts WriterOptions, entries []testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if err := w.Add([]byte(e.key), []byte(e.value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// writeUnsorted writes entries in the order given, which Writer.Add would
+// reject unless it is bytewise, for files ordered by another comparator.
+func writeUnsorted(t testing.TB, opts WriterOptions, entries []testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		w.lastKey = nil // skips the order check
+		if err := w.Add([]byte(e.key), []byte(e.value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// parseEntries writes entries to a new file and opens it.
+func parseEntries(t testing.TB, opts WriterOptions, entries []testEntry) *Reader {
+	t.Helper()
+	r, err := Parse(writeEntries(t, opts, entries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// readAll returns every entry in r, in file order.
+func readAll(t testing.TB, r *Reader) []testEntry {
+	t.Helper()
+	var entries []testEntry
+	it := r.NewIterator()
+	for it.Next() {
+		entries = append(entries, testEntry{string(it.Key()), string(it.Value())})
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
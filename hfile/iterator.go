@@ -4,43 +4,201 @@ package hfile
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
 )
 
+// Iterator walks every entry in the file in key order. Blocks are decoded as
+// Next reaches them; if one cannot be, Next returns false and Err says why.
+//
+// The iterator itself holds on to nothing but the block it is in and those
+// Readahead is fetching. With the reader's block cache on, though, each block
+// a scan decodes is kept in the cache as well, so a full scan fills the cache
+// up to its SetBlockCacheBytes budget, evicting blocks that other lookups may
+// want again, unless SetScanMemoryBudget caps how much of it each scan takes.
 type Iterator struct {
 	hfile          *Reader
 	dataBlockIndex int
 	block          *bytes.Reader
 	key            []byte
 	value          []byte
+	reuse          bool
+	err            error
+	ctx            context.Context
+	stopAtBlockEnd bool // for BlockIterator, which keeps to one block
+
+	// Blocks being fetched ahead of the iterator, by index.
+	readahead int
+	pending   map[int]chan prefetchedBlock
+
+	// The blocks the iterator added to the block cache, oldest first, and
+	// their total size, kept within the reader's ScanMemoryBudget.
+	added      []addedBlock
+	addedBytes int
+}
+
+type prefetchedBlock struct {
+	block  *bytes.Reader
+	cached bool // whether the fetch added it to the block cache
+	err    error
+}
+
+type addedBlock struct {
+	offset uint64
+	size   int
 }
 
 func (hfile *Reader) NewIterator() *Iterator {
-	it := Iterator{hfile, 0, nil, nil, nil}
+	return hfile.NewIteratorContext(context.Background())
+}
+
+// NewIteratorContext is NewIterator, except that before decoding each block
+// the iterator checks ctx, stopping with ctx's error once it is done. Entries
+// within a block already decoded carry on regardless, so cancellation takes
+// effect at the next block boundary, before the next read of the file.
+func (hfile *Reader) NewIteratorContext(ctx context.Context) *Iterator {
+	it := Iterator{hfile, 0, nil, nil, nil, false, nil, ctx, false, 0, nil, nil, 0}
 	return &it
 }
 
+// Readahead makes an iterator over a NewReaderAt source fetch and decode the
+// n blocks after the one it is in, each in its own goroutine, so that a scan
+// waits on one round trip per n blocks rather than per block. Blocks already
+// in the reader's block cache are taken from it. A fetch that has started
+// finishes on its own even if the scan stops, and none start once the
+// iterator's context is done. It is off by default, and does nothing for
+// mapped files, where the kernel already reads ahead.
+func (it *Iterator) Readahead(n int) {
+	if it.hfile.source == nil {
+		return
+	}
+	it.readahead = n
+}
+
+// getBlock is GetBlock, unless the iterator's context is done, taking the
+// block from readahead if it was fetched ahead and starting the fetch of
+// those after it.
+func (it *Iterator) getBlock(i int) (*bytes.Reader, error) {
+	if err := it.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var block *bytes.Reader
+	var cached bool
+	var err error
+	if c, ok := it.pending[i]; ok {
+		delete(it.pending, i)
+		fetched := <-c
+		block, cached, err = fetched.block, fetched.cached, fetched.err
+	} else {
+		block, cached, err = it.hfile.fetchBlock(i)
+	}
+	if cached && it.hfile.scanBudget > 0 {
+		it.keepWithinBudget(i, int(block.Size()))
+	}
+
+	for next := i + 1; next <= i+it.readahead && next < len(it.hfile.index); next++ {
+		if _, ok := it.pending[next]; ok {
+			continue
+		}
+		if it.pending == nil {
+			it.pending = make(map[int]chan prefetchedBlock)
+		}
+		c := make(chan prefetchedBlock, 1)
+		it.pending[next] = c
+		go func(next int) {
+			if err := it.ctx.Err(); err != nil {
+				c <- prefetchedBlock{nil, false, err}
+				return
+			}
+			block, cached, err := it.hfile.fetchBlock(next)
+			c <- prefetchedBlock{block, cached, err}
+		}(next)
+	}
+	return block, err
+}
+
+// keepWithinBudget notes that the iterator added block i, of size bytes, to
+// the block cache, and drops the earliest blocks it added from the cache
+// until those left fit in the reader's ScanMemoryBudget.
+func (it *Iterator) keepWithinBudget(i int, size int) {
+	it.added = append(it.added, addedBlock{it.hfile.index[i].offset, size})
+	it.addedBytes += size
+	for it.addedBytes > it.hfile.scanBudget {
+		oldest := it.added[0]
+		it.added = it.added[1:]
+		it.addedBytes -= oldest.size
+		if it.hfile.cache != nil {
+			it.hfile.cache.remove(oldest.offset)
+		}
+	}
+}
+
+// ReuseBuffers makes Next decode into the same key and value buffers every
+// time instead of allocating new ones. When enabled, the slices returned by
+// Key and Value are overwritten by the following call to Next; use Copy to
+// keep an entry around.
+func (it *Iterator) ReuseBuffers(reuse bool) {
+	it.reuse = reuse
+}
+
 func (it *Iterator) Next() bool {
-	if it.dataBlockIndex >= len(it.hfile.index) {
+	if it.err == nil && it.hfile.closed {
+		it.err = ErrClosed
+	}
+	if it.err != nil || it.dataBlockIndex >= len(it.hfile.index) {
 		return false
 	}
 
 	if it.block == nil {
-		it.block, _ = it.hfile.GetBlock(it.dataBlockIndex)
+		block, err := it.getBlock(it.dataBlockIndex)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.block = block
 	}
 
 	if it.block.Len() <= 0 {
+		// A skipped bad entry leaves the block at its end too.
+		if it.stopAtBlockEnd {
+			return false
+		}
 		it.dataBlockIndex += 1
+		it.block = nil
 		return it.Next()
 	}
 
-	var keyLen, valLen uint32
-	binary.Read(it.block, binary.BigEndian, &keyLen)
-	binary.Read(it.block, binary.BigEndian, &valLen)
-	it.key = make([]byte, keyLen)
-	it.value = make([]byte, valLen)
-	it.block.Read(it.key)
-	it.block.Read(it.value)
+	start := it.block.Size() - int64(it.block.Len())
+	keyLen, valLen, ok := readEntryLengths(it.block)
+	if !ok {
+		err := fmt.Errorf("truncated entry in block %d", it.dataBlockIndex)
+		if it.hfile.skipBadEntry(it.block, start, err) {
+			return it.Next()
+		}
+		it.err = err
+		return false
+	}
+	if it.reuse {
+		it.key = resize(it.key, keyLen)
+		it.value = resize(it.value, valLen)
+	} else {
+		it.key = make([]byte, keyLen)
+		it.value = make([]byte, valLen)
+	}
+	if err := readEntry(it.block, it.key, it.value); err != nil {
+		err = fmt.Errorf("block %d: %s", it.dataBlockIndex, err)
+		if it.hfile.skipBadEntry(it.block, start, err) {
+			return it.Next()
+		}
+		it.err = err
+		return false
+	}
 	return true
 }
 
@@ -51,3 +209,463 @@ func (it *Iterator) Key() []byte {
 func (it *Iterator) Value() []byte {
 	return it.value
 }
+
+// Err returns the error that ended iteration early, or nil if Next simply ran
+// out of entries.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Seek moves to the first entry with a key >= key and returns true, or false
+// if every key in the file is smaller. Key and Value then return that entry and
+// Next carries on from it, across block boundaries, in key order.
+func (it *Iterator) Seek(key []byte) bool {
+	it.err = nil
+	if err := it.seek(key); err != nil {
+		it.err = err
+		return false
+	}
+	return it.Next()
+}
+
+// seek positions the iterator so that the following call to Next returns the
+// first entry with a key >= key.
+func (it *Iterator) seek(key []byte) error {
+	if it.hfile.closed {
+		return ErrClosed
+	}
+
+	// The entries for key may start in the block before the first one whose
+	// first key is >= key, so begin there.
+	idx := sort.Search(len(it.hfile.index), func(i int) bool {
+		return it.hfile.compareKeys(it.hfile.index[i].firstKeyBytes, key) >= 0
+	})
+	if idx > 0 {
+		idx -= 1
+	}
+
+	it.dataBlockIndex = idx
+	it.block = nil
+	it.pending = nil // they finish into buffered channels and are dropped
+	for it.dataBlockIndex < len(it.hfile.index) {
+		block, err := it.getBlock(it.dataBlockIndex)
+		if err != nil {
+			return err
+		}
+		it.block = block
+
+		for block.Len() > 0 {
+			start := block.Size() - int64(block.Len())
+			keyLen, valLen, ok := readEntryLengths(block)
+			if !ok {
+				err := fmt.Errorf("truncated entry in block %d", it.dataBlockIndex)
+				if it.hfile.skipBadEntry(block, start, err) {
+					break
+				}
+				return err
+			}
+			keyBytes := make([]byte, keyLen)
+			if _, err := io.ReadFull(block, keyBytes); err != nil {
+				err = fmt.Errorf("block %d: %s", it.dataBlockIndex, err)
+				if it.hfile.skipBadEntry(block, start, err) {
+					break
+				}
+				return err
+			}
+			if it.hfile.compareKeys(keyBytes, key) >= 0 {
+				block.Seek(-(int64(keyLen) + 8), 1)
+				return nil
+			}
+			block.Seek(int64(valLen), 1)
+		}
+
+		it.dataBlockIndex += 1
+		it.block = nil
+	}
+	return nil
+}
+
+// Copy returns copies of the current key and value that stay valid across
+// calls to Next.
+func (it *Iterator) Copy() ([]byte, []byte) {
+	key := make([]byte, len(it.key))
+	copy(key, it.key)
+	value := make([]byte, len(it.value))
+	copy(value, it.value)
+	return key, value
+}
+
+// resize returns buf resliced to n bytes, allocating only if it is too small.
+func resize(buf []byte, n uint32) []byte {
+	if uint32(cap(buf)) < n {
+		return make([]byte, n)
+	}
+	return buf[:n]
+}
+
+const positionTokenVersion = 1
+
+// Position returns an opaque token recording where the iterator is. Passing it
+// to NewIteratorFrom resumes with the entry after the one last returned by
+// Next. Tokens are tied to the file that produced them.
+func (it *Iterator) Position() []byte {
+	var offset int64
+	if it.block != nil {
+		offset = it.block.Size() - int64(it.block.Len())
+	}
+
+	token := make([]byte, 9+2*binary.MaxVarintLen64)
+	token[0] = positionTokenVersion
+	binary.BigEndian.PutUint64(token[1:9], it.hfile.fingerprint())
+	n := 9
+	n += binary.PutUvarint(token[n:], uint64(it.dataBlockIndex))
+	n += binary.PutUvarint(token[n:], uint64(offset))
+	return token[:n]
+}
+
+// NewIteratorFrom resumes iteration at a token returned by Position.
+func (hfile *Reader) NewIteratorFrom(token []byte) (*Iterator, error) {
+	if len(token) < 9 || token[0] != positionTokenVersion {
+		return nil, errors.New("bad position token")
+	}
+	if hfile.closed {
+		return nil, ErrClosed
+	}
+	if binary.BigEndian.Uint64(token[1:9]) != hfile.fingerprint() {
+		return nil, errors.New("position token is from a different file")
+	}
+
+	buf := bytes.NewReader(token[9:])
+	idx, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return nil, errors.New("bad position token")
+	}
+	offset, err := binary.ReadUvarint(buf)
+	if err != nil || buf.Len() != 0 || idx > uint64(len(hfile.index)) {
+		return nil, errors.New("bad position token")
+	}
+
+	it := hfile.NewIterator()
+	it.dataBlockIndex = int(idx)
+	if offset == 0 {
+		return it, nil
+	}
+	if it.dataBlockIndex == len(hfile.index) {
+		return nil, errors.New("bad position token")
+	}
+
+	block, err := hfile.GetBlock(it.dataBlockIndex)
+	if err != nil {
+		return nil, err
+	}
+	// Position is only ever taken between entries, so any other offset is
+	// from a forged or corrupt token.
+	if offset != uint64(block.Size()) {
+		offsets := entryOffsets(block)
+		i := sort.Search(len(offsets), func(i int) bool {
+			return uint64(offsets[i]) >= offset
+		})
+		if i == len(offsets) || uint64(offsets[i]) != offset {
+			return nil, errors.New("bad position token")
+		}
+	}
+	block.Seek(int64(offset), 0)
+	it.block = block
+	return it, nil
+}
+
+// fingerprint identifies the file by hashing its trailer, which records the
+// offsets and counts of everything else in it.
+func (hfile *Reader) fingerprint() uint64 {
+	if hfile.closed {
+		return 0
+	}
+	trailer, err := hfile.readAt(hfile.header.index, hfile.size-hfile.header.index)
+	if err != nil {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write(trailer)
+	return h.Sum64()
+}
+
+// GetRange returns every key >= start and < end, along with its value, in key
+// order. The range may span any number of blocks; only those it touches are
+// decoded.
+func (hfile *Reader) GetRange(start, end []byte) ([][]byte, [][]byte, error) {
+	return hfile.getRange(context.Background(), start, end, 0)
+}
+
+// GetRangeContext is GetRange, giving up with ctx's error if ctx is done before
+// the range has been read.
+func (hfile *Reader) GetRangeContext(ctx context.Context, start, end []byte) ([][]byte, [][]byte, error) {
+	return hfile.getRange(ctx, start, end, 0)
+}
+
+// GetRangeLimit is GetRange, but returns only the first n entries of the
+// range, decoding no further than they reach. An n of 0 means no limit. To
+// read a range a page at a time when keys may have several entries, which a
+// page could end partway through, resume from an Iterator's Position instead.
+func (hfile *Reader) GetRangeLimit(start, end []byte, n int) ([][]byte, [][]byte, error) {
+	return hfile.getRange(context.Background(), start, end, n)
+}
+
+func (hfile *Reader) getRange(ctx context.Context, start, end []byte, limit int) ([][]byte, [][]byte, error) {
+	var keys, values [][]byte
+	it := hfile.NewIteratorContext(ctx)
+	for ok := it.Seek(start); ok && hfile.compareKeys(it.Key(), end) < 0; ok = it.Next() {
+		keys = append(keys, it.Key())
+		values = append(values, it.Value())
+		if len(keys) == limit {
+			break
+		}
+	}
+	return keys, values, it.Err()
+}
+
+// PrefixIterator walks the entries whose keys start with a prefix, in key
+// order. It is returned by GetPrefix.
+type PrefixIterator struct {
+	it      *Iterator
+	prefix  []byte
+	limit   int // 0 for none
+	n       int // entries returned so far
+	started bool
+	done    bool
+}
+
+// GetPrefix returns an iterator over every entry whose key starts with
+// prefix. It starts in the block where prefix would be and stops at the first
+// key past it, decoding one block at a time however many the entries span.
+func (hfile *Reader) GetPrefix(prefix []byte) *PrefixIterator {
+	return hfile.GetPrefixContext(context.Background(), prefix)
+}
+
+// GetPrefixContext is GetPrefix, with an iterator that stops with ctx's
+// error, reported by Err, once ctx is done.
+func (hfile *Reader) GetPrefixContext(ctx context.Context, prefix []byte) *PrefixIterator {
+	return &PrefixIterator{it: hfile.NewIteratorContext(ctx), prefix: prefix}
+}
+
+// Limit stops the iterator after n entries, however many more have the
+// prefix. An n of 0, the default, means no limit.
+func (p *PrefixIterator) Limit(n int) {
+	p.limit = n
+}
+
+func (p *PrefixIterator) Next() bool {
+	if p.done || (p.limit > 0 && p.n >= p.limit) {
+		return false
+	}
+	var ok bool
+	if !p.started {
+		p.started = true
+		ok = p.it.Seek(p.prefix)
+	} else {
+		ok = p.it.Next()
+	}
+	if !ok || !bytes.HasPrefix(p.it.Key(), p.prefix) {
+		p.done = true
+		return false
+	}
+	p.n += 1
+	return true
+}
+
+func (p *PrefixIterator) Key() []byte {
+	return p.it.Key()
+}
+
+func (p *PrefixIterator) Value() []byte {
+	return p.it.Value()
+}
+
+// Err returns the error that ended iteration early, or nil if Next simply ran
+// out of entries under the prefix.
+func (p *PrefixIterator) Err() error {
+	return p.it.Err()
+}
+
+// FilterIterator walks the entries that pass a filter, in key order. It is
+// returned by ScanFilter.
+type FilterIterator struct {
+	it     *Iterator
+	filter func(key, value []byte) bool
+	key    []byte
+	value  []byte
+}
+
+// ScanFilter returns an iterator over every entry for which filter returns
+// true. Entries are decoded into the same buffers, and only those that pass
+// are copied out, so the ones filtered away cost no allocations. The key and
+// value given to filter are overwritten by the next entry: filter must copy
+// them to keep them.
+func (hfile *Reader) ScanFilter(filter func(key, value []byte) bool) *FilterIterator {
+	it := hfile.NewIterator()
+	it.ReuseBuffers(true)
+	return &FilterIterator{it: it, filter: filter}
+}
+
+func (f *FilterIterator) Next() bool {
+	for f.it.Next() {
+		if f.filter(f.it.Key(), f.it.Value()) {
+			f.key, f.value = f.it.Copy()
+			return true
+		}
+	}
+	f.key, f.value = nil, nil
+	return false
+}
+
+func (f *FilterIterator) Key() []byte {
+	return f.key
+}
+
+func (f *FilterIterator) Value() []byte {
+	return f.value
+}
+
+// Err returns the error that ended iteration early, or nil if Next simply ran
+// out of entries.
+func (f *FilterIterator) Err() error {
+	return f.it.Err()
+}
+
+// BlockIterator walks the entries of a single data block, in key order. It is
+// returned by NewBlockIterator.
+type BlockIterator struct {
+	it *Iterator
+}
+
+// NewBlockIterator returns an iterator over the entries of data block i,
+// numbered as in BlockIndex, so that tools can split a file's blocks between
+// workers or look at one of them alone. The block is decoded here, so a
+// block that cannot be is an error now rather than from Err, as is an i out
+// of range.
+func (hfile *Reader) NewBlockIterator(i int) (*BlockIterator, error) {
+	if hfile.closed {
+		return nil, ErrClosed
+	}
+	if i < 0 || i >= len(hfile.index) {
+		return nil, fmt.Errorf("block %d out of range, file has %d", i, len(hfile.index))
+	}
+	block, err := hfile.GetBlock(i)
+	if err != nil {
+		return nil, fmt.Errorf("block %d: %s", i, err)
+	}
+	it := hfile.NewIterator()
+	it.dataBlockIndex = i
+	it.block = block
+	it.stopAtBlockEnd = true
+	return &BlockIterator{it}, nil
+}
+
+func (b *BlockIterator) Next() bool {
+	return b.it.Next()
+}
+
+func (b *BlockIterator) Key() []byte {
+	return b.it.Key()
+}
+
+func (b *BlockIterator) Value() []byte {
+	return b.it.Value()
+}
+
+// Err returns the error that ended iteration early, or nil if Next simply ran
+// out of entries in the block.
+func (b *BlockIterator) Err() error {
+	return b.it.Err()
+}
+
+// Ceiling returns the smallest key >= key and its value, or false if every key
+// in the file is smaller. Like GetFirst, it returns the first of the values of
+// a key that has several.
+func (hfile *Reader) Ceiling(key []byte) ([]byte, []byte, bool) {
+	it := hfile.NewIterator()
+	if !it.Seek(key) {
+		return nil, nil, false
+	}
+	return it.Key(), it.Value(), true
+}
+
+// Floor returns the greatest key <= key and its first value, or false if
+// every key in the file is larger.
+func (hfile *Reader) Floor(key []byte) ([]byte, []byte, bool) {
+	it := hfile.NewIterator()
+	if it.Seek(key) && hfile.compareKeys(it.Key(), key) == 0 {
+		return it.Key(), it.Value(), true
+	}
+	if it.Err() != nil {
+		return nil, nil, false
+	}
+
+	// Otherwise the floor is the last key smaller than key. The block it is in
+	// is the last one to start before key, though it may be that block's last
+	// entry, with the next block starting past key.
+	idx := sort.Search(len(hfile.index), func(i int) bool {
+		return hfile.compareKeys(hfile.index[i].firstKeyBytes, key) >= 0
+	})
+	if idx == 0 {
+		return nil, nil, false
+	}
+	it = hfile.NewIterator()
+	it.dataBlockIndex = idx - 1
+	var floor []byte
+	for it.Next() && hfile.compareKeys(it.Key(), key) < 0 {
+		floor = it.Key()
+	}
+	if floor == nil || it.Err() != nil {
+		return nil, nil, false
+	}
+
+	// Come back for the first of floor's values, which may be in an earlier
+	// block.
+	return hfile.Ceiling(floor)
+}
+
+// EqualPrefix reports whether a and b hold the same entries, in the same
+// order, among the keys that start with prefix. It stops at the first
+// difference and returns the key it is at: the one whose entries differ, or
+// whose entry only one of the files has, so that a sync can resume from there.
+// The key is nil when the files are equal.
+func EqualPrefix(a, b *Reader, prefix []byte) (bool, []byte, error) {
+	ia, ib := a.NewIterator(), b.NewIterator()
+	ia.ReuseBuffers(true)
+	ib.ReuseBuffers(true)
+	if err := ia.seek(prefix); err != nil {
+		return false, nil, err
+	}
+	if err := ib.seek(prefix); err != nil {
+		return false, nil, err
+	}
+
+	for {
+		okA := ia.Next() && bytes.HasPrefix(ia.Key(), prefix)
+		okB := ib.Next() && bytes.HasPrefix(ib.Key(), prefix)
+		if ia.Err() != nil {
+			return false, nil, ia.Err()
+		}
+		if ib.Err() != nil {
+			return false, nil, ib.Err()
+		}
+		switch {
+		case !okA && !okB:
+			return true, nil, nil
+		case !okB:
+			return false, append([]byte(nil), ia.Key()...), nil
+		case !okA:
+			return false, append([]byte(nil), ib.Key()...), nil
+		}
+		if cmp := a.compareKeys(ia.Key(), ib.Key()); cmp != 0 {
+			// The smaller key is the one missing from the other file.
+			if cmp > 0 {
+				return false, append([]byte(nil), ib.Key()...), nil
+			}
+			return false, append([]byte(nil), ia.Key()...), nil
+		}
+		if !bytes.Equal(ia.Key(), ib.Key()) || !bytes.Equal(ia.Value(), ib.Value()) {
+			return false, append([]byte(nil), ia.Key()...), nil
+		}
+	}
+}
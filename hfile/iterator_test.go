@@ -0,0 +1,501 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewIteratorFrom(t *testing.T) {
+	entries := sequentialEntries(50)
+	r := parseEntries(t, WriterOptions{BlockSize: 100}, entries)
+
+	for n := 0; n <= len(entries); n++ {
+		it := r.NewIterator()
+		for i := 0; i < n; i++ {
+			it.Next()
+		}
+		resumed, err := r.NewIteratorFrom(it.Position())
+		if err != nil {
+			t.Fatalf("after %d entries: %s", n, err)
+		}
+		var rest []testEntry
+		for resumed.Next() {
+			rest = append(rest, testEntry{string(resumed.Key()), string(resumed.Value())})
+		}
+		if len(rest) != len(entries)-n || (len(rest) > 0 && !reflect.DeepEqual(rest, entries[n:])) {
+			t.Fatalf("after %d entries resumed with %v", n, rest)
+		}
+	}
+}
+
+func TestNewIteratorFromRejectsBadTokens(t *testing.T) {
+	r := parseEntries(t, WriterOptions{BlockSize: 100}, sequentialEntries(50))
+	it := r.NewIterator()
+	it.Next()
+	token := it.Position()
+
+	// The same block, one byte into the entry after the one returned.
+	var forged bytes.Buffer
+	forged.Write(token[:9])
+	putUvarint(&forged, 0)
+	putUvarint(&forged, uint64(8+8+len("key000000")+len("value0")+1))
+	if _, err := r.NewIteratorFrom(forged.Bytes()); err == nil {
+		t.Error("accepted a token pointing into the middle of an entry")
+	}
+
+	other := parseEntries(t, WriterOptions{BlockSize: 100}, sequentialEntries(51))
+	if _, err := other.NewIteratorFrom(token); err == nil {
+		t.Error("accepted a token from a different file")
+	}
+
+	if _, err := r.NewIteratorFrom(token[:len(token)-1]); err == nil {
+		t.Error("accepted a truncated token")
+	}
+}
+
+func TestEqualPrefix(t *testing.T) {
+	base := []testEntry{{"a1", "x"}, {"b1", "x"}, {"b2", "x"}, {"b3", "x"}, {"c1", "x"}}
+	a := parseEntries(t, WriterOptions{BlockSize: 16}, base)
+
+	for _, test := range []struct {
+		name    string
+		entries []testEntry
+		prefix  string
+		diffKey string // "" if equal
+	}{
+		{"same", base, "b", ""},
+		{"outside prefix", []testEntry{{"a1", "y"}, {"b1", "x"}, {"b2", "x"}, {"b3", "x"}}, "b", ""},
+		{"value", []testEntry{{"a1", "x"}, {"b1", "x"}, {"b2", "y"}, {"b3", "x"}}, "b", "b2"},
+		{"missing", []testEntry{{"a1", "x"}, {"b1", "x"}, {"b3", "x"}}, "b", "b2"},
+		{"extra", []testEntry{{"a1", "x"}, {"b1", "x"}, {"b15", "x"}, {"b2", "x"}, {"b3", "x"}}, "b", "b15"},
+		{"shorter", []testEntry{{"a1", "x"}, {"b1", "x"}, {"b2", "x"}}, "b", "b3"},
+		{"longer", []testEntry{{"b1", "x"}, {"b2", "x"}, {"b3", "x"}, {"b4", "x"}}, "b", "b4"},
+	} {
+		b := parseEntries(t, WriterOptions{BlockSize: 16}, test.entries)
+		for _, order := range [][2]*Reader{{a, b}, {b, a}} {
+			equal, diffKey, err := EqualPrefix(order[0], order[1], []byte(test.prefix))
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			if equal != (test.diffKey == "") || string(diffKey) != test.diffKey {
+				t.Errorf("%s: got %v, %q, expected difference at %q", test.name, equal, diffKey, test.diffKey)
+			}
+		}
+	}
+}
+
+func TestReuseBuffers(t *testing.T) {
+	entries := sequentialEntries(100)
+	r := parseEntries(t, WriterOptions{BlockSize: 128}, entries)
+
+	it := r.NewIterator()
+	it.ReuseBuffers(true)
+	var copies []testEntry
+	var prevKey []byte
+	for i := 0; it.Next(); i++ {
+		if string(it.Key()) != entries[i].key || string(it.Value()) != entries[i].value {
+			t.Fatalf("entry %d is %s=%s, expected %v", i, it.Key(), it.Value(), entries[i])
+		}
+		if prevKey != nil && string(prevKey) != entries[i].key {
+			t.Fatalf("entry %d: key from the entry before is %s, expected the buffer to be reused", i, prevKey)
+		}
+		prevKey = it.Key()
+		key, value := it.Copy()
+		copies = append(copies, testEntry{string(key), string(value)})
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(copies, entries) {
+		t.Errorf("copied %d entries, expected %d", len(copies), len(entries))
+	}
+}
+
+func BenchmarkIterator(b *testing.B) {
+	r := parseEntries(b, WriterOptions{}, sequentialEntries(10000))
+	for _, reuse := range []bool{false, true} {
+		b.Run(fmt.Sprintf("reuse=%v", reuse), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				it := r.NewIterator()
+				it.ReuseBuffers(reuse)
+				for it.Next() {
+				}
+			}
+		})
+	}
+}
+
+// recordingSource serves data, remembering the offset of every read.
+type recordingSource struct {
+	data *bytes.Reader
+	mu   sync.Mutex
+	read map[int64]bool
+}
+
+func (s *recordingSource) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	s.read[off] = true
+	s.mu.Unlock()
+	return s.data.ReadAt(p, off)
+}
+
+func (s *recordingSource) wasRead(off uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read[int64(off)]
+}
+
+func TestReadahead(t *testing.T) {
+	entries := sequentialEntries(200)
+	data := writeEntries(t, WriterOptions{BlockSize: 256}, entries)
+	src := &recordingSource{data: bytes.NewReader(data), read: map[int64]bool{}}
+	r, err := NewReaderAt(src, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.index) < 6 {
+		t.Fatalf("got %d blocks, want more", len(r.index))
+	}
+
+	it := r.NewIterator()
+	it.Readahead(3)
+	if !it.Next() {
+		t.Fatal(it.Err())
+	}
+	// The fetches run in the background.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if src.wasRead(r.index[1].offset) && src.wasRead(r.index[2].offset) && src.wasRead(r.index[3].offset) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("blocks 1 to 3 were not read ahead")
+		}
+	}
+	if src.wasRead(r.index[4].offset) {
+		t.Error("read block 4, more than 3 ahead")
+	}
+
+	got := []testEntry{{string(it.Key()), string(it.Value())}}
+	for it.Next() {
+		got = append(got, testEntry{string(it.Key()), string(it.Value())})
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, entries) {
+		t.Errorf("read %d entries, want %d", len(got), len(entries))
+	}
+}
+
+func TestSeek(t *testing.T) {
+	// Even keys only, with key000010's entries running over a block boundary.
+	var entries []testEntry
+	for i := 0; i < 100; i += 2 {
+		entries = append(entries, testEntry{fmt.Sprintf("key%06d", i), fmt.Sprintf("value%d", i)})
+		if i == 10 {
+			for j := 0; j < 10; j++ {
+				entries = append(entries, testEntry{"key000010", fmt.Sprintf("more%d", j)})
+			}
+		}
+	}
+	r := parseEntries(t, WriterOptions{BlockSize: 64}, entries)
+	it := r.NewIterator()
+
+	// Seek in each direction, to present keys and the gaps between them.
+	for _, i := range []int{50, 51, 0, 10, 11, 98, 3, -1} {
+		key := []byte(fmt.Sprintf("key%06d", i))
+		if i < 0 {
+			key = nil
+		}
+		want := sort.Search(len(entries), func(n int) bool { return entries[n].key >= string(key) })
+		if !it.Seek(key) {
+			t.Fatalf("Seek(%s): %v", key, it.Err())
+		}
+		var got []testEntry
+		for ok := true; ok; ok = it.Next() {
+			got = append(got, testEntry{string(it.Key()), string(it.Value())})
+		}
+		if !reflect.DeepEqual(got, entries[want:]) {
+			t.Errorf("Seek(%s): got %d entries from %v, want %d from %v", key, len(got), got[0], len(entries)-want, entries[want])
+		}
+	}
+
+	if it.Seek([]byte("key000099")) {
+		t.Errorf("Seek past the last key: got %s", it.Key())
+	}
+	if err := it.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	entries := sequentialEntries(100)
+	r := parseEntries(t, WriterOptions{BlockSize: 64}, entries)
+	for _, test := range []struct {
+		start, end string
+		from, to   int
+	}{
+		{"key000010", "key000020", 10, 20},
+		{"key0000105", "key0000205", 11, 21},
+		{"", "key000005", 0, 5},
+		{"key000090", "z", 90, 100},
+		{"key000020", "key000020", 20, 20},
+		{"key000030", "key000020", 30, 30},
+		{"z", "zz", 100, 100},
+	} {
+		keys, values, err := r.GetRange([]byte(test.start), []byte(test.end))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != test.to-test.from || len(values) != len(keys) {
+			t.Errorf("[%s, %s): got %d keys and %d values, want %d", test.start, test.end, len(keys), len(values), test.to-test.from)
+			continue
+		}
+		for i := range keys {
+			if e := entries[test.from+i]; string(keys[i]) != e.key || string(values[i]) != e.value {
+				t.Errorf("[%s, %s): entry %d: got %s=%s, want %v", test.start, test.end, i, keys[i], values[i], e)
+			}
+		}
+	}
+}
+
+func TestFloorCeiling(t *testing.T) {
+	// c's values run over a block boundary.
+	r := parseEntries(t, WriterOptions{BlockSize: 20}, []testEntry{
+		{"b", "b1"}, {"c", "c1"}, {"c", "c2"}, {"c", "c3"}, {"e", "e1"}, {"g", "g1"},
+	})
+	for _, test := range []struct {
+		key            string
+		floor, ceiling string // key=value, or empty for none
+	}{
+		{"a", "", "b=b1"},
+		{"b", "b=b1", "b=b1"},
+		{"bb", "b=b1", "c=c1"},
+		{"c", "c=c1", "c=c1"},
+		{"d", "c=c1", "e=e1"},
+		{"f", "e=e1", "g=g1"},
+		{"g", "g=g1", "g=g1"},
+		{"h", "g=g1", ""},
+	} {
+		entry := func(key, value []byte, ok bool) string {
+			if !ok {
+				return ""
+			}
+			return string(key) + "=" + string(value)
+		}
+		if got := entry(r.Floor([]byte(test.key))); got != test.floor {
+			t.Errorf("Floor(%s): got %q, want %q", test.key, got, test.floor)
+		}
+		if got := entry(r.Ceiling([]byte(test.key))); got != test.ceiling {
+			t.Errorf("Ceiling(%s): got %q, want %q", test.key, got, test.ceiling)
+		}
+	}
+}
+
+func TestGetPrefix(t *testing.T) {
+	var entries []testEntry
+	for _, row := range []string{"a", "ab", "b", "ba", "bb", "c"} {
+		for i := 0; i < 10; i++ {
+			entries = append(entries, testEntry{fmt.Sprintf("%s/%d", row, i), row})
+		}
+	}
+	r := parseEntries(t, WriterOptions{BlockSize: 40}, entries)
+	under := func(prefix string) []testEntry {
+		var want []testEntry
+		for _, e := range entries {
+			if len(e.key) >= len(prefix) && e.key[:len(prefix)] == prefix {
+				want = append(want, e)
+			}
+		}
+		return want
+	}
+	for _, test := range []struct {
+		prefix string
+		limit  int
+	}{
+		{"", 0}, {"a", 0}, {"a/", 0}, {"b", 0}, {"b", 15}, {"ba/", 3}, {"bb/9", 0}, {"c/", 100}, {"d", 0}, {"0", 0},
+	} {
+		want := under(test.prefix)
+		if test.limit > 0 && len(want) > test.limit {
+			want = want[:test.limit]
+		}
+		p := r.GetPrefix([]byte(test.prefix))
+		p.Limit(test.limit)
+		var got []testEntry
+		for p.Next() {
+			got = append(got, testEntry{string(p.Key()), string(p.Value())})
+		}
+		if p.Err() != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%q, limit %d: got %v, %v, want %v", test.prefix, test.limit, got, p.Err(), want)
+		}
+		if p.Next() {
+			t.Errorf("%q, limit %d: Next went on after the end", test.prefix, test.limit)
+		}
+	}
+}
+
+func TestIteratorContext(t *testing.T) {
+	entries := sequentialEntries(200)
+	data := writeEntries(t, WriterOptions{BlockSize: 256}, entries)
+	src := &recordingSource{data: bytes.NewReader(data), read: map[int64]bool{}}
+	r, err := NewReaderAt(src, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.index) < 3 {
+		t.Fatalf("got %d blocks, want more", len(r.index))
+	}
+
+	// Cancelled partway through block 0, the iterator finishes it and reads
+	// nothing more.
+	ctx, cancel := context.WithCancel(context.Background())
+	it := r.NewIteratorContext(ctx)
+	if !it.Next() {
+		t.Fatal(it.Err())
+	}
+	cancel()
+	n := 1
+	for it.Next() {
+		n++
+	}
+	if it.Err() != context.Canceled {
+		t.Errorf("got %v, want %v", it.Err(), context.Canceled)
+	}
+	if first := string(r.index[1].firstKeyBytes); entries[n].key != first {
+		t.Errorf("got %d entries, want those before %s", n, first)
+	}
+	if src.wasRead(r.index[1].offset) {
+		t.Error("block 1 was read after the context was cancelled")
+	}
+
+	if keys, _, err := r.GetRangeContext(ctx, nil, []byte("zzz")); err != context.Canceled || len(keys) != 0 {
+		t.Errorf("GetRangeContext: got %d keys, %v", len(keys), err)
+	}
+	p := r.GetPrefixContext(ctx, []byte("key"))
+	if p.Next() || p.Err() != context.Canceled {
+		t.Errorf("GetPrefixContext: got %v", p.Err())
+	}
+	if keys, _, err := r.GetRangeContext(context.Background(), nil, []byte("zzz")); err != nil || len(keys) != len(entries) {
+		t.Errorf("GetRangeContext: got %d keys, %v", len(keys), err)
+	}
+}
+
+func TestScanFilter(t *testing.T) {
+	entries := sequentialEntries(500)
+	r := parseEntries(t, WriterOptions{Compression: "snappy", BlockSize: 256}, entries)
+	var want []testEntry
+	for i, e := range entries {
+		if i%7 == 0 {
+			want = append(want, e)
+		}
+	}
+	var seen [][]byte
+	it := r.ScanFilter(func(key, value []byte) bool {
+		seen = append(seen, key)
+		var n int
+		fmt.Sscanf(string(value), "value%d", &n)
+		return n%7 == 0
+	})
+	var got []testEntry
+	var keys [][]byte
+	for it.Next() {
+		got = append(got, testEntry{string(it.Key()), string(it.Value())})
+		keys = append(keys, it.Key())
+	}
+	if it.Err() != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, %v, want %v", got, it.Err(), want)
+	}
+	if len(seen) != len(entries) {
+		t.Fatalf("filter saw %d entries, want %d", len(seen), len(entries))
+	}
+	// The filter is given the same buffers each time, but the entries that
+	// pass are copied out of them.
+	if last := entries[len(entries)-1].key; string(seen[0]) != last {
+		t.Errorf("filter's first key is now %q, want it overwritten with %q", seen[0], last)
+	}
+	for i, key := range keys {
+		if string(key) != want[i].key {
+			t.Errorf("entry %d: got %q, want %q", i, key, want[i].key)
+		}
+	}
+	if it.Next() || it.Key() != nil || it.Value() != nil {
+		t.Error("Next went on after the end")
+	}
+}
+
+func TestBlockIterator(t *testing.T) {
+	entries := sequentialEntries(300)
+	r := parseEntries(t, WriterOptions{Compression: "lz4", BlockSize: 256}, entries)
+	if len(r.index) < 3 {
+		t.Fatalf("got %d blocks, want more", len(r.index))
+	}
+	// The blocks' entries, one after another, are the file's.
+	var got []testEntry
+	for i := range r.index {
+		it, err := r.NewBlockIterator(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for it.Next() {
+			if n == 0 && string(it.Key()) != string(r.index[i].firstKeyBytes) {
+				t.Errorf("block %d starts with %q", i, it.Key())
+			}
+			got = append(got, testEntry{string(it.Key()), string(it.Value())})
+			n++
+		}
+		if it.Err() != nil || n == 0 {
+			t.Errorf("block %d: got %d entries, %v", i, n, it.Err())
+		}
+		if it.Next() {
+			t.Errorf("block %d: Next went on after the end", i)
+		}
+	}
+	if !reflect.DeepEqual(got, entries) {
+		t.Errorf("got %d entries, want %d", len(got), len(entries))
+	}
+
+	for _, i := range []int{-1, len(r.index)} {
+		if _, err := r.NewBlockIterator(i); err == nil {
+			t.Errorf("block %d: got no error", i)
+		}
+	}
+	// A block that cannot be decoded fails here, not in Next.
+	r.index[1].size++
+	if _, err := r.NewBlockIterator(1); err == nil {
+		t.Error("damaged block: got no error")
+	}
+
+	// Skipping a bad entry skips the rest of its block, not into the next.
+	data := writeEntries(t, WriterOptions{BlockSize: 256}, entries)
+	r, err := NewReaderAtWithOptions(bytes.NewReader(data), int64(len(data)), ReaderOptions{
+		OnValueError: func(key []byte, err error) bool { return true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Block 1's first value runs past the end of the block.
+	binary.BigEndian.PutUint32(data[r.index[1].offset+12:], 1<<20)
+	it, err := r.NewBlockIterator(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it.Next() || it.Err() != nil {
+		t.Errorf("bad block: got %q, %v", it.Key(), it.Err())
+	}
+
+	r.Close()
+	if _, err := r.NewBlockIterator(0); err != ErrClosed {
+		t.Errorf("after Close: got %v, want %v", err, ErrClosed)
+	}
+}
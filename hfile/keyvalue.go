@@ -0,0 +1,136 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// KeyValueKey is the key HBase stores each cell under: the row, column family
+// and qualifier, timestamp and type of the cell, laid out as
+//
+//	row length (2) | row | family length (1) | family | qualifier | timestamp (8) | type (1)
+//
+// HBase files are not sorted bytewise in these keys. To look them up, give
+// the reader one of the comparators below with SetComparator, or
+// ReaderOptions.Comparator, and look up the key built by Bytes.
+// CompareKeyValues finds one version of one cell. CompareKeyValueColumns
+// treats every version of a cell as the same key, so that GetVersions returns
+// them all. CompareKeyValueRows does the same for every cell of a row, for
+// GetAll or GetVersions of a whole row. Only the parts of the key looked up
+// that the comparator compares matter.
+type KeyValueKey struct {
+	Row       []byte
+	Family    []byte
+	Qualifier []byte
+	Timestamp int64
+	Type      byte // 4 for a Put, 8 and up for the kinds of Delete
+}
+
+// ParseKeyValueKey splits a stored key into its parts, which are slices of
+// key.
+func ParseKeyValueKey(key []byte) (KeyValueKey, error) {
+	row, family, qualifier, ts, typ, ok := splitKeyValueKey(key)
+	if !ok {
+		return KeyValueKey{}, errors.New("malformed KeyValue key")
+	}
+	return KeyValueKey{row, family, qualifier, ts, typ}, nil
+}
+
+// Bytes lays the key out as HBase stores it. Row must be under 32k and
+// Family under 128 bytes.
+func (k KeyValueKey) Bytes() []byte {
+	b := make([]byte, 0, 2+len(k.Row)+1+len(k.Family)+len(k.Qualifier)+9)
+	b = append(b, byte(len(k.Row)>>8), byte(len(k.Row)))
+	b = append(b, k.Row...)
+	b = append(b, byte(len(k.Family)))
+	b = append(b, k.Family...)
+	b = append(b, k.Qualifier...)
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(k.Timestamp))
+	b = append(b, ts[:]...)
+	return append(b, k.Type)
+}
+
+// splitKeyValueKey is ParseKeyValueKey without the allocation, for the
+// comparators.
+func splitKeyValueKey(key []byte) (row, family, qualifier []byte, ts int64, typ byte, ok bool) {
+	if len(key) < 2 {
+		return
+	}
+	rowLen := int(binary.BigEndian.Uint16(key))
+	if len(key) < 2+rowLen+1 {
+		return
+	}
+	row = key[2 : 2+rowLen]
+	rest := key[2+rowLen:]
+	famLen := int(rest[0])
+	if len(rest) < 1+famLen+9 {
+		return
+	}
+	family = rest[1 : 1+famLen]
+	qualifier = rest[1+famLen : len(rest)-9]
+	ts = int64(binary.BigEndian.Uint64(rest[len(rest)-9:]))
+	typ = rest[len(rest)-1]
+	return row, family, qualifier, ts, typ, true
+}
+
+// CompareKeyValues orders KeyValue keys as HBase sorts cells: by row, family
+// and qualifier, then newest timestamp first, then by type, deletes before
+// the puts they cover. Keys too short to be KeyValue keys compare bytewise.
+func CompareKeyValues(a, b []byte) int {
+	return compareKeyValues(a, b, 3)
+}
+
+// CompareKeyValueColumns is CompareKeyValues, ignoring the timestamp and
+// type, so that every version of a cell compares equal.
+func CompareKeyValueColumns(a, b []byte) int {
+	return compareKeyValues(a, b, 2)
+}
+
+// CompareKeyValueRows is CompareKeyValues, comparing only the rows.
+func CompareKeyValueRows(a, b []byte) int {
+	return compareKeyValues(a, b, 1)
+}
+
+// compareKeyValues compares the first depth of the row, the column and the
+// version of two KeyValue keys.
+func compareKeyValues(a, b []byte, depth int) int {
+	aRow, aFamily, aQualifier, aTS, aType, aOK := splitKeyValueKey(a)
+	bRow, bFamily, bQualifier, bTS, bType, bOK := splitKeyValueKey(b)
+	if !aOK || !bOK {
+		return bytes.Compare(a, b)
+	}
+
+	if cmp := bytes.Compare(aRow, bRow); cmp != 0 || depth == 1 {
+		return cmp
+	}
+	if cmp := bytes.Compare(aFamily, bFamily); cmp != 0 {
+		return cmp
+	}
+	if cmp := bytes.Compare(aQualifier, bQualifier); cmp != 0 || depth == 2 {
+		return cmp
+	}
+	switch {
+	case aTS > bTS:
+		return -1
+	case aTS < bTS:
+		return 1
+	case aType > bType:
+		return -1
+	case aType < bType:
+		return 1
+	}
+	return 0
+}
+
+// keyValueComparator reports whether the Java comparator class orders
+// KeyValue keys, as CompareKeyValues does.
+func keyValueComparator(class string) bool {
+	return strings.HasSuffix(class, "KeyValue$KeyComparator") ||
+		strings.HasSuffix(class, ".CellComparator") ||
+		strings.HasSuffix(class, ".CellComparatorImpl")
+}
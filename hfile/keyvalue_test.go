@@ -0,0 +1,128 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestKeyValueKey(t *testing.T) {
+	k := KeyValueKey{Row: []byte("row"), Family: []byte("f"), Qualifier: []byte("q"), Timestamp: 1400000000000, Type: 4}
+	got, err := ParseKeyValueKey(k.Bytes())
+	if err != nil || !reflect.DeepEqual(got, k) {
+		t.Errorf("got %+v, %v, want %+v", got, err, k)
+	}
+	empty := KeyValueKey{Row: []byte{}, Family: []byte{}, Qualifier: []byte{}}
+	if got, err := ParseKeyValueKey(empty.Bytes()); err != nil || !reflect.DeepEqual(got, empty) {
+		t.Errorf("got %+v, %v, want %+v", got, err, empty)
+	}
+	// Too short to hold their rows, families and timestamps. A key cut short
+	// in its qualifier still parses, as one with a shorter qualifier.
+	noQualifier := KeyValueKey{Row: []byte("row"), Family: []byte("f")}
+	for _, key := range [][]byte{nil, {0}, {0, 3, 'r', 'o', 'w'}, noQualifier.Bytes()[:15]} {
+		if _, err := ParseKeyValueKey(key); err == nil {
+			t.Errorf("%v: got no error", key)
+		}
+	}
+}
+
+// keyValueOrder sorts KeyValue keys with CompareKeyValues.
+type keyValueOrder [][]byte
+
+func (k keyValueOrder) Len() int           { return len(k) }
+func (k keyValueOrder) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+func (k keyValueOrder) Less(i, j int) bool { return CompareKeyValues(k[i], k[j]) < 0 }
+
+func TestCompareKeyValues(t *testing.T) {
+	// In the order HBase sorts cells.
+	var keys [][]byte
+	for _, k := range []KeyValueKey{
+		{Row: []byte("a"), Family: []byte("f"), Qualifier: []byte("q"), Timestamp: 3, Type: 4},
+		{Row: []byte("a"), Family: []byte("f"), Qualifier: []byte("q"), Timestamp: 2, Type: 8},
+		{Row: []byte("a"), Family: []byte("f"), Qualifier: []byte("q"), Timestamp: 2, Type: 4},
+		{Row: []byte("a"), Family: []byte("f"), Qualifier: []byte("q"), Timestamp: 1, Type: 4},
+		{Row: []byte("a"), Family: []byte("f"), Qualifier: []byte("r"), Timestamp: 9, Type: 4},
+		{Row: []byte("a"), Family: []byte("g"), Qualifier: []byte(""), Timestamp: 9, Type: 4},
+		{Row: []byte("ab"), Family: []byte("f"), Qualifier: []byte("q"), Timestamp: 1, Type: 4},
+		{Row: []byte("b"), Family: []byte("f"), Qualifier: []byte("q"), Timestamp: 1, Type: 4},
+	} {
+		keys = append(keys, k.Bytes())
+	}
+	var sorted keyValueOrder
+	for i := len(keys) - 1; i >= 0; i-- {
+		sorted = append(sorted, keys[i])
+	}
+	sort.Sort(sorted)
+	if !reflect.DeepEqual([][]byte(sorted), keys) {
+		t.Errorf("got %q, want %q", sorted, keys)
+	}
+
+	for _, test := range []struct {
+		compare func(a, b []byte) int
+		a, b    int // indexes into keys
+		want    int
+	}{
+		{CompareKeyValues, 0, 0, 0},
+		{CompareKeyValues, 1, 2, -1},
+		{CompareKeyValueColumns, 0, 3, 0},
+		{CompareKeyValueColumns, 3, 4, -1},
+		{CompareKeyValueRows, 0, 5, 0},
+		{CompareKeyValueRows, 5, 6, -1},
+		{CompareKeyValueRows, 7, 6, 1},
+	} {
+		if got := test.compare(keys[test.a], keys[test.b]); got != test.want {
+			t.Errorf("keys %d and %d: got %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+	// Keys that are too short compare bytewise.
+	if got := CompareKeyValues([]byte("b"), []byte("a")); got != 1 {
+		t.Errorf("got %d", got)
+	}
+}
+
+func TestGetVersions(t *testing.T) {
+	// Ten cells of a hundred versions each, newest first as HBase writes
+	// them, across many blocks.
+	var entries []testEntry
+	for i := 0; i < 10; i++ {
+		for ts := int64(100); ts > 0; ts-- {
+			k := KeyValueKey{Row: []byte(fmt.Sprintf("row%d", i)), Family: []byte("f"), Qualifier: []byte("q"), Timestamp: ts, Type: 4}
+			entries = append(entries, testEntry{string(k.Bytes()), fmt.Sprintf("%d@%d", i, ts)})
+		}
+	}
+	r, err := Parse(writeUnsorted(t, WriterOptions{BlockSize: 256}, entries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetComparator(CompareKeyValueColumns)
+	if err := r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.index) < 30 {
+		t.Fatalf("got %d blocks, want runs across blocks", len(r.index))
+	}
+
+	s := NewScanner(r)
+	for i := 0; i < 10; i++ {
+		// Any timestamp finds every version.
+		lookup := KeyValueKey{Row: []byte(fmt.Sprintf("row%d", i)), Family: []byte("f"), Qualifier: []byte("q"), Timestamp: 12345}
+		keys, values, err := s.GetVersions(lookup.Bytes())
+		if err != nil || len(keys) != 100 || len(values) != 100 {
+			t.Fatalf("row%d: got %d keys, %d values, %v", i, len(keys), len(values), err)
+		}
+		for j := range keys {
+			ts := int64(100 - j)
+			k, err := ParseKeyValueKey(keys[j])
+			if err != nil || k.Timestamp != ts || string(values[j]) != fmt.Sprintf("%d@%d", i, ts) {
+				t.Errorf("row%d version %d: got %+v, %q, %v", i, j, k, values[j], err)
+			}
+		}
+	}
+	missing := KeyValueKey{Row: []byte("row5"), Family: []byte("f"), Qualifier: []byte("other")}
+	if keys, _, err := s.GetVersions(missing.Bytes()); err != nil || keys != nil {
+		t.Errorf("missing column: got %d keys, %v", len(keys), err)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+)
+
+// MultiReader presents several files, like the store files of one HBase
+// region, as a single one. Where files share a key, the one given earlier to
+// NewMultiReader wins: list them newest first for HBase's newest-file-wins.
+// Every file must be sorted the same way; keys are compared with the first
+// file's comparator.
+type MultiReader struct {
+	readers []*Reader
+}
+
+func NewMultiReader(readers ...*Reader) *MultiReader {
+	return &MultiReader{readers}
+}
+
+// MultiScanner looks up keys across the files of a MultiReader, with a
+// Scanner for each. Like a Scanner, it is not safe for concurrent use.
+type MultiScanner struct {
+	scanners []Scanner
+}
+
+func NewMultiScanner(m *MultiReader) MultiScanner {
+	scanners := make([]Scanner, len(m.readers))
+	for i, r := range m.readers {
+		scanners[i] = NewScanner(r)
+	}
+	return MultiScanner{scanners}
+}
+
+func (s *MultiScanner) Reset() {
+	for i := range s.scanners {
+		s.scanners[i].Reset()
+	}
+}
+
+// GetFirst returns key's first value in the first file that has it.
+func (s *MultiScanner) GetFirst(key []byte) ([]byte, error, bool) {
+	for i := range s.scanners {
+		value, err, ok := s.scanners[i].GetFirst(key)
+		if err != nil || ok {
+			return value, err, ok
+		}
+	}
+	return nil, nil, false
+}
+
+// GetAll returns key's values from every file, those of the file that wins
+// first and each file's in the order they are stored. ok reports whether any
+// file has key.
+func (s *MultiScanner) GetAll(key []byte) ([][]byte, error, bool) {
+	var values [][]byte
+	for i := range s.scanners {
+		found, err, _ := s.scanners[i].GetAll(key)
+		if err != nil {
+			return nil, err, false
+		}
+		values = append(values, found...)
+	}
+	return values, nil, len(values) > 0
+}
+
+// KVIterator is a sorted stream of entries: Iterator and the other iterators
+// in this package, or any source of entries in key order, like one generated
+// on the fly, that MergeIterators and CompactIterators should take alongside
+// them.
+type KVIterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Err() error
+}
+
+// MultiIterator walks every entry of every file of a MultiReader in key
+// order, merging an Iterator for each. Entries from several files under the
+// same key all appear, from the file that wins first.
+type MultiIterator struct {
+	heap    iteratorHeap
+	started bool
+	err     error
+}
+
+func (m *MultiReader) NewIterator() *MultiIterator {
+	its := make([]KVIterator, len(m.readers))
+	for i, r := range m.readers {
+		its[i] = r.NewIterator()
+	}
+	var compare func(a, b []byte) int
+	if len(m.readers) > 0 {
+		compare = m.readers[0].compareKeys
+	}
+	return MergeIterators(compare, its...)
+}
+
+// MergeIterators merges its, each in the order compare gives keys, into one
+// MultiIterator. Where several share a key, the one given earlier comes
+// first, as for NewMultiReader. A nil compare is bytes.Compare. Seek works
+// only if every one of its has a Seek like Iterator's.
+func MergeIterators(compare func(a, b []byte) int, its ...KVIterator) *MultiIterator {
+	if compare == nil {
+		compare = bytes.Compare
+	}
+	return &MultiIterator{heap: iteratorHeap{its: its, compare: compare}}
+}
+
+func (it *MultiIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	if !it.started {
+		it.started = true
+		for i, sub := range it.heap.its {
+			if !it.push(i, sub.Next()) {
+				return false
+			}
+		}
+		heap.Init(&it.heap)
+		return len(it.heap.order) > 0
+	}
+
+	if len(it.heap.order) == 0 {
+		return false
+	}
+	sub := it.heap.its[it.heap.order[0]]
+	if sub.Next() {
+		heap.Fix(&it.heap, 0)
+	} else {
+		heap.Pop(&it.heap)
+		if sub.Err() != nil {
+			it.err = sub.Err()
+			return false
+		}
+	}
+	return len(it.heap.order) > 0
+}
+
+// push adds sub-iterator i to the heap if ok says it has an entry, recording
+// its error otherwise. It reports whether iteration can go on.
+func (it *MultiIterator) push(i int, ok bool) bool {
+	if ok {
+		it.heap.order = append(it.heap.order, i)
+		return true
+	}
+	if err := it.heap.its[i].Err(); err != nil {
+		it.err = err
+		return false
+	}
+	return true
+}
+
+// Seek moves to the first entry with a key >= key in any file and returns
+// true, or false if every key in every file is smaller. Next carries on from
+// it in key order.
+func (it *MultiIterator) Seek(key []byte) bool {
+	it.err = nil
+	it.started = true
+	it.heap.order = it.heap.order[:0]
+	for i, sub := range it.heap.its {
+		seeker, ok := sub.(interface {
+			Seek(key []byte) bool
+		})
+		if !ok {
+			it.err = fmt.Errorf("merged iterator %d cannot seek", i)
+			return false
+		}
+		if !it.push(i, seeker.Seek(key)) {
+			return false
+		}
+	}
+	heap.Init(&it.heap)
+	return len(it.heap.order) > 0
+}
+
+func (it *MultiIterator) Key() []byte {
+	if len(it.heap.order) == 0 {
+		return nil
+	}
+	return it.heap.its[it.heap.order[0]].Key()
+}
+
+func (it *MultiIterator) Value() []byte {
+	if len(it.heap.order) == 0 {
+		return nil
+	}
+	return it.heap.its[it.heap.order[0]].Value()
+}
+
+// Err returns the error that ended iteration early, or nil if Next simply ran
+// out of entries.
+func (it *MultiIterator) Err() error {
+	return it.err
+}
+
+// iteratorHeap orders the sub-iterators that are on an entry by that entry's
+// key, and among equal keys by which file wins.
+type iteratorHeap struct {
+	its     []KVIterator
+	order   []int // indexes into its
+	compare func(a, b []byte) int
+}
+
+func (h iteratorHeap) Len() int      { return len(h.order) }
+func (h iteratorHeap) Swap(i, j int) { h.order[i], h.order[j] = h.order[j], h.order[i] }
+func (h iteratorHeap) Less(i, j int) bool {
+	if c := h.compare(h.its[h.order[i]].Key(), h.its[h.order[j]].Key()); c != 0 {
+		return c < 0
+	}
+	return h.order[i] < h.order[j]
+}
+
+func (h *iteratorHeap) Push(x interface{}) { h.order = append(h.order, x.(int)) }
+func (h *iteratorHeap) Pop() interface{} {
+	last := h.order[len(h.order)-1]
+	h.order = h.order[:len(h.order)-1]
+	return last
+}
@@ -0,0 +1,121 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"reflect"
+	"testing"
+)
+
+// multiFiles are three files, newest first, that share some keys.
+var multiFiles = [][]testEntry{
+	{{"b", "new"}, {"d", "new"}, {"f", "new1"}, {"f", "new2"}},
+	{{"a", "mid"}, {"d", "mid"}, {"g", "mid"}},
+	{{"a", "old"}, {"c", "old"}, {"f", "old"}, {"h", "old"}},
+}
+
+func newMultiReader(t *testing.T) *MultiReader {
+	var readers []*Reader
+	for _, entries := range multiFiles {
+		readers = append(readers, parseEntries(t, WriterOptions{BlockSize: 16}, entries))
+	}
+	return NewMultiReader(readers...)
+}
+
+func TestMultiScanner(t *testing.T) {
+	s := NewMultiScanner(newMultiReader(t))
+	for _, test := range []struct {
+		key   string
+		first string
+		all   []string
+	}{
+		{"a", "mid", []string{"mid", "old"}},
+		{"b", "new", []string{"new"}},
+		{"c", "old", []string{"old"}},
+		{"d", "new", []string{"new", "mid"}},
+		{"e", "", nil},
+		{"f", "new1", []string{"new1", "new2", "old"}},
+		{"h", "old", []string{"old"}},
+		{"i", "", nil},
+	} {
+		value, err, ok := s.GetFirst([]byte(test.key))
+		if err != nil || ok != (test.all != nil) || string(value) != test.first {
+			t.Errorf("GetFirst(%s): got %q, %v, %v", test.key, value, err, ok)
+		}
+		values, err, ok := s.GetAll([]byte(test.key))
+		var got []string
+		for _, v := range values {
+			got = append(got, string(v))
+		}
+		if err != nil || ok != (test.all != nil) || !reflect.DeepEqual(got, test.all) {
+			t.Errorf("GetAll(%s): got %q, %v, %v, want %q", test.key, got, err, ok, test.all)
+		}
+	}
+
+	// Reset starts the lookups over from the first key.
+	s.Reset()
+	if value, err, ok := s.GetFirst([]byte("a")); err != nil || !ok || string(value) != "mid" {
+		t.Errorf("after Reset: got %q, %v, %v", value, err, ok)
+	}
+}
+
+func TestMultiIterator(t *testing.T) {
+	want := []testEntry{
+		{"a", "mid"}, {"a", "old"}, {"b", "new"}, {"c", "old"}, {"d", "new"}, {"d", "mid"},
+		{"f", "new1"}, {"f", "new2"}, {"f", "old"}, {"g", "mid"}, {"h", "old"},
+	}
+	it := newMultiReader(t).NewIterator()
+	var got []testEntry
+	for it.Next() {
+		got = append(got, testEntry{string(it.Key()), string(it.Value())})
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, test := range []struct {
+		key  string
+		want int // index into want, or -1 past the end
+	}{{"", 0}, {"d", 4}, {"e", 6}, {"g", 9}, {"i", -1}} {
+		ok := it.Seek([]byte(test.key))
+		if ok != (test.want >= 0) {
+			t.Errorf("Seek(%q): got %v", test.key, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		got = got[:0]
+		for ok = true; ok; ok = it.Next() {
+			got = append(got, testEntry{string(it.Key()), string(it.Value())})
+		}
+		if !reflect.DeepEqual(got, want[test.want:]) {
+			t.Errorf("Seek(%q): got %v, want %v", test.key, got, want[test.want:])
+		}
+	}
+
+	if NewMultiReader().NewIterator().Next() {
+		t.Error("an empty MultiReader has entries")
+	}
+}
+
+func TestMergeIterators(t *testing.T) {
+	it := MergeIterators(nil,
+		&keyValueIterator{kvs: keyValues([]testEntry{{"b", "0"}, {"c", "0"}})},
+		&keyValueIterator{kvs: keyValues([]testEntry{{"a", "1"}, {"c", "1"}, {"d", "1"}})},
+	)
+	var got []testEntry
+	for it.Next() {
+		got = append(got, testEntry{string(it.Key()), string(it.Value())})
+	}
+	want := []testEntry{{"a", "1"}, {"b", "0"}, {"c", "0"}, {"c", "1"}, {"d", "1"}}
+	if it.Err() != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, %v, want %v", got, it.Err(), want)
+	}
+	if it.Seek([]byte("a")) || it.Err() == nil {
+		t.Error("Seek without a Seek on every iterator got no error")
+	}
+}
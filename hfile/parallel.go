@@ -0,0 +1,102 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"fmt"
+	"sync"
+)
+
+// scannedBlock is a data block decoded into its entries by a ParallelScan
+// worker.
+type scannedBlock struct {
+	keys   [][]byte
+	values [][]byte
+	err    error
+}
+
+// ParallelScan calls fn with every entry in the file, in key order, like an
+// Iterator, but decodes up to workers blocks at once ahead of the entries
+// being handed to fn, for full passes over large compressed files where
+// decompression is what takes the time. fn is called from one goroutine at a
+// time. The key and value it is given share a buffer with the rest of their
+// block; copy them to keep them without keeping the block. A block that
+// cannot be decoded stops the scan, and its error is returned once fn has
+// seen the entries of every block before it, but none of its own.
+func (r *Reader) ParallelScan(workers int, fn func(key, value []byte)) error {
+	if r.closed {
+		return ErrClosed
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	// The blocks' results come back in file order through order. slots
+	// keeps workers of them in flight at a time, decoding or decoded and
+	// waiting for fn. Nothing is still reading the file once this returns.
+	n := len(r.index)
+	order := make(chan chan scannedBlock, workers)
+	slots := make(chan struct{}, workers)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(done)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(order)
+		for i := 0; i < n; i++ {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			c := make(chan scannedBlock, 1)
+			order <- c
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				keys, values, err := r.scanBlock(i)
+				c <- scannedBlock{keys, values, err}
+			}(i)
+		}
+	}()
+
+	for c := range order {
+		block := <-c
+		<-slots
+		if block.err != nil {
+			return block.err
+		}
+		for j := range block.keys {
+			fn(block.keys[j], block.values[j])
+		}
+	}
+	return nil
+}
+
+// scanBlock decodes block i into its keys and values, which are slices of
+// one copy of the block.
+func (r *Reader) scanBlock(i int) ([][]byte, [][]byte, error) {
+	buf, err := r.GetBlock(i)
+	if err != nil {
+		return nil, nil, fmt.Errorf("block %d: %s", i, err)
+	}
+	data := make([]byte, buf.Size())
+	buf.ReadAt(data, 0)
+
+	var keys, values [][]byte
+	for buf.Len() > 0 {
+		keyLen, valLen, ok := readEntryLengths(buf)
+		if !ok {
+			return nil, nil, fmt.Errorf("truncated entry in block %d", i)
+		}
+		start := buf.Size() - int64(buf.Len())
+		mid := start + int64(keyLen)
+		end := mid + int64(valLen)
+		keys = append(keys, data[start:mid:mid])
+		values = append(values, data[mid:end:end])
+		buf.Seek(end, 0)
+	}
+	return keys, values, nil
+}
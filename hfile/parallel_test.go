@@ -0,0 +1,55 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestParallelScan(t *testing.T) {
+	entries := sequentialEntries(1000)
+	r := parseEntries(t, WriterOptions{Compression: "snappy", BlockSize: 256}, entries)
+	for _, workers := range []int{0, 1, 4, 64} {
+		var got []testEntry
+		err := r.ParallelScan(workers, func(key, value []byte) {
+			got = append(got, testEntry{string(key), string(value)})
+		})
+		if err != nil || !reflect.DeepEqual(got, entries) {
+			t.Errorf("%d workers: got %d entries, %v, want %d", workers, len(got), err, len(entries))
+		}
+	}
+
+	if err := parseEntries(t, WriterOptions{}, nil).ParallelScan(4, func(key, value []byte) {
+		t.Errorf("empty file: got %q", key)
+	}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParallelScanError(t *testing.T) {
+	entries := sequentialEntries(1000)
+	data := writeEntries(t, WriterOptions{BlockSize: 256}, entries)
+	r, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Block 5's first value runs past the end of the block.
+	binary.BigEndian.PutUint32(data[r.index[5].offset+12:], 1<<20)
+	first := string(r.index[5].firstKeyBytes)
+
+	for _, workers := range []int{1, 4, 64} {
+		var got []testEntry
+		err := r.ParallelScan(workers, func(key, value []byte) {
+			got = append(got, testEntry{string(key), string(value)})
+		})
+		if err == nil {
+			t.Errorf("%d workers: got no error", workers)
+		}
+		// Every entry before the bad block, and none after.
+		if len(got) >= len(entries) || entries[len(got)].key != first || !reflect.DeepEqual(got, entries[:len(got)]) {
+			t.Errorf("%d workers: got %d entries, want those before %s", workers, len(got), first)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+// FuzzParse checks that no input makes Parse, Validate or a full scan panic,
+// and that a file Validate passes can be scanned to the end. Run it with
+// go test -fuzz FuzzParse; without -fuzz it checks just the seeds.
+func FuzzParse(f *testing.F) {
+	dups := []testEntry{{"a", "1"}, {"b", "1"}, {"b", "2"}, {"b", "3"}, {"c", "1"}}
+	for _, codec := range []string{"none", "snappy", "lz4"} {
+		f.Add(writeEntries(f, WriterOptions{Compression: codec}, nil))
+		f.Add(writeEntries(f, WriterOptions{Compression: codec, BlockSize: 64}, sequentialEntries(20)))
+		f.Add(writeEntries(f, WriterOptions{Compression: codec, BlockSize: 8}, dups))
+		f.Add(writeEntries(f, WriterOptions{
+			Compression: codec,
+			FileInfo:    map[string][]byte{"info": []byte("value")},
+			Properties:  map[string]string{"property": "value"},
+		}, dups))
+	}
+	if sample, err := ioutil.ReadFile("../sample.hfile"); err == nil {
+		f.Add(sample)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r, err := Parse(data)
+		if err != nil {
+			return
+		}
+		valid := r.Validate() == nil
+
+		var entries uint64
+		it := r.NewIterator()
+		for it.Next() {
+			entries += 1
+		}
+		if valid && (it.Err() != nil || entries != r.EntryCount()) {
+			t.Fatalf("scanned %d of %d entries of a valid file: %v", entries, r.EntryCount(), it.Err())
+		}
+
+		r.MetaBlockNames()
+		r.Properties()
+		if key := r.FirstKey(); key != nil {
+			s := NewScanner(r)
+			s.GetAll(key)
+		}
+		r.LastKey()
+	})
+}
@@ -4,31 +4,100 @@ package hfile
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/edsrzf/mmap-go"
 	"github.com/golang/snappy"
+	"github.com/pierrec/lz4"
 )
 
+// A Reader may be shared by any number of goroutines. Lookups keep their
+// position in a Scanner or Iterator, which each goroutine should create for
+// itself; those are not safe for concurrent use. Close must not race with
+// lookups.
 type Reader struct {
+	lookups uint64 // keyed Scanner lookups, updated atomically; first for alignment
+
 	mmap         mmap.MMap
+	source       io.ReaderAt    // read from instead of mmap when not nil
+	windows      *mappedWindows // the source, for ReaderOptions.MapWindowBytes
+	readTimeout  time.Duration
+	size         uint64
 	name         string
-	majorVersion uint32
+	path         string // for Reopen, empty unless opened from a path
+	majorVersion uint32 // v3 is laid out as v2 is, but for cell tags
 	minorVersion uint32
 
 	header Header
 	index  []Block
 
-	debug bool
+	summaryLock sync.Mutex // guards entries and lastKeyBytes in index
+
+	// The parsed FileInfo block, and for v2 and v3 whether its key/value
+	// format follows each entry in a data block with a memstore timestamp,
+	// and for v3 whether it follows each value with the cell's tags.
+	fileInfo           map[string][]byte
+	includesMemstoreTS bool
+	includesTags       bool
+
+	// From FileInfo's gohfile widths, when every entry's key and value have
+	// the same lengths; entryWidth is 0 otherwise.
+	keyWidth   uint32
+	entryWidth int64
+
+	debug        bool
+	logger       *log.Logger
+	metrics      Metrics
+	tolerateSize bool
+
+	unframedSnappy bool
+
+	verifyChecksums bool
+	strictOrder     bool // whether parse checks the index's first keys are sorted
+
+	bloom       *bloomFilter // nil if the file has none we can use
+	ignoreBloom bool
+
+	cache      *blockCache // nil unless SetBlockCacheBytes turned it on
+	scanBudget int         // 0 unless SetScanMemoryBudget turned it on
+
+	onBlockDecoded func(index int, data []byte)
+	blockLoader    func(index int) ([]byte, bool)
+	onValueError   func(key []byte, err error) bool
+
+	compare func(a, b []byte) int // nil for bytes.Compare
+
+	mapped bool // whether Close should unmap mmap
+	closed bool
+}
+
+// ErrClosed is returned by lookups against a Reader after Close.
+var ErrClosed = errors.New("reader closed")
+
+// ErrReadTimeout is returned by opens and lookups whose read of a NewReaderAt
+// source took longer than the reader's ReadTimeout.
+var ErrReadTimeout = errors.New("read timed out")
+
+// Metrics receives a measurement each time a data block is decoded.
+type Metrics interface {
+	BlockDecoded(codec string, compressedBytes, uncompressedBytes int, elapsed time.Duration)
 }
 
 type Header struct {
-	index int
+	index uint64 // where the trailer starts
 
 	fileInfoOffset             uint64
 	dataIndexOffset            uint64
@@ -36,74 +105,860 @@ type Header struct {
 	metaIndexOffset            uint64
 	metaIndexCount             uint32
 	totalUncompressedDataBytes uint64
-	entryCount                 uint32
+	entryCount                 uint64
 	compressionCodec           uint32
+
+	// v2 and v3 only.
+	numDataIndexLevels   uint32
+	firstDataBlockOffset uint64
+	lastDataBlockOffset  uint64
+	comparatorClassName  string
 }
 
 type Block struct {
 	offset        uint64
 	size          uint32
 	firstKeyBytes []byte
+
+	// Filled in by summarizeBlock the first time they are needed.
+	entries      int // -1 until summarized
+	lastKeyBytes []byte
+
+	// Where each entry in the decoded block starts, filled in by
+	// blockEntryOffsets the first time a lookup lands in the block.
+	offsets []int64
 }
 
+// NewReader maps file into memory and parses its trailer and data index.
+//
+// Every read is served straight from the mapping, so there is no way to put a
+// deadline on it: on an NFS or FUSE backed file a page fault can block the
+// calling goroutine for as long as the filesystem hangs. To bound reads of
+// such files, open them with NewReaderAtWithOptions and a ReadTimeout.
 func NewReader(name string, file *os.File, lock, debug bool) (*Reader, error) {
-	hfile := new(Reader)
-	hfile.debug = debug
-	hfile.name = name
+	return NewReaderWithOptions(file, ReaderOptions{Name: name, Lock: lock, Debug: debug})
+}
+
+// ReaderOptions configures NewReaderWithOptions. The zero value of each field
+// is the same default a Reader from NewReader has, and each matches a setter
+// that can change it later, except that these apply while the file is
+// opened: Logger sees diagnostics from parsing the indexes, and
+// VerifyChecksums covers the index blocks too.
+type ReaderOptions struct {
+	Name   string // for log messages
+	Lock   bool   // mlock the mapping
+	Advice Advice // how the mapping will be read; see Advise
+	Debug  bool   // trace lookups to Logger, or the standard logger
+
+	Logger               *log.Logger   // see SetLogger
+	Metrics              Metrics       // see SetMetrics
+	TolerateSizeMismatch bool          // see SetTolerateSizeMismatch
+	AllowUnframedSnappy  bool          // see SetAllowUnframedSnappy
+	VerifyChecksums      bool          // see VerifyChecksums
+	IgnoreBloomFilter    bool          // see UseBloomFilter
+	BlockCacheBytes      int           // see SetBlockCacheBytes
+	ScanMemoryBudget     int           // see SetScanMemoryBudget
+	ReadTimeout          time.Duration // see SetReadTimeout
+
+	// StrictOrder fails the open if the data index lists blocks out of key
+	// order, which would otherwise send lookups to the wrong blocks without
+	// any error. It costs a key comparison per block, so it is off by
+	// default; turn it on for files that may be corrupt or from other
+	// writers. Unlike the other fields it has no setter, since it only
+	// applies while the index is loaded.
+	StrictOrder bool
+
+	// MapWindowBytes, if positive, maps the file in windows of about that
+	// many bytes rather than whole, for files too big for the address space
+	// or to bound how much of them is mapped: the trailer and indexes stay
+	// mapped, and data blocks are read through up to four windows at a
+	// time, mapped as lookups need them and unmapped least recently used
+	// first. Every read then copies out of a window, as for NewReaderAt,
+	// and the file must stay open until Close, since windows are mapped
+	// from it. Lock and Advice apply only to whole mappings, so they are
+	// ignored. Like StrictOrder, it has no setter.
+	MapWindowBytes int
+
+	// Comparator orders keys if the file is not sorted bytewise; see
+	// SetComparator.
+	Comparator func(a, b []byte) int
+
+	// OnBlockDecoded and BlockLoader let a cache of the caller's own hold
+	// decoded data blocks, alongside or instead of the block cache. Each
+	// time a lookup needs a block the block cache does not have,
+	// BlockLoader is asked for it first, by its number in BlockIndex, and
+	// if it has it the block is checked for its magic and used as given.
+	// Otherwise the block is read and decompressed, and the result passed
+	// to OnBlockDecoded. Either may be nil, and both may be called from any
+	// number of goroutines at once.
+	//
+	// A decoded block starts with its DATABLK* magic, followed by its
+	// entries in the v1 layout, whatever the file's version. Neither the
+	// reader nor the caller may modify it once it has been passed to
+	// OnBlockDecoded or returned from BlockLoader, as lookups go on reading
+	// from it. For uncompressed mapped files the slice passed to
+	// OnBlockDecoded is part of the mapping, valid only until Close: copy
+	// it to keep it longer.
+	OnBlockDecoded func(index int, data []byte)
+	BlockLoader    func(index int) ([]byte, bool)
+
+	// OnValueError decides what happens when an entry in a data block cannot
+	// be decoded, because its lengths run past the end of the block: it is
+	// called with the entry's key, or nil if even that is cut off, and the
+	// error. Returning true skips the entry, which since nothing after it
+	// can be found skips the rest of its block; false, or a nil
+	// OnValueError, fails the scan or lookup with the error, as by default.
+	// It applies to Iterators and what is built on them, like GetRange and
+	// GetPrefix, and to Scanner's GetFirst, GetAll, GetAllLimit and GetN.
+	OnValueError func(key []byte, err error) bool
+}
+
+// NewReaderWithOptions is NewReader, configured by opts.
+func NewReaderWithOptions(file *os.File, opts ReaderOptions) (*Reader, error) {
+	hfile := newReader(opts)
+
+	var err error
+	if opts.MapWindowBytes > 0 {
+		var info os.FileInfo
+		if info, err = file.Stat(); err != nil {
+			return hfile, err
+		}
+		hfile.windows = newMappedWindows(file, info.Size(), opts.MapWindowBytes)
+		hfile.source = hfile.windows
+		hfile.size = uint64(info.Size())
+	} else if hfile, err = mapWhole(hfile, file, opts); err != nil {
+		return hfile, err
+	}
+
+	if err = hfile.parse(); err != nil {
+		return hfile, err
+	}
+
+	if class, ok := hfile.ComparatorClass(); ok && opts.Comparator == nil && !bytewiseComparator(class) {
+		hfile.logf("[Reader.NewReader] %s: keys are ordered by %s, but lookups will compare them bytewise without a Comparator\n", hfile.name, class)
+	}
+
+	return hfile, nil
+}
+
+// mapWhole maps all of file for hfile, then advises and locks the mapping as
+// opts ask.
+func mapWhole(hfile *Reader, file *os.File, opts ReaderOptions) (*Reader, error) {
 	var err error
 	hfile.mmap, err = mmap.Map(file, mmap.RDONLY, 0)
 	if err != nil {
 		return hfile, err
 	}
+	hfile.mapped = true
+	hfile.size = uint64(len(hfile.mmap))
+
+	if opts.Advice != AdviceNormal {
+		if err = hfile.Advise(opts.Advice); err != nil {
+			hfile.logf("[Reader.NewReader] %s: ignoring madvise error: %s\n", hfile.name, err)
+		}
+	}
 
-	if lock {
-		log.Printf("[Reader.NewReader] locking %s...\n", hfile.name)
+	if opts.Lock {
+		hfile.logf("[Reader.NewReader] locking %s...\n", hfile.name)
 		if err = hfile.mmap.Lock(); err != nil {
-			log.Printf("[Reader.NewReader] error locking %s: %s\n", hfile.name, err.Error())
+			hfile.logf("[Reader.NewReader] error locking %s: %s\n", hfile.name, err.Error())
 			return nil, err
 		}
-		log.Printf("[Reader.NewReader] locked %s.\n", hfile.name)
+		hfile.logf("[Reader.NewReader] locked %s.\n", hfile.name)
+	}
+	return hfile, nil
+}
 
+// newReader returns a Reader configured by opts, with nothing read yet.
+func newReader(opts ReaderOptions) *Reader {
+	r := new(Reader)
+	r.debug = opts.Debug
+	r.name = opts.Name
+	r.logger = opts.Logger
+	r.metrics = opts.Metrics
+	r.tolerateSize = opts.TolerateSizeMismatch
+	r.unframedSnappy = opts.AllowUnframedSnappy
+	r.verifyChecksums = opts.VerifyChecksums
+	r.strictOrder = opts.StrictOrder
+	r.ignoreBloom = opts.IgnoreBloomFilter
+	r.SetBlockCacheBytes(opts.BlockCacheBytes)
+	r.SetScanMemoryBudget(opts.ScanMemoryBudget)
+	r.readTimeout = opts.ReadTimeout
+	r.compare = opts.Comparator
+	r.onBlockDecoded = opts.OnBlockDecoded
+	r.blockLoader = opts.BlockLoader
+	r.onValueError = opts.OnValueError
+	return r
+}
+
+// Close releases the file's mapping. Lookups made through the reader after
+// that fail with ErrClosed. Keys and values already handed out were copied
+// out of the mapping and remain valid. Closing more than once does nothing.
+func (r *Reader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.index = nil
+	r.cache = nil
+
+	var err error
+	if r.mapped {
+		err = r.mmap.Unmap()
+	}
+	if r.windows != nil {
+		err = r.windows.close()
+	}
+	r.mmap = nil
+	r.size = 0
+	return err
+}
+
+// Parse reads an HFile held entirely in data, such as a slice of a mapping
+// the caller made itself. Every constructor funnels through the same parse,
+// which checks each offset and length it reads from the file against data,
+// so malformed input produces an error rather than a panic. The caller keeps
+// ownership of data: Close does not unmap it, and it must not change while
+// the reader is in use.
+func Parse(data []byte) (*Reader, error) {
+	r := new(Reader)
+	r.mmap = mmap.MMap(data)
+	r.size = uint64(len(data))
+	if err := r.parse(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// NewReaderAt reads an HFile of size bytes through source, for files that are
+// not local or cannot be mapped: in memory, in object storage, or behind
+// any other io.ReaderAt. The trailer and indexes are read up front and data
+// blocks with one ReadAt each as lookups need them, so nothing else of the
+// file is fetched.
+func NewReaderAt(source io.ReaderAt, size int64) (*Reader, error) {
+	return NewReaderAtWithOptions(source, size, ReaderOptions{})
+}
+
+// NewReaderAtWithOptions is NewReaderAt, configured by opts. Lock and Advice
+// apply only to mappings, so they are ignored.
+func NewReaderAtWithOptions(source io.ReaderAt, size int64, opts ReaderOptions) (*Reader, error) {
+	if size < 0 {
+		return nil, errors.New("negative file size")
 	}
+	r := newReader(opts)
+	r.source = source
+	r.size = uint64(size)
+	if err := r.parse(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
 
-	v := binary.BigEndian.Uint32(hfile.mmap[len(hfile.mmap)-4:])
-	hfile.majorVersion = v & 0x00ffffff
-	hfile.minorVersion = v >> 24
+func (r *Reader) parse() error {
+	if r.size < 60 {
+		return errors.New("file too small to contain an HFile trailer")
+	}
 
-	hfile.header, err = hfile.newHeader(hfile.mmap)
+	version, err := r.readAt(r.size-4, 4)
 	if err != nil {
-		return hfile, err
+		return err
 	}
-	err = hfile.loadIndex(hfile.mmap)
+	v := binary.BigEndian.Uint32(version)
+	r.majorVersion = v & 0x00ffffff
+	r.minorVersion = v >> 24
+
+	r.header, err = r.newHeader()
 	if err != nil {
-		return hfile, err
+		return err
+	}
+	if r.windows != nil {
+		if err = r.windows.pin(int64(r.header.dataIndexOffset)); err != nil {
+			return err
+		}
+	}
+	if err = r.loadIndex(); err != nil {
+		return err
+	}
+	if err = r.checkIndexBounds(); err != nil {
+		return err
 	}
+	if r.strictOrder {
+		if err = r.checkIndexOrder(); err != nil {
+			return err
+		}
+	}
+	r.loadBloomFilter()
+	r.loadEntryWidth()
+	return nil
+}
 
-	return hfile, nil
+// checkIndexBounds makes sure every data block the index points at lies
+// before the trailer, so a corrupt index fails the open rather than the
+// lookups that happen to land in a bad block.
+func (r *Reader) checkIndexBounds() error {
+	for i, blk := range r.index {
+		if blk.offset > r.header.index || uint64(blk.size) > r.header.index-blk.offset {
+			return fmt.Errorf("data block %d (offset %d, %d bytes) runs into the trailer at %d", i, blk.offset, blk.size, r.header.index)
+		}
+	}
+	return nil
+}
+
+// checkIndexOrder makes sure the data index lists its blocks in key order,
+// as the binary searches over it assume.
+func (r *Reader) checkIndexOrder() error {
+	for i := 1; i < len(r.index); i++ {
+		if r.compareKeys(r.index[i-1].firstKeyBytes, r.index[i].firstKeyBytes) > 0 {
+			return fmt.Errorf("data block %d (offset %d) first key sorts before block %d's", i, r.index[i].offset, i-1)
+		}
+	}
+	return nil
+}
+
+// SetLogger sends the reader's diagnostics, like a tolerated size mismatch,
+// to l. By default there are none. The tracing turned on by NewReader's
+// debug flag also goes to l, or without one to the standard logger.
+func (r *Reader) SetLogger(l *log.Logger) {
+	r.logger = l
+}
+
+func (r *Reader) logf(format string, v ...interface{}) {
+	if r.logger != nil {
+		r.logger.Printf(format, v...)
+	} else if r.debug {
+		log.Printf(format, v...)
+	}
+}
+
+// SetMetrics installs a sink for block decode measurements. Nothing is timed
+// while it is nil, which is the default.
+func (r *Reader) SetMetrics(m Metrics) {
+	r.metrics = m
+}
+
+// SetBlockCacheBytes keeps up to n bytes of decoded data blocks in memory,
+// evicting the least recently used, so that lookups into a hot block do not
+// decompress or, for NewReaderAt sources, read it again each time. The cache
+// is shared by every Scanner and Iterator on the reader. It is off by
+// default, and n <= 0 turns it off again. Call it before sharing the reader.
+func (r *Reader) SetBlockCacheBytes(n int) {
+	if n <= 0 {
+		r.cache = nil
+		return
+	}
+	r.cache = newBlockCache(n)
+}
+
+// SetScanMemoryBudget caps how many bytes of decoded blocks each Iterator
+// leaves in the block cache. A scan never goes back to a block it has passed,
+// so once the blocks it added to the cache take up more than n, it drops the
+// earliest of them from the cache again, rather than let a full scan push out
+// the blocks other lookups want. Blocks that were already cached when the
+// scan reached them stay. ReverseIterators, Cursors and Scanners, which may
+// come back to a block, leave the cache to its least recently used eviction
+// as before. Without the block cache a scan holds only the block it is in and
+// those Readahead is fetching, so the budget has nothing to cap. It is off by
+// default, and n <= 0 turns it off again.
+func (r *Reader) SetScanMemoryBudget(n int) {
+	if n < 0 {
+		n = 0
+	}
+	r.scanBudget = n
+}
+
+// SetReadTimeout makes each read of a NewReaderAt source that takes longer
+// than d fail with ErrReadTimeout, so that a hung network filesystem or
+// object store fails lookups rather than blocking them forever. Given as a
+// ReaderOptions field it also bounds each read made while the file is
+// opened. The read itself cannot be cancelled through io.ReaderAt: it goes on
+// in its own goroutine, and its result is dropped whenever it finishes. It
+// is off by default, and d <= 0 turns it off again. Mapped files are read by
+// page faults, which cannot be timed out, so for them it does nothing.
+func (r *Reader) SetReadTimeout(d time.Duration) {
+	r.readTimeout = d
+}
+
+// Stats describes a reader's size and what it has done so far. None of it
+// takes a pass over the data.
+type Stats struct {
+	Entries     uint64 // from the trailer
+	Blocks      int    // data blocks
+	MappedBytes int64
+	CachedBytes int64
+
+	BlockCacheHits   uint64
+	BlockCacheMisses uint64
+	Lookups          uint64 // keyed lookups by Scanners
+}
+
+func (r *Reader) Stats() Stats {
+	stats := Stats{
+		Entries:     r.header.entryCount,
+		Blocks:      len(r.index),
+		MappedBytes: r.MappedBytes(),
+		CachedBytes: r.CachedBytes(),
+		Lookups:     atomic.LoadUint64(&r.lookups),
+	}
+	if r.cache != nil {
+		stats.BlockCacheHits, stats.BlockCacheMisses = r.cache.stats()
+	}
+	return stats
+}
+
+// MappedBytes returns the length of the reader's memory mapping of its file,
+// or 0 if it has none. For a reader mapped in windows, it is the length of
+// the index and the windows mapped now.
+func (r *Reader) MappedBytes() int64 {
+	if r.windows != nil && !r.closed {
+		return r.windows.mappedBytes()
+	}
+	if !r.mapped || r.closed {
+		return 0
+	}
+	return int64(len(r.mmap))
+}
+
+// CachedBytes returns how many bytes of decoded blocks the block cache holds.
+func (r *Reader) CachedBytes() int64 {
+	if r.cache == nil {
+		return 0
+	}
+	return int64(r.cache.size())
+}
+
+// HeaderInfo is the file's trailer as parsed at open, for inspecting tools.
+// Offsets are from the start of the file.
+type HeaderInfo struct {
+	MajorVersion, MinorVersion uint32
+
+	TrailerOffset              uint64
+	FileInfoOffset             uint64
+	DataIndexOffset            uint64
+	DataIndexCount             uint32
+	MetaIndexOffset            uint64 // for v2, found behind the data index
+	MetaIndexCount             uint32
+	TotalUncompressedDataBytes uint64
+	EntryCount                 uint64
+	CompressionCodec           uint32 // named by Reader.CompressionCodec
+
+	// v2 and v3 only; zero for v1 files.
+	NumDataIndexLevels   uint32
+	FirstDataBlockOffset uint64
+	LastDataBlockOffset  uint64
+	ComparatorClassName  string
+}
+
+func (r *Reader) HeaderInfo() HeaderInfo {
+	h := r.header
+	return HeaderInfo{
+		MajorVersion:               r.majorVersion,
+		MinorVersion:               r.minorVersion,
+		TrailerOffset:              h.index,
+		FileInfoOffset:             h.fileInfoOffset,
+		DataIndexOffset:            h.dataIndexOffset,
+		DataIndexCount:             h.dataIndexCount,
+		MetaIndexOffset:            h.metaIndexOffset,
+		MetaIndexCount:             h.metaIndexCount,
+		TotalUncompressedDataBytes: h.totalUncompressedDataBytes,
+		EntryCount:                 h.entryCount,
+		CompressionCodec:           h.compressionCodec,
+		NumDataIndexLevels:         h.numDataIndexLevels,
+		FirstDataBlockOffset:       h.firstDataBlockOffset,
+		LastDataBlockOffset:        h.lastDataBlockOffset,
+		ComparatorClassName:        h.comparatorClassName,
+	}
+}
+
+// SetComparator makes lookups order keys with compare, which returns a
+// negative number, 0 or a positive number as a sorts before, with or after b,
+// instead of bytewise. It must be the order the file was written in, such as
+// CompareKeyValues for HBase's KeyValue keys; a nil compare restores
+// bytes.Compare. Call it before any lookups.
+func (r *Reader) SetComparator(compare func(a, b []byte) int) {
+	r.compare = compare
+}
+
+// ComparatorClass returns the name of the Java class the writer ordered keys
+// with: from the trailer in v2 files and the hfile.COMPARATOR FileInfo entry
+// in v1. It is false if the file does not say. Unless that is HBase's
+// bytewise Bytes$ByteArrayComparator, lookups need a matching SetComparator to
+// find keys reliably; NewReaderWithOptions logs a warning when it is given no
+// Comparator for such a file.
+func (r *Reader) ComparatorClass() (string, bool) {
+	if r.header.comparatorClassName != "" {
+		return r.header.comparatorClassName, true
+	}
+	if class, ok := r.fileInfo["hfile.COMPARATOR"]; ok && len(class) > 0 {
+		return string(class), true
+	}
+	return "", false
+}
+
+// The FileInfo entries in which Writer records the width of every key and of
+// every value it added, when they are all the same.
+const (
+	keyWidthInfo   = "gohfile.KEY_WIDTH"
+	valueWidthInfo = "gohfile.VALUE_WIDTH"
+)
+
+// loadEntryWidth reads the key and value widths from FileInfo. With both,
+// entries in a block follow one another at a fixed stride, so lookups can find
+// each by its position rather than by walking the block.
+func (r *Reader) loadEntryWidth() {
+	key, value := r.fileInfo[keyWidthInfo], r.fileInfo[valueWidthInfo]
+	if len(key) != 4 || len(value) != 4 {
+		return
+	}
+	r.keyWidth = binary.BigEndian.Uint32(key)
+	r.entryWidth = 8 + int64(r.keyWidth) + int64(binary.BigEndian.Uint32(value))
+}
+
+// bytewiseComparator reports whether the Java comparator class orders keys
+// as bytes.Compare does.
+func bytewiseComparator(class string) bool {
+	return strings.HasSuffix(class, "Bytes$ByteArrayComparator")
+}
+
+// compareKeys compares two keys in the order the file was written in.
+func (r *Reader) compareKeys(a, b []byte) int {
+	if r.compare == nil {
+		return bytes.Compare(a, b)
+	}
+	return r.compare(a, b)
+}
+
+// NewReaderFromPath opens and maps the file at path. The descriptor is closed
+// as soon as the file is mapped, since the mapping outlives it, so Close on
+// the reader is all the cleanup there is. If the file is not a readable HFile,
+// nothing is left open or mapped. The reader keeps path for Reopen.
+func NewReaderFromPath(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r, err := NewReader(path, file, false, false)
+	if err != nil {
+		if r != nil {
+			r.Close()
+		}
+		return nil, err
+	}
+	r.path = path
+	return r, nil
+}
+
+// Reopen maps the file at the path the reader was opened from again and
+// switches to it, for picking up a file that has been replaced there, as by
+// a rename. The configuration set on the reader carries over, but the block
+// cache, if on, starts out empty, and the first and last keys of blocks are
+// found afresh. If the new file cannot be opened or parsed, the reader goes
+// on reading the old one and the error is returned. Only readers from
+// NewReaderFromPath have a path to reopen.
+//
+// Like Close, Reopen unmaps the old file, so it must not race with lookups,
+// and Scanners, Iterators and the rest made before it must not be used after
+// it; keys and values they handed out remain valid.
+func (r *Reader) Reopen() error {
+	if r.closed {
+		return ErrClosed
+	}
+	if r.path == "" {
+		return errors.New("reader was not opened from a path")
+	}
+	file, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	next := newReader(ReaderOptions{
+		Name:                 r.name,
+		Debug:                r.debug,
+		Logger:               r.logger,
+		Metrics:              r.metrics,
+		TolerateSizeMismatch: r.tolerateSize,
+		AllowUnframedSnappy:  r.unframedSnappy,
+		VerifyChecksums:      r.verifyChecksums,
+		StrictOrder:          r.strictOrder,
+		IgnoreBloomFilter:    r.ignoreBloom,
+		ReadTimeout:          r.readTimeout,
+		Comparator:           r.compare,
+		OnBlockDecoded:       r.onBlockDecoded,
+		BlockLoader:          r.blockLoader,
+		OnValueError:         r.onValueError,
+	})
+	if next.mmap, err = mmap.Map(file, mmap.RDONLY, 0); err != nil {
+		return err
+	}
+	next.mapped = true
+	next.size = uint64(len(next.mmap))
+	if err = next.parse(); err != nil {
+		next.mmap.Unmap()
+		return fmt.Errorf("%s: %s", r.path, err)
+	}
+
+	old, oldMapped := r.mmap, r.mapped
+	r.mmap, r.source, r.size, r.mapped = next.mmap, nil, next.size, true
+	r.majorVersion, r.minorVersion = next.majorVersion, next.minorVersion
+	r.header, r.index = next.header, next.index
+	r.fileInfo, r.includesMemstoreTS, r.includesTags = next.fileInfo, next.includesMemstoreTS, next.includesTags
+	r.keyWidth, r.entryWidth = next.keyWidth, next.entryWidth
+	r.bloom = next.bloom
+	if r.cache != nil {
+		r.cache = newBlockCache(r.cache.budget)
+	}
+	if oldMapped {
+		return old.Unmap()
+	}
+	return nil
+}
+
+// NewReaderFromCompressedPath opens the file at path like NewReaderFromPath,
+// except that a whole file compressed with gzip, as cold files are archived,
+// is decompressed into memory and read from there. That takes the whole
+// decompressed file's worth of memory until the reader is closed and
+// dropped. Whether the file is compressed is decided by its first bytes, not
+// its name, so an uncompressed file is mapped as usual.
+func NewReaderFromCompressedPath(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	magic := make([]byte, 2)
+	if _, err = io.ReadFull(file, magic); err != nil || !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return NewReaderFromPath(path)
+	}
+	if _, err = file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	defer gz.Close()
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	r, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	r.name = path
+	return r, nil
+}
+
+// OpenVerified opens and maps the file at path, then walks all of it with
+// Validate before returning, trading open latency for finding corruption up
+// front rather than mid-query.
+func OpenVerified(path string) (*Reader, error) {
+	r, err := NewReaderFromPath(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.Validate(); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Validate checks the whole file without looking up any keys, fsck style: it
+// decodes every data block, checking its magic and, for v2 files with them,
+// its checksums whether or not VerifyChecksums is on. It checks that the
+// blocks and the keys within them are in order, that each block starts with
+// the key the index says it does and that the entry count matches the
+// trailer. It returns the first problem it finds, naming the block and its
+// offset.
+func (r *Reader) Validate() error {
+	if r.closed {
+		return ErrClosed
+	}
+
+	var entries uint64
+	var lastKey []byte
+	for i, blk := range r.index {
+		if i > 0 && r.compareKeys(r.index[i-1].firstKeyBytes, blk.firstKeyBytes) > 0 {
+			return fmt.Errorf("block %d (offset %d) first key sorts before block %d's", i, blk.offset, i-1)
+		}
+
+		if r.majorVersion >= 2 && r.minorVersion >= 1 && !r.verifyChecksums {
+			if err := r.checkBlockChecksums(blk.offset); err != nil {
+				return fmt.Errorf("block %d (offset %d): %s", i, blk.offset, err)
+			}
+		}
+
+		buf, err := r.GetBlock(i)
+		if err != nil {
+			return fmt.Errorf("block %d (offset %d): %s", i, blk.offset, err)
+		}
+
+		for first := true; buf.Len() > 0; first = false {
+			keyLen, valLen, ok := readEntryLengths(buf)
+			if !ok {
+				return fmt.Errorf("block %d (offset %d) has a truncated entry", i, blk.offset)
+			}
+			keyBytes := make([]byte, keyLen)
+			if _, err := io.ReadFull(buf, keyBytes); err != nil {
+				return fmt.Errorf("block %d (offset %d): %s", i, blk.offset, err)
+			}
+			buf.Seek(int64(valLen), 1)
+
+			if first && bytes.Compare(keyBytes, blk.firstKeyBytes) != 0 {
+				return fmt.Errorf("block %d (offset %d) starts with %v, index says %v", i, blk.offset, keyBytes, blk.firstKeyBytes)
+			}
+			if lastKey != nil && r.compareKeys(lastKey, keyBytes) > 0 {
+				return fmt.Errorf("block %d (offset %d) key %v sorts before previous key %v", i, blk.offset, keyBytes, lastKey)
+			}
+			lastKey = keyBytes
+			entries += 1
+		}
+	}
+
+	if entries != r.header.entryCount {
+		return fmt.Errorf("found %d entries, trailer says %d", entries, r.header.entryCount)
+	}
+	return nil
+}
+
+// SetTolerateSizeMismatch controls what happens when a snappy block's framed
+// uncompressed size matches neither convention for the size recorded in the
+// index. By default that is an error; when tolerated it is logged and the
+// block is decoded anyway.
+func (r *Reader) SetTolerateSizeMismatch(tolerate bool) {
+	r.tolerateSize = tolerate
+}
+
+// SetAllowUnframedSnappy accepts v1 snappy blocks written without the
+// uncompressed and compressed sizes in front, as some writers do. When a
+// block's framing does not match the index, its size in the index is taken
+// as the compressed block itself, and used if it decodes to a block with a
+// valid magic. Otherwise, and by default, the framing is trusted as before.
+func (r *Reader) SetAllowUnframedSnappy(allow bool) {
+	r.unframedSnappy = allow
+}
+
+// VerifyChecksums controls whether blocks are checked against the checksums
+// stored with them before being decoded, so that corruption surfaces as an
+// error naming the block rather than as wrong answers. It is off by default
+// and applies to blocks read after it is called. Only version 2 and 3 files
+// from minor version 1 on store checksums; for others it does nothing.
+func (r *Reader) VerifyChecksums(verify bool) {
+	r.verifyChecksums = verify
+}
+
+// UseBloomFilter controls whether lookups consult the file's row bloom filter
+// first, answering not found without touching a data block when it rules
+// the key out. It is on by default, and does nothing for files without one.
+// Bloom filters hash the whole key, so turn this off for files whose writer
+// built them over only part of it.
+func (r *Reader) UseBloomFilter(use bool) {
+	r.ignoreBloom = !use
+}
+
+// mightContain reports whether key may be in the file, as far as the bloom
+// filter can tell.
+func (r *Reader) mightContain(key []byte) bool {
+	return r.bloom == nil || r.ignoreBloom || r.bloom.mightContain(key)
+}
+
+// EntryCount returns the number of key/value pairs the trailer says the file
+// holds.
+func (r *Reader) EntryCount() uint64 {
+	return r.header.entryCount
+}
+
+// UncompressedSize returns the size the trailer records for the file's data
+// once decompressed. It is the writer's count, which need not agree with
+// the blocks' sizes: writers differ over whether it counts block headers.
+func (r *Reader) UncompressedSize() uint64 {
+	return r.header.totalUncompressedDataBytes
+}
+
+// CompressedSize returns how many bytes of the file the data blocks take up,
+// as stored, with any size framing or v2 block headers. Against
+// UncompressedSize it gives the compression ratio the data got.
+func (r *Reader) CompressedSize() int64 {
+	var n int64
+	for i := range r.index {
+		n += int64(r.blockOnDiskSize(i))
+	}
+	return n
+}
+
+// CompressionCodec returns the name HBase uses for the codec the file's
+// blocks are compressed with: "none", "gzip", "snappy", "lz4" or "lzo".
+func (r *Reader) CompressionCodec() string {
+	return codecName(r.header.compressionCodec)
+}
+
+// FirstKey returns the smallest key in the file, from the data index. It is
+// nil for files with no data blocks.
+func (r *Reader) FirstKey() []byte {
+	if len(r.index) == 0 {
+		return nil
+	}
+	return r.index[0].firstKeyBytes
+}
+
+// LastKey returns the largest key in the file. The index does not record it,
+// so it comes from scanning the final data block to its end, the first time it
+// is asked for, rather than from FileInfo's LASTKEY, which HBase writes in its
+// own key format. It is nil for files with no data blocks.
+func (r *Reader) LastKey() ([]byte, error) {
+	if r.closed {
+		return nil, ErrClosed
+	}
+	if len(r.index) == 0 {
+		return nil, nil
+	}
+	_, lastKey, err := r.summarizeBlock(len(r.index) - 1)
+	return lastKey, err
 }
 
 func (r *Reader) PrintDebugInfo(out io.Writer) {
+	fmt.Fprintf(out, "version: %d.%d\n", r.majorVersion, r.minorVersion)
 	fmt.Fprintln(out, "entries: ", r.header.entryCount)
 	fmt.Fprintln(out, "blocks: ", len(r.index))
 	for i, blk := range r.index {
-		fmt.Fprintf(out, "\t#%d: %s (%v)\n", i, blk.firstKeyBytes, blk.firstKeyBytes)
+		entries, err := r.blockEntries(i)
+		if err != nil {
+			fmt.Fprintf(out, "\t#%d: %s (%v) error: %s\n", i, blk.firstKeyBytes, blk.firstKeyBytes, err)
+			continue
+		}
+		fmt.Fprintf(out, "\t#%d: %s (%v) entries: %d, size: %d, uncompressed: %d\n",
+			i, blk.firstKeyBytes, blk.firstKeyBytes, entries, r.blockOnDiskSize(i), r.blockUncompressedSize(i))
 	}
 }
 
-func (r *Reader) newHeader(mmap mmap.MMap) (Header, error) {
+func (r *Reader) newHeader() (Header, error) {
+	if r.majorVersion == 2 || r.majorVersion == 3 {
+		return r.newHeaderV2()
+	}
+
 	header := Header{}
 
 	if r.majorVersion != 1 || r.minorVersion != 0 {
-		return header, errors.New("wrong version")
+		return header, fmt.Errorf("wrong version %d.%d (%s)", r.majorVersion, r.minorVersion, r.describeBadTrailer(nil))
 	}
 
-	header.index = len(mmap) - 60
-	buf := bytes.NewReader(mmap[header.index:])
+	header.index = r.size - 60
+	trailer, err := r.readAt(header.index, 60)
+	if err != nil {
+		return header, err
+	}
+	buf := bytes.NewReader(trailer)
 
 	headerMagic := make([]byte, 8)
 	buf.Read(headerMagic)
 	if bytes.Compare(headerMagic, []byte("TRABLK\"$")) != 0 {
-		return header, errors.New("bad header magic")
+		return header, fmt.Errorf("bad header magic %s (%s)", hex.EncodeToString(headerMagic), r.describeBadTrailer(headerMagic))
 	}
 
 	binary.Read(buf, binary.BigEndian, &header.fileInfoOffset)
@@ -112,74 +967,950 @@ func (r *Reader) newHeader(mmap mmap.MMap) (Header, error) {
 	binary.Read(buf, binary.BigEndian, &header.metaIndexOffset)
 	binary.Read(buf, binary.BigEndian, &header.metaIndexCount)
 	binary.Read(buf, binary.BigEndian, &header.totalUncompressedDataBytes)
-	binary.Read(buf, binary.BigEndian, &header.entryCount)
+	// v1 only has room for 32 bits of entry count.
+	var entryCount uint32
+	binary.Read(buf, binary.BigEndian, &entryCount)
+	header.entryCount = uint64(entryCount)
 	binary.Read(buf, binary.BigEndian, &header.compressionCodec)
 	return header, nil
 }
 
-func (r *Reader) loadIndex(mmap mmap.MMap) error {
-
-	dataIndexEnd := r.header.metaIndexOffset
-	if r.header.metaIndexOffset == 0 {
-		dataIndexEnd = uint64(r.header.index)
+// describeBadTrailer guesses why the file does not end in a v1 trailer, given
+// the magic found where the trailer should start if it got that far.
+func (r *Reader) describeBadTrailer(magic []byte) string {
+	n := uint64(8)
+	if r.size < n {
+		n = r.size
 	}
-	buf := bytes.NewReader(mmap[r.header.dataIndexOffset:dataIndexEnd])
+	head, _ := r.readAt(0, n)
 
-	dataIndexMagic := make([]byte, 8)
-	buf.Read(dataIndexMagic)
-	if bytes.Compare(dataIndexMagic, []byte("IDXBLK)+")) != 0 {
-		return errors.New("bad data index magic")
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return "looks like gzip compressed data, decompress it first"
+	case bytes.HasPrefix(head, []byte{0xef, 0xbb, 0xbf}):
+		return "starts with a UTF-8 byte order mark, looks like a text file"
+	case bytes.HasPrefix(head, []byte("PAR1")):
+		return "looks like a Parquet file"
+	case bytes.HasPrefix(head, []byte("SEQ")):
+		return "looks like a Hadoop SequenceFile"
 	}
 
-	for buf.Len() > 0 {
-		dataBlock := Block{}
-
-		binary.Read(buf, binary.BigEndian, &dataBlock.offset)
-		binary.Read(buf, binary.BigEndian, &dataBlock.size)
-
-		firstKeyLen, _ := binary.ReadUvarint(buf)
-		dataBlock.firstKeyBytes = make([]byte, firstKeyLen)
-		buf.Read(dataBlock.firstKeyBytes)
-
-		r.index = append(r.index, dataBlock)
+	switch string(magic) {
+	case "DATABLK*", "IDXBLK)+", "METABLKc":
+		return fmt.Sprintf("found %q block magic where the trailer should be, the file may be truncated", magic)
 	}
-
-	return nil
+	if r.size >= 212 {
+		if v2Magic, _ := r.readAt(r.size-212, 8); bytes.Equal(v2Magic, []byte("TRABLK\"$")) {
+			return "looks like an HFile v2 trailer"
+		}
+	}
+	if bytes.HasPrefix(head, []byte("DATABLK*")) {
+		return "starts like an HFile but the trailer is damaged"
+	}
+	return "not an HFile"
 }
 
-func (b *Block) IsAfter(key []byte) bool {
-	return bytes.Compare(b.firstKeyBytes, key) > 0
-}
+func (r *Reader) loadIndex() error {
+	if r.majorVersion >= 2 {
+		return r.loadIndexV2()
+	}
 
-func (r *Reader) GetBlock(i int) (*bytes.Reader, error) {
-	var buf *bytes.Reader
+	trailer := r.header.index
+	if r.header.fileInfoOffset > trailer || r.header.dataIndexOffset > trailer || r.header.metaIndexOffset > trailer {
+		return errors.New("trailer offsets point past the trailer")
+	}
 
-	block := r.index[i]
+	// The FileInfo runs up to whatever follows it. Nothing in v1 depends on
+	// it, so one that cannot be read is left empty rather than failing the
+	// open.
+	r.fileInfo = map[string][]byte{}
+	if end := r.sectionEnd(r.header.fileInfoOffset); end > r.header.fileInfoOffset {
+		data, err := r.readAt(r.header.fileInfoOffset, end-r.header.fileInfoOffset)
+		var info map[string][]byte
+		if err == nil {
+			info, err = readFileInfo(data)
+		}
+		if err == nil {
+			r.fileInfo = info
+		} else {
+			r.logf("[Reader.loadIndex] %s: ignoring unreadable file info: %s\n", r.name, err)
+		}
+	}
 
-	switch {
-	case r.header.compressionCodec == 2: // No compression
-		buf = bytes.NewReader(r.mmap[block.offset : block.offset+uint64(block.size)])
-	case r.header.compressionCodec == 3: // Snappy
-		uncompressedByteSize := binary.BigEndian.Uint32(r.mmap[block.offset : block.offset+4])
-		if uncompressedByteSize != block.size {
-			return nil, errors.New("mismatched uncompressed block size")
-		}
-		compressedByteSize := binary.BigEndian.Uint32(r.mmap[block.offset+4 : block.offset+8])
-		compressedBytes := r.mmap[block.offset+8 : block.offset+8+uint64(compressedByteSize)]
-		uncompressedBytes, err := snappy.Decode(nil, compressedBytes)
+	if end := r.sectionEnd(r.header.dataIndexOffset); r.header.dataIndexCount > 0 && end > r.header.dataIndexOffset {
+		data, err := r.readAt(r.header.dataIndexOffset, end-r.header.dataIndexOffset)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		r.index, err = readBlockIndex(data, "data")
+		if err != nil {
+			return err
 		}
-		buf = bytes.NewReader(uncompressedBytes)
-	default:
-		return nil, errors.New("Unsupported compression codec " + string(r.header.compressionCodec))
 	}
 
-	dataBlockMagic := make([]byte, 8)
-	buf.Read(dataBlockMagic)
-	if bytes.Compare(dataBlockMagic, []byte("DATABLK*")) != 0 {
-		return nil, errors.New("bad data block magic")
+	if len(r.index) == 0 && r.header.entryCount > 0 {
+		return r.loadSingleBlockIndex()
 	}
+	return nil
+}
+
+// loadSingleBlockIndex rebuilds the index for files whose writer left the
+// data index empty even though they hold entries. That only happens for
+// files with a single data block, which v1 places at the very start of the
+// file, running up to the first meta block or else the FileInfo.
+func (r *Reader) loadSingleBlockIndex() error {
+	end := r.header.fileInfoOffset
+	if r.header.metaIndexCount > 0 {
+		meta, err := r.metaIndex()
+		if err == nil && len(meta) > 0 && meta[0].offset < end {
+			end = meta[0].offset
+		}
+	}
+	if end < 8 {
+		return errors.New("empty data index and no data block")
+	}
+	// end is no further than fileInfoOffset, which loadIndex checked.
+
+	block := Block{offset: 0, size: uint32(end), entries: -1}
+	if r.framedBlocks() {
+		// The on-disk size, as the index of a compressed file would record it.
+		block.size = 8 + r.uint32At(4)
+	}
+	r.index = []Block{block}
+
+	buf, err := r.GetBlock(0)
+	if err != nil {
+		r.index = nil
+		return err
+	}
+	keyLen, _, ok := readEntryLengths(buf)
+	if !ok {
+		r.index = nil
+		return errors.New("truncated entry in block 0")
+	}
+	r.index[0].firstKeyBytes = make([]byte, keyLen)
+	if _, err := io.ReadFull(buf, r.index[0].firstKeyBytes); err != nil {
+		r.index = nil
+		return fmt.Errorf("block 0: %s", err)
+	}
+	return nil
+}
+
+// readBlockIndex parses an IDXBLK)+ region. The data and meta indexes share
+// this layout; for meta blocks the "first key" is the block's name.
+func readBlockIndex(data []byte, kind string) ([]Block, error) {
+	buf := bytes.NewReader(data)
+
+	indexMagic := make([]byte, 8)
+	io.ReadFull(buf, indexMagic) // a short read leaves zeroes, which fail the check
+	if bytes.Compare(indexMagic, []byte("IDXBLK)+")) != 0 {
+		return nil, fmt.Errorf("bad %s index magic", kind)
+	}
+
+	var index []Block
+	for buf.Len() > 0 {
+		block := Block{entries: -1}
+
+		if binary.Read(buf, binary.BigEndian, &block.offset) != nil ||
+			binary.Read(buf, binary.BigEndian, &block.size) != nil {
+			return nil, fmt.Errorf("truncated %s index entry %d", kind, len(index))
+		}
+
+		firstKeyLen, err := binary.ReadUvarint(buf)
+		if err != nil || firstKeyLen > uint64(buf.Len()) {
+			return nil, fmt.Errorf("truncated %s index entry %d", kind, len(index))
+		}
+		block.firstKeyBytes = make([]byte, firstKeyLen)
+		if _, err := io.ReadFull(buf, block.firstKeyBytes); err != nil {
+			return nil, fmt.Errorf("%s index entry %d: %s", kind, len(index), err)
+		}
+
+		index = append(index, block)
+	}
+
+	return index, nil
+}
+
+// MetaBlockNames lists the names of the meta blocks recorded in the meta
+// index, in file order. Files without a meta index return an empty slice.
+func (r *Reader) MetaBlockNames() ([]string, error) {
+	if r.closed {
+		return nil, ErrClosed
+	}
+	names := []string{}
+	if r.header.metaIndexCount == 0 {
+		return names, nil
+	}
+
+	index, err := r.metaIndex()
+	if err != nil {
+		return nil, err
+	}
+	for _, blk := range index {
+		names = append(names, string(blk.firstKeyBytes))
+	}
+	return names, nil
+}
+
+// MetaBlock returns the decompressed contents of the meta block called name,
+// without its magic, or false if the file has no such block or it cannot be
+// read.
+func (r *Reader) MetaBlock(name string) ([]byte, bool) {
+	if r.closed || r.header.metaIndexCount == 0 {
+		return nil, false
+	}
+
+	index, err := r.metaIndex()
+	if err != nil {
+		r.logf("[Reader.MetaBlock] %s: %s\n", r.name, err)
+		return nil, false
+	}
+	for i, blk := range index {
+		if string(blk.firstKeyBytes) != name {
+			continue
+		}
+		data, err := r.readMetaBlock(blk, i)
+		if err != nil {
+			r.logf("[Reader.MetaBlock] %s: meta block %s: %s\n", r.name, name, err)
+			return nil, false
+		}
+		return data, true
+	}
+	return nil, false
+}
+
+func (r *Reader) readMetaBlock(blk Block, i int) ([]byte, error) {
+	var magic, data []byte
+	if r.majorVersion >= 2 {
+		var err error
+		if magic, data, _, err = r.readBlockV2(blk.offset); err != nil {
+			return nil, err
+		}
+	} else {
+		body, err := r.readBlockV1(blk, i)
+		if err != nil || !bytes.HasPrefix(body, []byte("METABLKc")) {
+			if gz, ok := r.readGzipMetaBlock(blk); ok {
+				body, err = gz, nil
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(body) >= 8 {
+			magic, data = body[:8], body[8:]
+		}
+	}
+	if bytes.Compare(magic, []byte("METABLKc")) != 0 {
+		return nil, errors.New("bad meta block magic")
+	}
+	return data, nil
+}
+
+// readGzipMetaBlock decodes a v1 meta block as gzip, reporting whether that
+// gave a meta block. Some writers compress meta blocks, like the bloom
+// filter, with gzip whatever the codec of the data blocks, and v1 blocks do
+// not record their own codec, so one that the file's codec cannot decode is
+// tried as gzip if it starts like a gzip stream. Like the file's codec, it
+// is framed with its uncompressed and compressed sizes.
+func (r *Reader) readGzipMetaBlock(blk Block) ([]byte, bool) {
+	if !r.framedBlocks() || r.header.compressionCodec == 1 {
+		return nil, false
+	}
+	framing, err := r.readAt(blk.offset, 8)
+	if err != nil {
+		return nil, false
+	}
+	uncompressedByteSize := binary.BigEndian.Uint32(framing[0:4])
+	compressed, err := r.readAt(blk.offset+8, uint64(binary.BigEndian.Uint32(framing[4:8])))
+	if err != nil || !bytes.HasPrefix(compressed, []byte{0x1f, 0x8b}) {
+		return nil, false
+	}
+	data, err := gunzip(compressed, uncompressedByteSize)
+	if err != nil || !bytes.HasPrefix(data, []byte("METABLKc")) {
+		return nil, false
+	}
+	return data, true
+}
+
+// FileInfo returns the entries of the file's FileInfo block: what the writer
+// recorded about the file, like hfile.LASTKEY and hfile.COMPARATOR, plus any
+// entries of its own. It is empty if the file has none. The map is shared by
+// all callers and must not be modified.
+func (r *Reader) FileInfo() map[string][]byte {
+	return r.fileInfo
+}
+
+// propertiesBlockName names the meta block holding WriterOptions.Properties,
+// outside HBase's own names.
+const propertiesBlockName = "gohfile.PROPERTIES"
+
+// Properties returns the application metadata the file was written with by
+// WriterOptions.Properties. It is empty if the file has none, as for files
+// from other writers.
+func (r *Reader) Properties() (map[string]string, error) {
+	if r.closed {
+		return nil, ErrClosed
+	}
+	props := map[string]string{}
+	if r.header.metaIndexCount == 0 {
+		return props, nil
+	}
+
+	index, err := r.metaIndex()
+	if err != nil {
+		return nil, err
+	}
+	for i, blk := range index {
+		if string(blk.firstKeyBytes) != propertiesBlockName {
+			continue
+		}
+		data, err := r.readMetaBlock(blk, i)
+		if err != nil {
+			return nil, fmt.Errorf("meta block %s: %s", propertiesBlockName, err)
+		}
+		info, err := readFileInfo(data)
+		if err != nil {
+			return nil, fmt.Errorf("meta block %s: %s", propertiesBlockName, err)
+		}
+		for k, v := range info {
+			props[k] = string(v)
+		}
+		break
+	}
+	return props, nil
+}
+
+// metaIndex parses the meta index, whose entries point at meta blocks and
+// carry their names in place of a first key.
+func (r *Reader) metaIndex() ([]Block, error) {
+	if r.majorVersion >= 2 {
+		return r.metaIndexV2()
+	}
+	end := r.sectionEnd(r.header.metaIndexOffset)
+	data, err := r.readAt(r.header.metaIndexOffset, end-r.header.metaIndexOffset)
+	if err != nil {
+		return nil, err
+	}
+	return readBlockIndex(data, "meta")
+}
+
+// sectionEnd returns where the v1 section starting at offset ends: at the
+// start of the next of the FileInfo and the data and meta indexes that are
+// not empty, or of the trailer. Writers put the FileInfo first and usually
+// the meta index last, but the trailer records each offset separately, so
+// the order is not assumed. A section that starts where another does is
+// taken to be empty.
+func (r *Reader) sectionEnd(offset uint64) uint64 {
+	starts := []uint64{r.header.fileInfoOffset}
+	if r.header.dataIndexCount > 0 {
+		starts = append(starts, r.header.dataIndexOffset)
+	}
+	if r.header.metaIndexCount > 0 {
+		starts = append(starts, r.header.metaIndexOffset)
+	}
+
+	end := r.header.index
+	same := 0
+	for _, start := range starts {
+		if start == offset {
+			same += 1
+		} else if start > offset && start < end {
+			end = start
+		}
+	}
+	if same > 1 {
+		return offset
+	}
+	return end
+}
+
+func (b *Block) IsAfter(key []byte) bool {
+	return bytes.Compare(b.firstKeyBytes, key) > 0
+}
+
+// blockIsAfter is IsAfter for block i, in the reader's key order.
+func (r *Reader) blockIsAfter(i int, key []byte) bool {
+	return r.compareKeys(r.index[i].firstKeyBytes, key) > 0
+}
+
+// findBlock returns the block key's entries would start in, searching the
+// whole index, or false if key sorts before the first block.
+func (r *Reader) findBlock(key []byte) (int, bool) {
+	idx := sort.Search(len(r.index), func(i int) bool {
+		return r.blockIsAfter(i, key)
+	}) - 1
+	// A block starting with key may be the continuation of a run of entries
+	// for key that began in the block before it.
+	for idx > 0 && r.compareKeys(r.index[idx].firstKeyBytes, key) == 0 {
+		idx -= 1
+	}
+	return idx, idx >= 0
+}
+
+// BlockIndexFor returns the data block a Scanner lookup of key would search,
+// numbered as in BlockIndex and PrintDebugInfo, without decoding it, or false
+// if key sorts before the first block. It is for tracking down lookups that
+// unexpectedly miss. It does not consult the bloom filter, which a Scanner
+// checks first and may rule the key out before any block is chosen; nor
+// does it count as a lookup in Stats.
+func (r *Reader) BlockIndexFor(key []byte) (int, bool) {
+	if r.closed || len(r.index) == 0 {
+		return -1, false
+	}
+	return r.findBlock(key)
+}
+
+// RangeInSingleBlock reports whether every key in [start, end] that could be
+// in the file falls in one data block, and if so which. It only consults the
+// block index, so it errs towards false when a key equal to a block's first
+// key might also end the block before it.
+func (r *Reader) RangeInSingleBlock(start, end []byte) (bool, int) {
+	n := len(r.index)
+	if n == 0 {
+		return false, -1
+	}
+
+	// first is the earliest block that can hold a key >= start: every block
+	// before it is followed by one starting before start.
+	first := sort.Search(n-1, func(i int) bool {
+		return r.compareKeys(r.index[i+1].firstKeyBytes, start) >= 0
+	})
+	// last is the final block starting at or before end.
+	last := sort.Search(n, func(i int) bool {
+		return r.blockIsAfter(i, end)
+	}) - 1
+
+	if first != last {
+		return false, -1
+	}
+	return true, first
+}
+
+// framedBlocks reports whether v1 data blocks are compressed, and so start
+// with their uncompressed and compressed sizes.
+func (r *Reader) framedBlocks() bool {
+	return r.header.compressionCodec == 1 || r.header.compressionCodec == 3 || r.header.compressionCodec == 4
+}
+
+// blockOnDiskSize returns how many bytes block i occupies in the file, which
+// for compressed files includes the 8 byte size framing. v2 indexes record
+// it directly, block header included.
+func (r *Reader) blockOnDiskSize(i int) uint32 {
+	block := r.index[i]
+	if r.majorVersion >= 2 {
+		return block.size
+	}
+	if r.framedBlocks() {
+		return 8 + r.uint32At(block.offset+4)
+	}
+	return block.size
+}
+
+// blockUncompressedSize returns the decoded size of block i. Compressed
+// blocks record it in their framing since the index may hold either size.
+func (r *Reader) blockUncompressedSize(i int) uint32 {
+	block := r.index[i]
+	if r.majorVersion >= 2 {
+		return uint32(r.v2BlockHeaderSize()) + r.uint32At(block.offset+12)
+	}
+	if r.framedBlocks() {
+		return r.uint32At(block.offset)
+	}
+	return block.size
+}
+
+// blockEntries counts the key/value pairs in block i.
+func (r *Reader) blockEntries(i int) (int, error) {
+	entries, _, err := r.summarizeBlock(i)
+	return entries, err
+}
+
+// BlockKeyRange returns the first and last keys in data block i. The last key
+// is decoded from the block the first time it is asked for and cached.
+func (r *Reader) BlockKeyRange(i int) ([]byte, []byte, error) {
+	if r.closed {
+		return nil, nil, ErrClosed
+	}
+	if i < 0 || i >= len(r.index) {
+		return nil, nil, fmt.Errorf("block %d out of range, file has %d", i, len(r.index))
+	}
+	_, lastKey, err := r.summarizeBlock(i)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.index[i].firstKeyBytes, lastKey, nil
+}
+
+// BlockCount returns the number of data blocks in the file.
+func (r *Reader) BlockCount() int {
+	return len(r.index)
+}
+
+// BlockInfo describes a data block, as recorded in the data index.
+type BlockInfo struct {
+	FirstKey []byte
+	Offset   uint64
+	Size     uint32 // on disk, compressed and with any framing or header
+}
+
+// BlockIndex describes every data block in file order, for routing keys to a
+// file or block without decoding any. The first keys are copies, still valid
+// after Close. On compressed v1 files it reads each block's framing to find
+// its size on disk.
+func (r *Reader) BlockIndex() []BlockInfo {
+	blocks := make([]BlockInfo, len(r.index))
+	for i, blk := range r.index {
+		blocks[i] = BlockInfo{
+			FirstKey: append([]byte(nil), blk.firstKeyBytes...),
+			Offset:   blk.offset,
+			Size:     r.blockOnDiskSize(i),
+		}
+	}
+	return blocks
+}
 
-	return buf, nil
+// BlockBytes returns the decompressed contents of data block i, starting with
+// its DATABLK* magic, without interpreting its entries. The slice is the
+// caller's own.
+func (r *Reader) BlockBytes(i int) ([]byte, error) {
+	if r.closed {
+		return nil, ErrClosed
+	}
+	if i < 0 || i >= len(r.index) {
+		return nil, fmt.Errorf("block %d out of range, file has %d", i, len(r.index))
+	}
+	buf, err := r.GetBlock(i)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, buf.Size())
+	buf.ReadAt(data, 0)
+	return data, nil
+}
+
+// summarizeBlock returns the entry count and last key of block i, decoding
+// the block to find them only the first time.
+func (r *Reader) summarizeBlock(i int) (int, []byte, error) {
+	r.summaryLock.Lock()
+	defer r.summaryLock.Unlock()
+	if r.index[i].entries >= 0 {
+		return r.index[i].entries, r.index[i].lastKeyBytes, nil
+	}
+
+	buf, err := r.GetBlock(i)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	entries := 0
+	var lastKey []byte
+	for buf.Len() > 0 {
+		keyLen, valLen, ok := readEntryLengths(buf)
+		if !ok {
+			return 0, nil, fmt.Errorf("truncated entry in block %d", i)
+		}
+		lastKey = resize(lastKey, keyLen)
+		if _, err := io.ReadFull(buf, lastKey); err != nil {
+			return 0, nil, fmt.Errorf("block %d: %s", i, err)
+		}
+		buf.Seek(int64(valLen), 1)
+		entries += 1
+	}
+	r.index[i].entries = entries
+	r.index[i].lastKeyBytes = lastKey
+	return entries, lastKey, nil
+}
+
+// blockEntryOffsets returns where each entry in block i starts, given the
+// block as GetBlock returned it. They are found the first time any lookup
+// needs them and kept in the index from then on, however many times the
+// block is decoded again or by whichever Scanner.
+func (r *Reader) blockEntryOffsets(i int, buf *bytes.Reader) []int64 {
+	r.summaryLock.Lock()
+	offsets := r.index[i].offsets
+	r.summaryLock.Unlock()
+	if offsets != nil {
+		return offsets
+	}
+
+	offsets = entryOffsets(buf)
+	r.summaryLock.Lock()
+	r.index[i].offsets = offsets
+	r.summaryLock.Unlock()
+	return offsets
+}
+
+// EntryAt returns the n-th entry in key order, counting from zero. Blocks
+// before it are skipped using their cached entry counts, so only the first
+// call pays to count them.
+func (r *Reader) EntryAt(n uint64) ([]byte, []byte, bool) {
+	if n >= r.header.entryCount {
+		return nil, nil, false
+	}
+
+	for i := range r.index {
+		entries, err := r.blockEntries(i)
+		if err != nil {
+			return nil, nil, false
+		}
+		if n >= uint64(entries) {
+			n -= uint64(entries)
+			continue
+		}
+
+		buf, err := r.GetBlock(i)
+		if err != nil {
+			return nil, nil, false
+		}
+		for ; n > 0; n -= 1 {
+			keyLen, valLen, _ := readEntryLengths(buf)
+			buf.Seek(int64(keyLen)+int64(valLen), 1)
+		}
+		keyLen, valLen, ok := readEntryLengths(buf)
+		if !ok {
+			return nil, nil, false
+		}
+		key := make([]byte, keyLen)
+		value := make([]byte, valLen)
+		if readEntry(buf, key, value) != nil {
+			return nil, nil, false
+		}
+		return key, value, true
+	}
+	return nil, nil, false
+}
+
+func (r *Reader) GetBlock(i int) (*bytes.Reader, error) {
+	buf, _, err := r.fetchBlock(i)
+	return buf, err
+}
+
+// fetchBlock is GetBlock, also reporting whether this call decoded the block
+// into the block cache.
+func (r *Reader) fetchBlock(i int) (*bytes.Reader, bool, error) {
+	if r.closed {
+		return nil, false, ErrClosed
+	}
+
+	var data []byte
+	var err error
+	var cached bool
+	if r.cache != nil {
+		data, err = r.cache.load(r.index[i].offset, func() ([]byte, error) {
+			cached = true
+			return r.decodeBlock(i)
+		})
+	} else {
+		data, err = r.decodeBlock(i)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Each caller gets its own position in the block, which with the cache
+	// on may be shared by any number of them.
+	buf := bytes.NewReader(data)
+	buf.Seek(8, 0) // past the magic, which decodeBlock checked
+	return buf, cached, nil
+}
+
+// decodeBlock reads and decompresses data block i, checking its magic, unless
+// the BlockLoader has it.
+func (r *Reader) decodeBlock(i int) ([]byte, error) {
+	if r.blockLoader != nil {
+		if data, ok := r.blockLoader(i); ok {
+			if !bytes.HasPrefix(data, []byte("DATABLK*")) {
+				return nil, fmt.Errorf("block %d from BlockLoader has no data block magic", i)
+			}
+			return data, nil
+		}
+	}
+
+	var start time.Time
+	if r.metrics != nil {
+		start = time.Now()
+	}
+
+	var data []byte
+	var err error
+	if r.majorVersion >= 2 {
+		data, err = r.getBlockV2(i)
+	} else {
+		data, err = r.readBlockV1(r.index[i], i)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if r.metrics != nil {
+		r.metrics.BlockDecoded(codecName(r.header.compressionCodec), int(r.blockOnDiskSize(i)), len(data), time.Since(start))
+	}
+
+	if !bytes.HasPrefix(data, []byte("DATABLK*")) {
+		return nil, errors.New("bad data block magic")
+	}
+	if r.onBlockDecoded != nil {
+		r.onBlockDecoded(i, data)
+	}
+	return data, nil
+}
+
+// readBlockV1 returns the decompressed contents of a v1 block, magic
+// included. Data and meta blocks are compressed the same way; i is the
+// block's position in its index, for messages.
+func (r *Reader) readBlockV1(block Block, i int) ([]byte, error) {
+	switch {
+	case r.header.compressionCodec == 2: // No compression
+		if !r.inBounds(block.offset, uint64(block.size)) {
+			return nil, fmt.Errorf("block %d extends past the end of the file", i)
+		}
+		return r.readAt(block.offset, uint64(block.size))
+	case r.framedBlocks(): // Gzip, Snappy or LZ4
+		if !r.inBounds(block.offset, 8) {
+			return nil, fmt.Errorf("block %d extends past the end of the file", i)
+		}
+		framing, err := r.readAt(block.offset, 8)
+		if err != nil {
+			return nil, err
+		}
+		uncompressedByteSize := binary.BigEndian.Uint32(framing[0:4])
+		compressedByteSize := binary.BigEndian.Uint32(framing[4:8])
+		// Writers disagree on whether the index records a block's uncompressed
+		// size or its size on disk, framing included. Either is fine.
+		if uncompressedByteSize != block.size && compressedByteSize+8 != block.size {
+			if r.unframedSnappy && r.header.compressionCodec == 3 {
+				if data, ok := r.readUnframedSnappy(block); ok {
+					return data, nil
+				}
+			}
+			if !r.tolerateSize {
+				return nil, errors.New("mismatched uncompressed block size")
+			}
+			r.logf("[Reader.readBlockV1] %s block %d: index size %d matches neither uncompressed size %d nor on-disk size %d, decoding anyway\n",
+				r.name, i, block.size, uncompressedByteSize, compressedByteSize+8)
+		}
+		if !r.inBounds(block.offset+8, uint64(compressedByteSize)) {
+			return nil, fmt.Errorf("block %d extends past the end of the file", i)
+		}
+		compressedBytes, err := r.readAt(block.offset+8, uint64(compressedByteSize))
+		if err != nil {
+			return nil, err
+		}
+		switch r.header.compressionCodec {
+		case 1:
+			return gunzip(compressedBytes, uncompressedByteSize)
+		case 4:
+			uncompressed, err := lz4Decode(compressedBytes, uncompressedByteSize)
+			if err == nil && uint64(len(uncompressed)) != uint64(uncompressedByteSize) {
+				err = errors.New("mismatched uncompressed block size")
+			}
+			return uncompressed, err
+		}
+		return snappyDecode(compressedBytes)
+	}
+	return nil, fmt.Errorf("unsupported compression codec %d", r.header.compressionCodec)
+}
+
+// readUnframedSnappy decodes block as a bare snappy block of block.size bytes,
+// reporting whether that gave a data or meta block.
+func (r *Reader) readUnframedSnappy(block Block) ([]byte, bool) {
+	if !r.inBounds(block.offset, uint64(block.size)) {
+		return nil, false
+	}
+	compressed, err := r.readAt(block.offset, uint64(block.size))
+	if err != nil {
+		return nil, false
+	}
+	data, err := snappyDecode(compressed)
+	if err != nil || len(data) < 8 {
+		return nil, false
+	}
+	if magic := string(data[:8]); magic != "DATABLK*" && magic != "METABLKc" {
+		return nil, false
+	}
+	return data, true
+}
+
+// gunzip decompresses a gzip stream of at most max bytes. gzip can expand
+// its input a thousandfold, so a stream that goes on past max is cut off
+// there rather than read to its end.
+func gunzip(data []byte, max uint32) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(gz, int64(max)+1))
+	if err == nil && uint64(len(out)) > uint64(max) {
+		err = fmt.Errorf("gzip block decompresses to more than %d bytes", max)
+	}
+	return out, err
+}
+
+// snappyDecode decodes a snappy block. The block starts with its decoded
+// length, which snappy allocates before decoding anything, so it is checked
+// first against how much the rest could possibly decode to. No snappy
+// element decodes to more than about 21 times its own size, a 3 byte copy of
+// 64 bytes, so 32 times the block's size is a safe bound.
+func snappyDecode(data []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(n) > 32*uint64(len(data)) {
+		return nil, fmt.Errorf("snappy block of %d bytes claims to decode to %d", len(data), n)
+	}
+	return snappy.Decode(nil, data)
+}
+
+// lz4Decode decodes a raw LZ4 block, as Hadoop's Lz4Codec writes them without
+// the LZ4 frame format around them, of at most max bytes. No input byte
+// decodes to more than 255 output bytes, which bounds what a corrupt max can
+// make it allocate.
+func lz4Decode(data []byte, max uint32) ([]byte, error) {
+	if bound := 255 * uint64(len(data)); bound < uint64(max) {
+		max = uint32(bound)
+	}
+	out := make([]byte, max)
+	n, err := lz4.UncompressBlock(data, out)
+	if err != nil {
+		return nil, err
+	}
+	return out[:n], nil
+}
+
+// readEntryLengths reads the key and value lengths that start each entry in a
+// block, reporting false if the entry they describe does not fit in the rest
+// of buf.
+func readEntryLengths(buf *bytes.Reader) (uint32, uint32, bool) {
+	var lens [8]byte
+	if n, _ := buf.Read(lens[:]); n < len(lens) {
+		return 0, 0, false
+	}
+	keyLen := binary.BigEndian.Uint32(lens[0:4])
+	valLen := binary.BigEndian.Uint32(lens[4:8])
+	if uint64(keyLen)+uint64(valLen) > uint64(buf.Len()) {
+		return 0, 0, false
+	}
+	return keyLen, valLen, true
+}
+
+// skipBadEntry reports whether OnValueError says to skip the entry starting
+// at start in buf, which could not be decoded with err, and if so moves buf
+// to the end of its block.
+func (r *Reader) skipBadEntry(buf *bytes.Reader, start int64, err error) bool {
+	if r.onValueError == nil {
+		return false
+	}
+	var key []byte
+	var keyLen [4]byte
+	if n, _ := buf.ReadAt(keyLen[:], start); n == len(keyLen) {
+		if end := start + 8 + int64(binary.BigEndian.Uint32(keyLen[:])); end <= buf.Size() {
+			key = make([]byte, end-start-8)
+			buf.ReadAt(key, start+8)
+		}
+	}
+	if !r.onValueError(key, err) {
+		return false
+	}
+	buf.Seek(0, io.SeekEnd)
+	return true
+}
+
+// readEntry fills key and value, sized from readEntryLengths, with the entry's
+// key and value.
+func readEntry(buf io.Reader, key, value []byte) error {
+	if _, err := io.ReadFull(buf, key); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(buf, value)
+	return err
+}
+
+// inBounds reports whether the n bytes at offset lie within the file.
+func (r *Reader) inBounds(offset, n uint64) bool {
+	return offset <= r.size && n <= r.size-offset
+}
+
+// maxInt is the largest slice length, which is smaller than a file offset can
+// be on 32 bit platforms.
+const maxInt = uint64(^uint(0) >> 1)
+
+// readAt returns the n bytes of the file at offset. For mapped files that is
+// a slice of the mapping; otherwise they are read from source into a new
+// buffer.
+func (r *Reader) readAt(offset, n uint64) ([]byte, error) {
+	if !r.inBounds(offset, n) {
+		return nil, fmt.Errorf("read of %d bytes at %d extends past the end of the file", n, offset)
+	}
+	if r.source == nil {
+		return r.mmap[offset : offset+n], nil
+	}
+	if n > maxInt {
+		return nil, fmt.Errorf("read of %d bytes at %d is too large to buffer", n, offset)
+	}
+	buf := make([]byte, n)
+	if r.readTimeout <= 0 {
+		if err := r.readSource(buf, offset); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+
+	// The buffered channel lets a read that timed out finish, and be
+	// dropped, whenever it does.
+	done := make(chan error, 1)
+	go func() {
+		done <- r.readSource(buf, offset)
+	}()
+	timer := time.NewTimer(r.readTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+		return buf, nil
+	case <-timer.C:
+		return nil, ErrReadTimeout
+	}
+}
+
+// readSource fills buf from source at offset. Like io.ReadFull, it reports a
+// short read as io.ErrUnexpectedEOF, whether source gave io.EOF or no error.
+func (r *Reader) readSource(buf []byte, offset uint64) error {
+	if read, err := r.source.ReadAt(buf, int64(offset)); read < len(buf) {
+		if err == nil || err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// uint32At returns the big endian uint32 at offset, or 0 if it cannot be
+// read.
+func (r *Reader) uint32At(offset uint64) uint32 {
+	b, err := r.readAt(offset, 4)
+	if err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+// codecName maps a trailer compression codec to the name HBase uses for it.
+func codecName(codec uint32) string {
+	switch codec {
+	case 0:
+		return "lzo"
+	case 1:
+		return "gzip"
+	case 2:
+		return "none"
+	case 3:
+		return "snappy"
+	case 4:
+		return "lz4"
+	}
+	return fmt.Sprintf("unknown(%d)", codec)
 }
@@ -0,0 +1,1762 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// stallingSource serves data, but once stalled blocks every read until
+// released.
+type stallingSource struct {
+	data    *bytes.Reader
+	stalled int32
+	release chan struct{}
+}
+
+func newStallingSource(data []byte) *stallingSource {
+	return &stallingSource{data: bytes.NewReader(data), release: make(chan struct{})}
+}
+
+func (s *stallingSource) ReadAt(p []byte, off int64) (int, error) {
+	if atomic.LoadInt32(&s.stalled) != 0 {
+		<-s.release
+	}
+	return s.data.ReadAt(p, off)
+}
+
+func TestReadTimeout(t *testing.T) {
+	data := writeEntries(t, WriterOptions{BlockSize: 64}, sequentialEntries(100))
+	opts := ReaderOptions{ReadTimeout: 20 * time.Millisecond}
+
+	t.Run("open", func(t *testing.T) {
+		source := newStallingSource(data)
+		defer close(source.release)
+		source.stalled = 1
+		if _, err := NewReaderAtWithOptions(source, int64(len(data)), opts); err != ErrReadTimeout {
+			t.Fatalf("got %v, expected ErrReadTimeout", err)
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		source := newStallingSource(data)
+		defer close(source.release)
+		r, err := NewReaderAtWithOptions(source, int64(len(data)), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := NewScanner(r)
+		if _, err, ok := s.GetFirst([]byte("key000010")); err != nil || !ok {
+			t.Fatalf("got %v, %v before stalling", err, ok)
+		}
+
+		atomic.StoreInt32(&source.stalled, 1)
+		start := time.Now()
+		if _, err, _ := s.GetFirst([]byte("key000090")); err != ErrReadTimeout {
+			t.Fatalf("got %v, expected ErrReadTimeout", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("timed out after %s", elapsed)
+		}
+	})
+
+	t.Run("off", func(t *testing.T) {
+		r, err := NewReaderAtWithOptions(newStallingSource(data), int64(len(data)), ReaderOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readAll(t, r); len(got) != 100 {
+			t.Fatalf("read %d entries, expected 100", len(got))
+		}
+	})
+}
+
+func TestBlockHooks(t *testing.T) {
+	entries := sequentialEntries(200)
+	data := writeEntries(t, WriterOptions{Compression: "snappy", BlockSize: 256}, entries)
+
+	var lock sync.Mutex
+	decoded := map[int][]byte{}
+	loads := 0
+	opts := ReaderOptions{
+		OnBlockDecoded: func(i int, data []byte) {
+			lock.Lock()
+			defer lock.Unlock()
+			decoded[i] = data
+		},
+		BlockLoader: func(i int) ([]byte, bool) {
+			lock.Lock()
+			defer lock.Unlock()
+			loads += 1
+			data, ok := decoded[i]
+			return data, ok
+		},
+	}
+
+	r, err := NewReaderAtWithOptions(bytes.NewReader(data), int64(len(data)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, r); !reflect.DeepEqual(got, entries) {
+		t.Fatalf("read %d entries, expected %d", len(got), len(entries))
+	}
+	if len(decoded) != r.BlockCount() || loads != r.BlockCount() {
+		t.Fatalf("%d of %d blocks decoded after %d loads", len(decoded), r.BlockCount(), loads)
+	}
+
+	// Served by the loader from now on, so a source that fails every read
+	// is never touched.
+	r, err = NewReaderAtWithOptions(bytes.NewReader(data), int64(len(data)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.source = failingSource{}
+	if got := readAll(t, r); !reflect.DeepEqual(got, entries) {
+		t.Fatalf("read %d entries from the loader, expected %d", len(got), len(entries))
+	}
+
+	// With the block cache on, the hooks only see its misses.
+	loads = 0
+	opts.BlockCacheBytes = 1 << 20
+	r, err = NewReaderAtWithOptions(bytes.NewReader(data), int64(len(data)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, r)
+	readAll(t, r)
+	if loads != r.BlockCount() {
+		t.Errorf("loader asked %d times for %d cached blocks", loads, r.BlockCount())
+	}
+
+	// A loader returning something other than a block is an error.
+	r, err = NewReaderAtWithOptions(bytes.NewReader(data), int64(len(data)), ReaderOptions{
+		BlockLoader: func(i int) ([]byte, bool) { return []byte("garbage"), true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetBlock(0); err == nil {
+		t.Error("used a block without its magic from the loader")
+	}
+}
+
+type failingSource struct{}
+
+func (failingSource) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("read from the file")
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	before := sequentialEntries(100)
+	if err := ioutil.WriteFile(path, writeEntries(t, WriterOptions{BlockSize: 128}, before), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReaderFromPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.SetBlockCacheBytes(1 << 20)
+	if got := readAll(t, r); !reflect.DeepEqual(got, before) {
+		t.Fatalf("read %d entries, expected %d", len(got), len(before))
+	}
+
+	// The replacement's blocks start at the same offsets as the cached ones.
+	after := make([]testEntry, 150)
+	for i := range after {
+		after[i] = testEntry{fmt.Sprintf("key%06d", i), fmt.Sprintf("other%d", i)}
+	}
+	replace(t, path, writeEntries(t, WriterOptions{BlockSize: 128}, after))
+
+	if err := r.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, r); !reflect.DeepEqual(got, after) {
+		t.Fatalf("read %d entries after reopening, expected %d", len(got), len(after))
+	}
+	if r.EntryCount() != uint64(len(after)) {
+		t.Errorf("trailer says %d entries after reopening, expected %d", r.EntryCount(), len(after))
+	}
+
+	// A file that is no longer an HFile leaves the reader as it was.
+	replace(t, path, []byte("not an hfile"))
+	if err := r.Reopen(); err == nil {
+		t.Fatal("reopened a file that is not an HFile")
+	}
+	if got := readAll(t, r); !reflect.DeepEqual(got, after) {
+		t.Fatalf("read %d entries after a failed reopen, expected %d", len(got), len(after))
+	}
+
+	if err := parseEntries(t, WriterOptions{}, before).Reopen(); err == nil {
+		t.Error("reopened a reader without a path")
+	}
+}
+
+// replace atomically replaces the file at path with one holding data, as the
+// files a Reader has mapped must be.
+func replace(t *testing.T, path string, data []byte) {
+	t.Helper()
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOnValueError(t *testing.T) {
+	entries := sequentialEntries(30)
+	data := writeEntries(t, WriterOptions{BlockSize: 64}, entries)
+	r, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := r.BlockIndex()
+	bad := blocks[1].FirstKey
+	// Give block 1's first entry a value running past the end of the block.
+	binary.BigEndian.PutUint32(data[blocks[1].Offset+12:], 1<<20)
+
+	// Everything but block 1 is left.
+	var expected []testEntry
+	for _, e := range entries {
+		if bytes.Compare([]byte(e.key), bad) < 0 || bytes.Compare([]byte(e.key), blocks[2].FirstKey) >= 0 {
+			expected = append(expected, e)
+		}
+	}
+
+	for _, skip := range []bool{false, true} {
+		var reported [][]byte
+		r, err := NewReaderAtWithOptions(bytes.NewReader(data), int64(len(data)), ReaderOptions{
+			OnValueError: func(key []byte, err error) bool {
+				reported = append(reported, key)
+				return skip
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []testEntry
+		it := r.NewIterator()
+		for it.Next() {
+			got = append(got, testEntry{string(it.Key()), string(it.Value())})
+		}
+		scanErr := it.Err()
+		// Seeks and prefixes land in the bad block too.
+		seeked := it.Seek(bad)
+		var prefixed []testEntry
+		p := r.GetPrefix([]byte("key00000"))
+		for p.Next() {
+			prefixed = append(prefixed, testEntry{string(p.Key()), string(p.Value())})
+		}
+		s := NewScanner(r)
+		_, getErr, _ := s.GetFirst(bad)
+		if skip {
+			if scanErr != nil || !reflect.DeepEqual(got, expected) {
+				t.Errorf("skipping: scanned %d entries, expected %d, err %v", len(got), len(expected), scanErr)
+			}
+			if !seeked || !bytes.Equal(it.Key(), blocks[2].FirstKey) {
+				t.Errorf("skipping: seek got %v at %q, %v", seeked, it.Key(), it.Err())
+			}
+			if p.Err() != nil || !reflect.DeepEqual(prefixed, expected[:len(expected)-20]) {
+				t.Errorf("skipping: prefix got %v, %v, expected %v", prefixed, p.Err(), expected[:len(expected)-20])
+			}
+			if getErr != nil {
+				t.Errorf("skipping: lookup failed with %s", getErr)
+			}
+			if values, err, ok := s.GetAll(blocks[2].FirstKey); err != nil || !ok || len(values) != 1 {
+				t.Errorf("skipping: lookup past the bad block got %v, %v, %v", values, err, ok)
+			}
+		} else {
+			if scanErr == nil {
+				t.Error("scanned past the bad entry")
+			}
+			if seeked || it.Err() == nil {
+				t.Error("seeked past the bad entry")
+			}
+			if p.Err() == nil {
+				t.Error("prefix scanned past the bad entry")
+			}
+			if getErr == nil {
+				t.Error("looked up past the bad entry")
+			}
+		}
+		// The last lookup starts in block 1, in case the key's entries run
+		// on from there.
+		calls := 4
+		if skip {
+			calls = 5
+		}
+		if len(reported) != calls {
+			t.Errorf("skip %v: OnValueError called %d times, expected %d", skip, len(reported), calls)
+		}
+		for _, key := range reported {
+			if !bytes.Equal(key, bad) {
+				t.Errorf("skip %v: OnValueError called with %q, expected %q", skip, key, bad)
+			}
+		}
+	}
+}
+
+// TestSnappySizeMismatch checks the sizes a snappy block's index entry may
+// record: its size on disk as the Writer does, its uncompressed size as some
+// other writers do, or, only with SetTolerateSizeMismatch, anything else.
+func TestSnappySizeMismatch(t *testing.T) {
+	entries := sequentialEntries(200)
+	r := parseEntries(t, WriterOptions{Compression: "snappy", BlockSize: 256}, entries)
+
+	for i := range r.index {
+		if got, want := r.index[i].size, r.blockOnDiskSize(i); got != want {
+			t.Fatalf("block %d: index size %d, want on-disk size %d", i, got, want)
+		}
+		r.index[i].size = r.blockUncompressedSize(i)
+	}
+	if r.index[0].size == r.blockOnDiskSize(0) {
+		t.Fatal("on-disk and uncompressed sizes match, pick compressible entries")
+	}
+	if got := readAll(t, r); !reflect.DeepEqual(got, entries) {
+		t.Errorf("uncompressed sizes: got %d entries, want %d", len(got), len(entries))
+	}
+
+	r.index[0].size++
+	if _, err := r.GetBlock(0); err == nil || !strings.Contains(err.Error(), "mismatched") {
+		t.Errorf("arbitrary size: got %v, want a mismatch error", err)
+	}
+	r.SetTolerateSizeMismatch(true)
+	if got := readAll(t, r); !reflect.DeepEqual(got, entries) {
+		t.Errorf("tolerated: got %d entries, want %d", len(got), len(entries))
+	}
+}
+
+// TestEmptyDataIndex opens files whose one data block is missing from the
+// data index, as some writers leave it, with and without a meta block after
+// the data block.
+func TestEmptyDataIndex(t *testing.T) {
+	entries := sequentialEntries(50)
+	for _, opts := range []WriterOptions{
+		{},
+		{Compression: "snappy"},
+		{Compression: "lz4", Properties: map[string]string{"source": "test"}},
+	} {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if err := w.Add([]byte(e.key), []byte(e.value)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.flushBlock(); err != nil {
+			t.Fatal(err)
+		}
+		if len(w.index) != 1 {
+			t.Fatalf("%+v: wrote %d blocks, want 1", opts, len(w.index))
+		}
+		w.index = nil
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := Parse(buf.Bytes())
+		if err != nil {
+			t.Fatalf("%+v: %s", opts, err)
+		}
+		if len(r.index) != 1 || string(r.index[0].firstKeyBytes) != entries[0].key {
+			t.Errorf("%+v: got index %+v", opts, r.index)
+		}
+		if got := readAll(t, r); !reflect.DeepEqual(got, entries) {
+			t.Errorf("%+v: got %d entries, want %d", opts, len(got), len(entries))
+		}
+		s := NewScanner(r)
+		if value, err, ok := s.GetFirst([]byte(entries[25].key)); err != nil || !ok || string(value) != entries[25].value {
+			t.Errorf("%+v: got %q, %v, %v", opts, value, err, ok)
+		}
+	}
+}
+
+// shortSource serves data, but once short returns only half of each read,
+// with no error, as an io.ReaderAt must not.
+type shortSource struct {
+	data  *bytes.Reader
+	short int32
+}
+
+func (s *shortSource) ReadAt(p []byte, off int64) (int, error) {
+	if atomic.LoadInt32(&s.short) != 0 {
+		p = p[:len(p)/2]
+	}
+	n, err := s.data.ReadAt(p, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// TestShortRead checks that a source returning fewer bytes than asked for
+// without an error is reported as io.ErrUnexpectedEOF rather than read as
+// zeroes.
+func TestShortRead(t *testing.T) {
+	data := writeEntries(t, WriterOptions{Compression: "snappy", BlockSize: 256}, sequentialEntries(100))
+
+	src := &shortSource{data: bytes.NewReader(data), short: 1}
+	if _, err := NewReaderAt(src, int64(len(data))); err == nil || !strings.Contains(err.Error(), io.ErrUnexpectedEOF.Error()) {
+		t.Errorf("open: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	src.short = 0
+	r, err := NewReaderAt(src, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&src.short, 1)
+	if _, err := r.GetBlock(1); err == nil || !strings.Contains(err.Error(), io.ErrUnexpectedEOF.Error()) {
+		t.Errorf("GetBlock: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+// TestOversizedOffsets opens files whose trailer points past the end of the
+// file, out to the largest offsets a uint64 holds, which must be errors
+// rather than panics or wrapped-around slices.
+func TestOversizedOffsets(t *testing.T) {
+	data := writeEntries(t, WriterOptions{Properties: map[string]string{"a": "b"}}, sequentialEntries(100))
+	trailer := len(data) - 60
+	for _, field := range []struct {
+		name string
+		at   int
+	}{
+		{"file info", 8},
+		{"data index", 16},
+		{"meta index", 28},
+	} {
+		for _, offset := range []uint64{uint64(len(data)), uint64(len(data)) + 1, 1 << 63, math.MaxUint64 - 7, math.MaxUint64} {
+			bad := append([]byte(nil), data...)
+			binary.BigEndian.PutUint64(bad[trailer+field.at:], offset)
+			if _, err := Parse(bad); err == nil {
+				t.Errorf("%s offset %d: opened", field.name, offset)
+			}
+			if _, err := NewReaderAt(bytes.NewReader(bad), int64(len(bad))); err == nil {
+				t.Errorf("%s offset %d: opened from a ReaderAt", field.name, offset)
+			}
+		}
+	}
+
+	// A data index entry pointing past the file.
+	r, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := int(r.header.dataIndexOffset) + 8
+	for _, offset := range []uint64{uint64(len(data)), math.MaxUint64 - 3} {
+		bad := append([]byte(nil), data...)
+		binary.BigEndian.PutUint64(bad[index:], offset)
+		if r, err := Parse(bad); err == nil {
+			if _, err := r.GetBlock(0); err == nil {
+				t.Errorf("block offset %d: read", offset)
+			}
+		}
+	}
+}
+
+// TestEmptyFile looks up keys in a file with no entries and so no data
+// blocks, as HBase writes for empty regions.
+func TestEmptyFile(t *testing.T) {
+	for _, codec := range []string{"none", "snappy", "lz4"} {
+		r := parseEntries(t, WriterOptions{Compression: codec}, nil)
+		if len(r.index) != 0 {
+			t.Fatalf("%s: got %d blocks", codec, len(r.index))
+		}
+		if got := readAll(t, r); len(got) != 0 {
+			t.Errorf("%s: iterated %v", codec, got)
+		}
+
+		for _, ordered := range []bool{true, false} {
+			s := NewScanner(r)
+			s.Ordered(ordered)
+			for _, key := range []string{"", "key", "\xff"} {
+				if value, err, ok := s.GetFirst([]byte(key)); err != nil || ok {
+					t.Errorf("%s: GetFirst(%q): got %q, %v, %v", codec, key, value, err, ok)
+				}
+				if values, err, ok := s.GetAll([]byte(key)); err != nil || ok {
+					t.Errorf("%s: GetAll(%q): got %q, %v, %v", codec, key, values, err, ok)
+				}
+				if n, err := s.Count([]byte(key)); err != nil || n != 0 {
+					t.Errorf("%s: Count(%q): got %d, %v", codec, key, n, err)
+				}
+			}
+		}
+
+		var out bytes.Buffer
+		r.PrintDebugInfo(&out)
+		for _, want := range []string{"entries:  0\n", "blocks:  0\n"} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("%s: debug info %q lacks %q", codec, out.String(), want)
+			}
+		}
+	}
+}
+
+// TestMetaIndexFirst opens a file laid out as some writers do, with the meta
+// index ahead of the data index rather than after it.
+func TestMetaIndexFirst(t *testing.T) {
+	entries := sequentialEntries(100)
+	props := map[string]string{"layout": "reversed"}
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, WriterOptions{BlockSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if err := w.Add([]byte(e.key), []byte(e.value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.flushBlock(); err != nil {
+		t.Fatal(err)
+	}
+	// Close, with the two indexes swapped.
+	raw := append([]byte("METABLKc"), writeInfo(map[string][]byte{"layout": []byte("reversed")})...)
+	meta := Block{offset: w.offset, firstKeyBytes: []byte(propertiesBlockName)}
+	meta.size = w.writeBlock(raw)
+	fileInfoOffset := w.offset
+	w.write(w.fileInfo())
+	metaIndexOffset := w.offset
+	w.write(writeBlockIndex([]Block{meta}))
+	dataIndexOffset := w.offset
+	w.write(writeBlockIndex(w.index))
+	trailer := make([]byte, 60)
+	copy(trailer, "TRABLK\"$")
+	binary.BigEndian.PutUint64(trailer[8:16], fileInfoOffset)
+	binary.BigEndian.PutUint64(trailer[16:24], dataIndexOffset)
+	binary.BigEndian.PutUint32(trailer[24:28], uint32(len(w.index)))
+	binary.BigEndian.PutUint64(trailer[28:36], metaIndexOffset)
+	binary.BigEndian.PutUint32(trailer[36:40], 1)
+	binary.BigEndian.PutUint32(trailer[48:52], uint32(w.entries))
+	binary.BigEndian.PutUint32(trailer[52:56], w.codec)
+	binary.BigEndian.PutUint32(trailer[56:60], 1)
+	w.write(trailer)
+	if w.err != nil {
+		t.Fatal(w.err)
+	}
+
+	r, err := Parse(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.index) != len(w.index) {
+		t.Errorf("got %d blocks, want %d", len(r.index), len(w.index))
+	}
+	if err := r.Validate(); err != nil {
+		t.Error(err)
+	}
+	if names, err := r.MetaBlockNames(); err != nil || !reflect.DeepEqual(names, []string{propertiesBlockName}) {
+		t.Errorf("got meta blocks %v, %v", names, err)
+	}
+	if got, err := r.Properties(); err != nil || !reflect.DeepEqual(got, props) {
+		t.Errorf("got properties %v, %v, want %v", got, err, props)
+	}
+	if got := readAll(t, r); !reflect.DeepEqual(got, entries) {
+		t.Errorf("read %d entries, want %d", len(got), len(entries))
+	}
+}
+
+func TestPrintDebugInfo(t *testing.T) {
+	// Entries of 8+9+6 bytes, three to a block of 64.
+	r := parseEntries(t, WriterOptions{Compression: "snappy", BlockSize: 64}, sequentialEntries(10))
+	var out bytes.Buffer
+	r.PrintDebugInfo(&out)
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 3+4 {
+		t.Fatalf("got %d lines: %q", len(lines), out.String())
+	}
+	for i, want := range []string{"version: 1.0", "entries:  10", "blocks:  4"} {
+		if lines[i] != want {
+			t.Errorf("line %d: got %q, want %q", i, lines[i], want)
+		}
+	}
+	for i, entries := range []int{3, 3, 3, 1} {
+		prefix := fmt.Sprintf("\t#%d: key%06d (", i, 3*i)
+		counts := fmt.Sprintf(" entries: %d, size: %d, uncompressed: %d", entries, r.blockOnDiskSize(i), r.blockUncompressedSize(i))
+		if line := lines[3+i]; !strings.HasPrefix(line, prefix) || !strings.HasSuffix(line, counts) {
+			t.Errorf("block %d: got %q, want %q...%q", i, line, prefix, counts)
+		}
+	}
+}
+
+// decodeRecord is a call to Metrics.BlockDecoded.
+type decodeRecord struct {
+	codec                    string
+	compressed, uncompressed int
+}
+
+type recordingMetrics struct {
+	decoded []decodeRecord
+}
+
+func (m *recordingMetrics) BlockDecoded(codec string, compressedBytes, uncompressedBytes int, elapsed time.Duration) {
+	m.decoded = append(m.decoded, decodeRecord{codec, compressedBytes, uncompressedBytes})
+}
+
+func TestMetrics(t *testing.T) {
+	for _, codec := range []string{"none", "snappy", "lz4"} {
+		r := parseEntries(t, WriterOptions{Compression: codec, BlockSize: 256}, sequentialEntries(100))
+		m := &recordingMetrics{}
+		r.SetMetrics(m)
+		readAll(t, r)
+
+		if len(m.decoded) != len(r.index) {
+			t.Fatalf("%s: got %d decodes, want one for each of %d blocks", codec, len(m.decoded), len(r.index))
+		}
+		for i, got := range m.decoded {
+			want := decodeRecord{codec, int(r.blockOnDiskSize(i)), int(r.blockUncompressedSize(i))}
+			if got != want {
+				t.Errorf("%s: block %d: got %+v, want %+v", codec, i, got, want)
+			}
+		}
+	}
+}
+
+func TestOpenVerified(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	entries := sequentialEntries(100)
+	data := writeEntries(t, WriterOptions{BlockSize: 256}, entries)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenVerified(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, r); !reflect.DeepEqual(got, entries) {
+		t.Errorf("read %d entries, want %d", len(got), len(entries))
+	}
+	r.Close()
+
+	// Swap two keys in the last block: the file still opens, but is out of
+	// order.
+	at := bytes.Index(data, []byte("key000098"))
+	copy(data[at:], "key000099")
+	copy(data[at+len("key000098value98")+8:], "key000098")
+	replace(t, path, data)
+	if r, err := NewReaderFromPath(path); err != nil {
+		t.Fatalf("NewReaderFromPath: %s", err)
+	} else {
+		r.Close()
+	}
+	if _, err := OpenVerified(path); err == nil || !strings.Contains(err.Error(), "sorts before previous key") {
+		t.Errorf("OpenVerified: got %v, want an ordering error", err)
+	}
+}
+
+func TestBadTrailer(t *testing.T) {
+	data := writeEntries(t, WriterOptions{}, sequentialEntries(100))
+	r, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version1 := []byte{0, 0, 0, 1}
+	withVersion := func(b []byte) []byte {
+		return append(append([]byte(nil), b...), version1...)
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(data)
+	zw.Close()
+
+	damaged := append([]byte(nil), data...)
+	copy(damaged[len(damaged)-60:], "XXXXXXXX")
+
+	// Cut off partway through the data index, which then sits where the
+	// trailer should.
+	truncated := append([]byte(nil), data[:r.header.dataIndexOffset+8]...)
+	truncated = withVersion(append(truncated, make([]byte, 48)...))
+
+	for _, test := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"gzip", gz.Bytes(), "gzip"},
+		{"text", withVersion(append([]byte("\xef\xbb\xbfsome text"), make([]byte, 60)...)), "byte order mark"},
+		{"parquet", withVersion(append([]byte("PAR1"), make([]byte, 60)...)), "Parquet"},
+		{"sequence file", withVersion(append([]byte("SEQ\x06"), make([]byte, 60)...)), "SequenceFile"},
+		{"truncated", truncated, "may be truncated"},
+		{"damaged", damaged, "trailer is damaged"},
+		{"other", withVersion(make([]byte, 100)), "not an HFile"},
+		{"short", []byte("hi"), ""},
+		{"empty", nil, ""},
+	} {
+		_, err := Parse(test.data)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want an error mentioning %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestRangeInSingleBlock(t *testing.T) {
+	// Blocks of 20 bytes hold two entries of 8+1+2: [b c] [d f] [f g].
+	r := parseEntries(t, WriterOptions{BlockSize: 20}, []testEntry{
+		{"b", "01"}, {"c", "02"}, {"d", "03"}, {"f", "04"}, {"f", "05"}, {"g", "06"},
+	})
+	for _, test := range []struct {
+		start, end string
+		ok         bool
+		block      int
+	}{
+		{"a", "a", false, -1}, // before the file
+		{"a", "c", true, 0},
+		{"b", "cz", true, 0},
+		{"c", "d", false, -1},
+		{"d", "e", false, -1}, // d may end block 0 and start block 1
+		{"da", "e", true, 1},
+		{"d", "f", false, -1}, // f may end block 1 and start block 2
+		{"e", "e", true, 1},
+		{"g", "z", true, 2},
+		{"a", "z", false, -1},
+	} {
+		ok, block := r.RangeInSingleBlock([]byte(test.start), []byte(test.end))
+		if ok != test.ok || block != test.block {
+			t.Errorf("[%s, %s]: got %v, %d, want %v, %d", test.start, test.end, ok, block, test.ok, test.block)
+		}
+	}
+}
+
+func TestEntryAt(t *testing.T) {
+	entries := sequentialEntries(100)
+	r := parseEntries(t, WriterOptions{Compression: "snappy", BlockSize: 128}, entries)
+	for _, n := range rand.New(rand.NewSource(1)).Perm(len(entries)) {
+		key, value, ok := r.EntryAt(uint64(n))
+		if !ok || string(key) != entries[n].key || string(value) != entries[n].value {
+			t.Errorf("%d: got %q, %q, %v, want %v", n, key, value, ok, entries[n])
+		}
+	}
+	for _, n := range []uint64{uint64(len(entries)), math.MaxUint64} {
+		if key, _, ok := r.EntryAt(n); ok {
+			t.Errorf("%d: got %q past the last entry", n, key)
+		}
+	}
+}
+
+func TestBlockKeyRange(t *testing.T) {
+	// Entries of 8+9+6 bytes, three to a block of 64.
+	r := parseEntries(t, WriterOptions{BlockSize: 64}, sequentialEntries(10))
+	for i, want := range [][2]int{{0, 2}, {3, 5}, {6, 8}, {9, 9}} {
+		first, last, err := r.BlockKeyRange(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(first) != fmt.Sprintf("key%06d", want[0]) || string(last) != fmt.Sprintf("key%06d", want[1]) {
+			t.Errorf("block %d: got %s to %s, want keys %d to %d", i, first, last, want[0], want[1])
+		}
+	}
+	for _, i := range []int{-1, 4} {
+		if _, _, err := r.BlockKeyRange(i); err == nil {
+			t.Errorf("block %d: got no error", i)
+		}
+	}
+	r.Close()
+	if _, _, err := r.BlockKeyRange(0); err != ErrClosed {
+		t.Errorf("after Close: got %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	entries := sequentialEntries(100)
+	if err := ioutil.WriteFile(path, writeEntries(t, WriterOptions{BlockSize: 256}, entries), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReaderFromPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewScanner(r)
+	value, err, ok := s.GetFirst([]byte(entries[50].key))
+	if err != nil || !ok {
+		t.Fatalf("got %v, %v", err, ok)
+	}
+	read := readAll(t, r)
+	before := r.NewIterator()
+	if !before.Next() {
+		t.Fatal(before.Err())
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// These were copied out of the mapping, so outlive it.
+	if string(value) != entries[50].value || !reflect.DeepEqual(read, entries) {
+		t.Errorf("values changed after Close")
+	}
+	if _, err, ok := s.GetFirst([]byte(entries[50].key)); err != ErrClosed || ok {
+		t.Errorf("GetFirst: got %v, %v, want %v", err, ok, ErrClosed)
+	}
+	if _, err := r.GetBlock(0); err != ErrClosed {
+		t.Errorf("GetBlock: got %v, want %v", err, ErrClosed)
+	}
+	if err := r.Validate(); err != ErrClosed {
+		t.Errorf("Validate: got %v, want %v", err, ErrClosed)
+	}
+
+	// Iterators fail rather than run out, whether opened before or after.
+	if before.Next() || before.Err() != ErrClosed {
+		t.Errorf("open iterator: got %v, want %v", before.Err(), ErrClosed)
+	}
+	if it := r.NewIterator(); it.Next() || it.Err() != ErrClosed {
+		t.Errorf("NewIterator: got %v, want %v", it.Err(), ErrClosed)
+	}
+	if it := r.NewIterator(); it.Seek(nil) || it.Err() != ErrClosed {
+		t.Errorf("Seek: got %v, want %v", it.Err(), ErrClosed)
+	}
+	if it := r.NewReverseIterator(); it.Next() || it.Err() != ErrClosed {
+		t.Errorf("NewReverseIterator: got %v, want %v", it.Err(), ErrClosed)
+	}
+	if keys, _, err := r.GetRange(nil, []byte("z")); err != ErrClosed || keys != nil {
+		t.Errorf("GetRange: got %d keys, %v, want %v", len(keys), err, ErrClosed)
+	}
+	if keys, _, err := r.GetRangeLimit(nil, []byte("z"), 10); err != ErrClosed || keys != nil {
+		t.Errorf("GetRangeLimit: got %d keys, %v, want %v", len(keys), err, ErrClosed)
+	}
+	if p := r.GetPrefix([]byte("key")); p.Next() || p.Err() != ErrClosed {
+		t.Errorf("GetPrefix: got %v, want %v", p.Err(), ErrClosed)
+	}
+	if f := r.ScanFilter(func(key, value []byte) bool { return true }); f.Next() || f.Err() != ErrClosed {
+		t.Errorf("ScanFilter: got %v, want %v", f.Err(), ErrClosed)
+	}
+	if _, _, err := EqualPrefix(r, r, []byte("key")); err != ErrClosed {
+		t.Errorf("EqualPrefix: got %v, want %v", err, ErrClosed)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("second Close: got %v", err)
+	}
+}
+
+// TestGzipBlocks reads a version 1 file of gzip compressed blocks, which the
+// Writer does not write, so the test frames them itself.
+func TestGzipBlocks(t *testing.T) {
+	entries := sequentialEntries(100)
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.codec = 1
+	for start := 0; start < len(entries); start += 30 {
+		raw := bytes.NewBufferString("DATABLK*")
+		end := start + 30
+		if end > len(entries) {
+			end = len(entries)
+		}
+		for _, e := range entries[start:end] {
+			binary.Write(raw, binary.BigEndian, uint32(len(e.key)))
+			binary.Write(raw, binary.BigEndian, uint32(len(e.value)))
+			raw.WriteString(e.key + e.value)
+		}
+		var gz bytes.Buffer
+		zw := gzip.NewWriter(&gz)
+		zw.Write(raw.Bytes())
+		zw.Close()
+
+		var framing [8]byte
+		binary.BigEndian.PutUint32(framing[0:4], uint32(raw.Len()))
+		binary.BigEndian.PutUint32(framing[4:8], uint32(gz.Len()))
+		w.index = append(w.index, Block{offset: w.offset, size: uint32(8 + gz.Len()), firstKeyBytes: []byte(entries[start].key)})
+		w.write(framing[:])
+		w.write(gz.Bytes())
+		w.entries += uint64(end - start)
+		w.totalUncompressedDataBytes += uint64(raw.Len())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Parse(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.CompressionCodec() != "gzip" {
+		t.Errorf("got codec %s", r.CompressionCodec())
+	}
+	if err := r.Validate(); err != nil {
+		t.Error(err)
+	}
+	if got := readAll(t, r); !reflect.DeepEqual(got, entries) {
+		t.Errorf("read %d entries, want %d", len(got), len(entries))
+	}
+	s := NewScanner(r)
+	if value, err, ok := s.GetFirst([]byte(entries[75].key)); err != nil || !ok || string(value) != entries[75].value {
+		t.Errorf("got %q, %v, %v", value, err, ok)
+	}
+}
+
+// TestConcurrentReads shares a reader, with its block cache on, between
+// goroutines that each look up keys with their own Scanner and iterate. Run
+// it with -race.
+func TestConcurrentReads(t *testing.T) {
+	entries := sequentialEntries(1000)
+	r := parseEntries(t, WriterOptions{Compression: "snappy", BlockSize: 256}, entries)
+	r.SetBlockCacheBytes(4 << 10) // small enough to evict
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			s := NewScanner(r)
+			for _, i := range rand.New(rand.NewSource(seed)).Perm(len(entries))[:200] {
+				value, err, ok := s.GetFirst([]byte(entries[i].key))
+				if err != nil || !ok || string(value) != entries[i].value {
+					errs <- fmt.Errorf("%s: got %q, %v, %v", entries[i].key, value, err, ok)
+					return
+				}
+			}
+			it := r.NewIterator()
+			n := 0
+			for ; it.Next(); n++ {
+			}
+			if it.Err() != nil || n != len(entries) {
+				errs <- fmt.Errorf("iterated %d entries, %v", n, it.Err())
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestFileInfo(t *testing.T) {
+	custom := map[string][]byte{
+		"app.empty": {},
+		"app.long":  bytes.Repeat([]byte("x"), 70000), // a vlong length of several bytes
+		"app.bytes": {0, 1, 0xff},
+	}
+	entries := []testEntry{{"a", "12"}, {"bbb", "3456"}}
+	r := parseEntries(t, WriterOptions{FileInfo: custom}, entries)
+	info := r.FileInfo()
+	for k, v := range custom {
+		if !bytes.Equal(info[k], v) {
+			t.Errorf("%s: got %d bytes, want %d", k, len(info[k]), len(v))
+		}
+	}
+	for k, v := range map[string][]byte{
+		"hfile.LASTKEY":       []byte("bbb"),
+		"hfile.AVG_KEY_LEN":   {0, 0, 0, 2},
+		"hfile.AVG_VALUE_LEN": {0, 0, 0, 3},
+	} {
+		if !bytes.Equal(info[k], v) {
+			t.Errorf("%s: got %v, want %v", k, info[k], v)
+		}
+	}
+	if len(info) != len(custom)+4 {
+		t.Errorf("got %d entries, want %d", len(info), len(custom)+4)
+	}
+}
+
+func TestMetaBlock(t *testing.T) {
+	blocks := []struct{ name, data string }{{"BLOOM_FILTER_META", "meta"}, {"BLOOM_FILTER_DATA", "bits"}, {"app", ""}}
+	for _, codec := range []string{"none", "snappy", "lz4"} {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, WriterOptions{Compression: codec})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Add([]byte("key"), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.flushBlock(); err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range blocks {
+			blk := Block{offset: w.offset, firstKeyBytes: []byte(b.name)}
+			blk.size = w.writeBlock([]byte("METABLKc" + b.data))
+			w.metaIndex = append(w.metaIndex, blk)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r, err := Parse(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names, err := r.MetaBlockNames()
+		if err != nil || len(names) != len(blocks) {
+			t.Fatalf("%s: got %v, %v", codec, names, err)
+		}
+		for i, b := range blocks {
+			if names[i] != b.name {
+				t.Errorf("%s: meta block %d is %q, want %q", codec, i, names[i], b.name)
+			}
+			if data, ok := r.MetaBlock(b.name); !ok || string(data) != b.data {
+				t.Errorf("%s: %s: got %q, %v, want %q", codec, b.name, data, ok, b.data)
+			}
+		}
+		if data, ok := r.MetaBlock("missing"); ok {
+			t.Errorf("%s: got %q for a missing meta block", codec, data)
+		}
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	entries := sequentialEntries(20)
+	r := parseEntries(t, WriterOptions{Compression: "snappy", BlockSize: 64}, entries)
+	var logged bytes.Buffer
+	r.SetLogger(log.New(&logged, "", 0))
+
+	s := NewScanner(r)
+	if _, err, ok := s.GetFirst([]byte(entries[5].key)); err != nil || !ok {
+		t.Fatalf("got %v, %v", err, ok)
+	}
+	if logged.Len() != 0 {
+		t.Errorf("logged without debug: %q", logged.String())
+	}
+
+	// Diagnostics go to the logger without debug.
+	r.index[0].size++
+	r.SetTolerateSizeMismatch(true)
+	if _, err := r.GetBlock(0); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logged.String(), "decoding anyway") {
+		t.Errorf("got %q, want the tolerated size mismatch", logged.String())
+	}
+
+	// Tracing does too.
+	logged.Reset()
+	r.debug = true
+	s.GetFirst([]byte(entries[15].key))
+	if !strings.Contains(logged.String(), "[Scanner.blockFor]") {
+		t.Errorf("got %q, want lookup tracing", logged.String())
+	}
+}
+
+func TestKeyRangeAndCounts(t *testing.T) {
+	entries := append(sequentialEntries(50), testEntry{"last", "1"}, testEntry{"last", "2"})
+	for _, codec := range []string{"none", "snappy"} {
+		r := parseEntries(t, WriterOptions{Compression: codec, BlockSize: 128}, entries)
+		if got := string(r.FirstKey()); got != entries[0].key {
+			t.Errorf("%s: FirstKey: got %q", codec, got)
+		}
+		if got, err := r.LastKey(); err != nil || string(got) != "last" {
+			t.Errorf("%s: LastKey: got %q, %v", codec, got, err)
+		}
+		if got := r.EntryCount(); got != uint64(len(entries)) {
+			t.Errorf("%s: EntryCount: got %d, want %d", codec, got, len(entries))
+		}
+		var raw uint64
+		for i := range r.index {
+			raw += uint64(r.blockUncompressedSize(i))
+		}
+		if got := r.UncompressedSize(); got != raw {
+			t.Errorf("%s: UncompressedSize: got %d, want %d", codec, got, raw)
+		}
+		if got := r.BlockCount(); got != len(r.index) {
+			t.Errorf("%s: BlockCount: got %d, want %d", codec, got, len(r.index))
+		}
+	}
+
+	r := parseEntries(t, WriterOptions{}, nil)
+	if r.FirstKey() != nil || r.EntryCount() != 0 {
+		t.Errorf("empty file: got first key %q and %d entries", r.FirstKey(), r.EntryCount())
+	}
+	if got, err := r.LastKey(); got != nil || err != nil {
+		t.Errorf("empty file: LastKey: got %q, %v", got, err)
+	}
+}
+
+func TestNewReaderFromPath(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	entries := sequentialEntries(100)
+	if err := ioutil.WriteFile(path, writeEntries(t, WriterOptions{BlockSize: 256}, entries), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bad := filepath.Join(dir, "bad")
+	if err := ioutil.WriteFile(bad, make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	openFiles := func() int {
+		fds, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skip("cannot count open files:", err)
+		}
+		return len(fds)
+	}
+
+	before := openFiles()
+	r, err := NewReaderFromPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, r); !reflect.DeepEqual(got, entries) {
+		t.Errorf("read %d entries, want %d", len(got), len(entries))
+	}
+	// The mapping outlives the descriptor, which is closed already.
+	if n := openFiles(); n != before {
+		t.Errorf("%d files open, want %d", n, before)
+	}
+	r.Close()
+
+	if _, err := NewReaderFromPath(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("missing file: got %v", err)
+	}
+	if _, err := NewReaderFromPath(bad); err == nil {
+		t.Error("opened a file that is not an HFile")
+	}
+	if n := openFiles(); n != before {
+		t.Errorf("%d files open after failed opens, want %d", n, before)
+	}
+}
+
+func TestStats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	entries := sequentialEntries(100)
+	data := writeEntries(t, WriterOptions{Compression: "snappy", BlockSize: 256}, entries)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReaderFromPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Stats{Entries: 100, Blocks: len(r.index), MappedBytes: int64(len(data))}
+	if got := r.Stats(); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	r.SetBlockCacheBytes(1 << 20)
+	s := NewScanner(r)
+	s.GetFirst([]byte(entries[0].key))
+	s.GetFirst([]byte(entries[1].key))
+	s.GetFirst([]byte(entries[99].key))
+	block0, err := r.BlockBytes(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := r.BlockBytes(len(r.index) - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.CachedBytes = int64(len(block0) + len(last))
+	want.BlockCacheHits, want.BlockCacheMisses = 2, 2 // the hits are BlockBytes
+	want.Lookups = 3
+	if got := r.Stats(); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	r.Close()
+	if got := r.MappedBytes(); got != 0 {
+		t.Errorf("after Close: got %d mapped bytes", got)
+	}
+	if got := parseEntries(t, WriterOptions{}, entries).MappedBytes(); got != 0 {
+		t.Errorf("Parse: got %d mapped bytes", got)
+	}
+}
+
+func TestBlockBytes(t *testing.T) {
+	entries := sequentialEntries(100)
+	// Uncompressed blocks are stored as BlockBytes returns them, and the
+	// Writer cuts blocks in the same places whatever the codec.
+	raw := writeEntries(t, WriterOptions{BlockSize: 256}, entries)
+	var want [][]byte
+	for _, blk := range parseEntries(t, WriterOptions{BlockSize: 256}, entries).index {
+		want = append(want, raw[blk.offset:blk.offset+uint64(blk.size)])
+	}
+	for _, codec := range []string{"none", "snappy", "lz4"} {
+		r := parseEntries(t, WriterOptions{Compression: codec, BlockSize: 256}, entries)
+		if r.BlockCount() != len(want) {
+			t.Fatalf("%s: got %d blocks, want %d", codec, r.BlockCount(), len(want))
+		}
+		for i := range want {
+			got, err := r.BlockBytes(i)
+			if err != nil || !bytes.Equal(got, want[i]) {
+				t.Errorf("%s: block %d: got %q, %v, want %q", codec, i, got, err, want[i])
+			}
+		}
+		for _, i := range []int{-1, len(want)} {
+			if _, err := r.BlockBytes(i); err == nil || !strings.Contains(err.Error(), "out of range") {
+				t.Errorf("%s: block %d: got %v", codec, i, err)
+			}
+		}
+	}
+
+	// The caller may keep or modify the bytes.
+	r := parseEntries(t, WriterOptions{BlockSize: 256}, entries)
+	data, _ := r.BlockBytes(0)
+	copy(data[8:], "garbage")
+	if got := readAll(t, r); !reflect.DeepEqual(got, entries) {
+		t.Errorf("read %d entries after modifying a block's bytes", len(got))
+	}
+}
+
+func TestReadEntry(t *testing.T) {
+	// Readers may return fewer bytes than asked for, one at a time here.
+	key, value := make([]byte, 3), make([]byte, 5)
+	if err := readEntry(iotest.OneByteReader(strings.NewReader("keyvalue")), key, value); err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != "key" || string(value) != "value" {
+		t.Errorf("got %q, %q", key, value)
+	}
+	if err := readEntry(iotest.OneByteReader(strings.NewReader("keyval")), key, value); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestComparatorClass(t *testing.T) {
+	r := parseEntries(t, WriterOptions{}, sequentialEntries(10))
+	if class, ok := r.ComparatorClass(); !ok || !bytewiseComparator(class) {
+		t.Errorf("got %q, %v, want the Writer's bytewise comparator", class, ok)
+	}
+	r = parseEntries(t, WriterOptions{FileInfo: map[string][]byte{"hfile.COMPARATOR": nil}}, sequentialEntries(10))
+	if class, ok := r.ComparatorClass(); ok {
+		t.Errorf("empty hfile.COMPARATOR: got %q", class)
+	}
+	for _, opts := range []v2Options{{minor: 0, codec: 2}, {minor: 3, codec: 2, pbInfo: true}} {
+		r, err := Parse(writeV2(opts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if class, ok := r.ComparatorClass(); !ok || class != "cmpr" {
+			t.Errorf("%+v: got %q, %v, want the trailer's", opts, class, ok)
+		}
+	}
+
+	// Opening a file ordered by another comparator without one logs a
+	// warning.
+	const kvComparator = "org.apache.hadoop.hbase.KeyValue$KeyComparator"
+	path := filepath.Join(t.TempDir(), "file")
+	data := writeEntries(t, WriterOptions{FileInfo: map[string][]byte{"hfile.COMPARATOR": []byte(kvComparator)}}, sequentialEntries(10))
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		opts ReaderOptions
+		warn bool
+	}{
+		{ReaderOptions{}, true},
+		{ReaderOptions{Comparator: CompareKeyValues}, false},
+	} {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var logged bytes.Buffer
+		test.opts.Logger = log.New(&logged, "", 0)
+		r, err := NewReaderWithOptions(file, test.opts)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if class, ok := r.ComparatorClass(); !ok || class != kvComparator {
+			t.Errorf("got %q, %v", class, ok)
+		}
+		if warned := strings.Contains(logged.String(), kvComparator); warned != test.warn {
+			t.Errorf("comparator %v: got %q", test.opts.Comparator != nil, logged.String())
+		}
+		r.Close()
+	}
+}
+
+func TestValidate(t *testing.T) {
+	entries := sequentialEntries(100)
+	for _, test := range []struct {
+		name   string
+		damage func(data []byte, r *Reader)
+		want   string // in the error; empty for none
+	}{
+		{"clean", func([]byte, *Reader) {}, ""},
+		{"magic", func(data []byte, r *Reader) {
+			copy(data[r.index[2].offset:], "DATABLK?")
+		}, "block 2"},
+		{"index first key", func(data []byte, r *Reader) {
+			r.index[2].firstKeyBytes = append(r.index[2].firstKeyBytes, 0) // still in order
+		}, "index says"},
+		{"index order", func(data []byte, r *Reader) {
+			r.index[1], r.index[2] = r.index[2], r.index[1]
+		}, "block 2 (offset"},
+		{"key order", func(data []byte, r *Reader) {
+			at := bytes.Index(data, []byte("key000098"))
+			copy(data[at:], "key000099")
+			copy(data[at+len("key000098value98")+8:], "key000098")
+		}, "sorts before previous key"},
+		{"truncated entry", func(data []byte, r *Reader) {
+			binary.BigEndian.PutUint32(data[12:16], 1<<20)
+		}, "block 0 (offset 0) has a truncated entry"},
+		{"entry count", func(data []byte, r *Reader) {
+			r.header.entryCount++
+		}, "found 100 entries, trailer says 101"},
+	} {
+		data := writeEntries(t, WriterOptions{BlockSize: 256}, entries)
+		r, err := Parse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.damage(data, r)
+		err = r.Validate()
+		if test.want == "" && err != nil || test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+			t.Errorf("%s: got %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestBlockIndex(t *testing.T) {
+	entries := sequentialEntries(200)
+	check := func(name string, r *Reader) {
+		blocks := r.BlockIndex()
+		if len(blocks) != r.BlockCount() || len(blocks) < 2 {
+			t.Fatalf("%s: got %d blocks", name, len(blocks))
+		}
+		// The data blocks lie end to end from the start of the file.
+		offset := uint64(0)
+		for i, blk := range blocks {
+			if blk.Offset != offset {
+				t.Errorf("%s: block %d: got offset %d, want %d", name, i, blk.Offset, offset)
+			}
+			offset = blk.Offset + uint64(blk.Size)
+			first, _, err := r.BlockKeyRange(i)
+			if err != nil || !bytes.Equal(blk.FirstKey, first) {
+				t.Errorf("%s: block %d: got first key %q, block starts with %q, %v", name, i, blk.FirstKey, first, err)
+			}
+		}
+		// In v1, with no meta blocks, FileInfo follows them.
+		if r.majorVersion == 1 && offset != r.header.fileInfoOffset {
+			t.Errorf("%s: blocks end at %d, FileInfo starts at %d", name, offset, r.header.fileInfoOffset)
+		}
+	}
+	for _, codec := range []string{"none", "snappy", "lz4"} {
+		check(codec, parseEntries(t, WriterOptions{Compression: codec, BlockSize: 256}, entries))
+	}
+	for _, opts := range []v2Options{{minor: 0, codec: 3}, {minor: 1, codec: 2}, {minor: 3, codec: 1, pbInfo: true}} {
+		r, err := Parse(writeV2(opts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(fmt.Sprintf("%+v", opts), r)
+	}
+
+	// The first keys are copies.
+	path := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(path, writeEntries(t, WriterOptions{BlockSize: 256}, entries), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReaderFromPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := r.BlockIndex()
+	r.Close()
+	if got := string(blocks[0].FirstKey); got != entries[0].key {
+		t.Errorf("after Close: got %q", got)
+	}
+}
+
+func TestUnframedSnappy(t *testing.T) {
+	entries := sequentialEntries(100)
+	// Snappy blocks written bare, with no sizes in front, and their size on
+	// disk in the index.
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, WriterOptions{Compression: "snappy", BlockSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range entries {
+		if err := w.Add([]byte(e.key), []byte(e.value)); err != nil {
+			t.Fatal(err)
+		}
+		if i%10 == 9 {
+			raw := append([]byte("DATABLK*"), w.block.Bytes()...)
+			w.block.Reset()
+			compressed := snappy.Encode(nil, raw)
+			blk := &w.index[len(w.index)-1]
+			blk.offset, blk.size = w.offset, uint32(len(compressed))
+			w.write(compressed)
+			w.totalUncompressedDataBytes += uint64(len(raw))
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Parse(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.index) != 10 {
+		t.Fatalf("got %d blocks, want 10", len(r.index))
+	}
+	if _, err := r.GetBlock(0); err == nil {
+		t.Error("read an unframed block without SetAllowUnframedSnappy")
+	}
+	r.SetAllowUnframedSnappy(true)
+	if got := readAll(t, r); !reflect.DeepEqual(got, entries) {
+		t.Errorf("read %d entries, want %d", len(got), len(entries))
+	}
+	if err := r.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	// Framed blocks read as before.
+	r = parseEntries(t, WriterOptions{Compression: "snappy", BlockSize: 256}, entries)
+	r.SetAllowUnframedSnappy(true)
+	if got := readAll(t, r); !reflect.DeepEqual(got, entries) {
+		t.Errorf("framed: read %d entries, want %d", len(got), len(entries))
+	}
+}
+
+func TestParse(t *testing.T) {
+	entries := sequentialEntries(100)
+	data := writeEntries(t, WriterOptions{BlockSize: 256}, entries)
+	r, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Uncompressed blocks are read in place.
+	var decoded []byte
+	r.onBlockDecoded = func(i int, block []byte) { decoded = block }
+	if _, err := r.GetBlock(1); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) == 0 || &decoded[0] != &data[r.index[1].offset] {
+		t.Error("block 1 was copied out of data")
+	}
+	// Close leaves data to the caller.
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := Parse(data); err != nil {
+		t.Error(err)
+	} else if got := readAll(t, r); !reflect.DeepEqual(got, entries) {
+		t.Errorf("read %d entries after Close, want %d", len(got), len(entries))
+	}
+
+	// Every prefix is missing the trailer.
+	for n := 0; n < len(data); n += 7 {
+		if _, err := Parse(data[:n]); err == nil {
+			t.Errorf("parsed the first %d of %d bytes", n, len(data))
+		}
+	}
+}
+
+func TestStrictOrder(t *testing.T) {
+	open := func(entries []testEntry, strict bool) error {
+		data := writeUnsorted(t, WriterOptions{BlockSize: 1}, entries)
+		_, err := NewReaderAtWithOptions(bytes.NewReader(data), int64(len(data)), ReaderOptions{StrictOrder: strict})
+		return err
+	}
+	sorted := []testEntry{{"a", "1"}, {"b", "2"}, {"c", "3"}, {"d", "4"}}
+	// Each entry fills a block, so this puts block 2 out of order.
+	blocks := []testEntry{{"a", "1"}, {"c", "3"}, {"b", "2"}, {"d", "4"}}
+	// Only the first key of each block is in the index, so this is left to
+	// Validate.
+	within := []testEntry{{"a", "1"}, {"c", "3"}, {"b", "2"}}
+	for _, test := range []struct {
+		name    string
+		entries []testEntry
+		strict  bool
+		want    string // in the error; empty for none
+	}{
+		{"sorted", sorted, true, ""},
+		{"blocks", blocks, false, ""},
+		{"blocks", blocks, true, "data block 2 (offset"},
+	} {
+		err := open(test.entries, test.strict)
+		if test.want == "" && err != nil || test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+			t.Errorf("%s, strict %v: got %v, want %q", test.name, test.strict, err, test.want)
+		}
+	}
+
+	data := writeUnsorted(t, WriterOptions{BlockSize: 64}, within)
+	r, err := NewReaderAtWithOptions(bytes.NewReader(data), int64(len(data)), ReaderOptions{StrictOrder: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.index) != 1 {
+		t.Fatalf("got %d blocks, want 1", len(r.index))
+	}
+	if err := r.Validate(); err == nil {
+		t.Error("Validate accepted keys out of order within a block")
+	}
+}
+
+func TestNewReaderFromCompressedPath(t *testing.T) {
+	dir := t.TempDir()
+	entries := sequentialEntries(100)
+	data := writeEntries(t, WriterOptions{BlockSize: 256}, entries)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(data)
+	gz.Close()
+
+	for _, test := range []struct {
+		name   string
+		data   []byte
+		mapped bool
+	}{
+		{"plain", data, true},
+		{"gzipped", compressed.Bytes(), false},
+	} {
+		path := filepath.Join(dir, test.name)
+		if err := ioutil.WriteFile(path, test.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReaderFromCompressedPath(path)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if got := readAll(t, r); !reflect.DeepEqual(got, entries) {
+			t.Errorf("%s: read %d entries, want %d", test.name, len(got), len(entries))
+		}
+		if mapped := r.MappedBytes() > 0; mapped != test.mapped {
+			t.Errorf("%s: got mapped %v", test.name, mapped)
+		}
+		r.Close()
+	}
+
+	// A damaged gzip stream is an error naming the file.
+	path := filepath.Join(dir, "damaged")
+	if err := ioutil.WriteFile(path, compressed.Bytes()[:compressed.Len()/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewReaderFromCompressedPath(path); err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("got %v, want an error naming %s", err, path)
+	}
+	if _, err := NewReaderFromCompressedPath(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("missing file: got %v", err)
+	}
+}
+
+func TestCompressedSize(t *testing.T) {
+	var entries []testEntry
+	for i := 0; i < 200; i++ {
+		entries = append(entries, testEntry{fmt.Sprintf("key%06d", i), strings.Repeat("compressible", 10)})
+	}
+	for _, codec := range []string{"none", "snappy", "lz4"} {
+		r := parseEntries(t, WriterOptions{Compression: codec, BlockSize: 1024}, entries)
+		if got := r.CompressionCodec(); got != codec {
+			t.Errorf("%s: got codec %q", codec, got)
+		}
+		// The data blocks are all that comes before FileInfo here.
+		compressed, uncompressed := r.CompressedSize(), r.UncompressedSize()
+		if uint64(compressed) != r.header.fileInfoOffset {
+			t.Errorf("%s: got %d compressed bytes, data blocks take %d", codec, compressed, r.header.fileInfoOffset)
+		}
+		var raw uint64
+		for i := range r.index {
+			block, err := r.BlockBytes(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw += uint64(len(block))
+		}
+		if uncompressed != raw {
+			t.Errorf("%s: got %d uncompressed bytes, blocks decode to %d", codec, uncompressed, raw)
+		}
+		if codec == "none" && uint64(compressed) != uncompressed || codec != "none" && uint64(compressed) >= uncompressed/2 {
+			t.Errorf("%s: %d bytes compressed to %d", codec, uncompressed, compressed)
+		}
+	}
+	if got := parseEntries(t, WriterOptions{}, nil).CompressedSize(); got != 0 {
+		t.Errorf("empty file: got %d compressed bytes", got)
+	}
+}
+
+// TestConcurrentDecodes checks that with the block cache on, each block is
+// decoded once however many lookups want it at the same time.
+func TestConcurrentDecodes(t *testing.T) {
+	entries := sequentialEntries(500)
+	r := parseEntries(t, WriterOptions{Compression: "snappy", BlockSize: 256}, entries)
+	r.SetBlockCacheBytes(1 << 20)
+	var decoded int32
+	r.onBlockDecoded = func(int, []byte) { atomic.AddInt32(&decoded, 1) }
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			s := NewScanner(r)
+			for _, e := range entries {
+				if value, err, ok := s.GetFirst([]byte(e.key)); err != nil || !ok || string(value) != e.value {
+					t.Errorf("%s: got %q, %v, %v", e.key, value, err, ok)
+					return
+				}
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if int(decoded) != len(r.index) {
+		t.Errorf("decoded %d times, want each of %d blocks once", decoded, len(r.index))
+	}
+}
+
+func TestBlockIndexFor(t *testing.T) {
+	var entries []testEntry
+	for i := 0; i < 100; i++ {
+		entries = append(entries, testEntry{fmt.Sprintf("key%06d", 2*i), "value"})
+		if i == 50 {
+			for j := 0; j < 30; j++ {
+				entries = append(entries, testEntry{fmt.Sprintf("key%06d", 2*i), fmt.Sprintf("run%d", j)})
+			}
+		}
+	}
+	r := parseEntries(t, WriterOptions{BlockSize: 128}, entries)
+	// The first block holding each key.
+	want := map[string]int{}
+	for i := range r.index {
+		it, err := r.NewBlockIterator(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for it.Next() {
+			if _, ok := want[string(it.Key())]; !ok {
+				want[string(it.Key())] = i
+			}
+		}
+	}
+	decoded := 0
+	r.onBlockDecoded = func(int, []byte) { decoded++ }
+
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%06d", i)
+		got, ok := r.BlockIndexFor([]byte(key))
+		if !ok {
+			t.Errorf("%s: got no block", key)
+			continue
+		}
+		// A key that starts a block may have a run starting in the block
+		// before, which is where a lookup starts.
+		if first, ok := want[key]; ok {
+			if got != first && (got != first-1 || string(r.index[first].firstKeyBytes) != key) {
+				t.Errorf("%s: got block %d, want %d", key, got, first)
+			}
+			continue
+		}
+		// A missing key would be in the last block starting before it.
+		last := 0
+		for j, blk := range r.index {
+			if string(blk.firstKeyBytes) < key {
+				last = j
+			}
+		}
+		if got != last {
+			t.Errorf("%s: got block %d, want %d", key, got, last)
+		}
+	}
+	if _, ok := r.BlockIndexFor([]byte("a")); ok {
+		t.Error("got a block for a key before the file")
+	}
+	if decoded != 0 || r.Stats().Lookups != 0 {
+		t.Errorf("decoded %d blocks for %d lookups", decoded, r.Stats().Lookups)
+	}
+}
+
+func TestHeaderInfo(t *testing.T) {
+	entries := sequentialEntries(100)
+	data := writeEntries(t, WriterOptions{Compression: "snappy", BlockSize: 256}, entries)
+	r, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := r.HeaderInfo()
+	if h.MajorVersion != 1 || h.MinorVersion != 0 || h.EntryCount != 100 || h.CompressionCodec != 3 {
+		t.Errorf("got %+v", h)
+	}
+	// v1 lays the file out data blocks, FileInfo, data index, trailer, with
+	// no meta index when there are no meta blocks.
+	if h.FileInfoOffset != uint64(r.CompressedSize()) || h.DataIndexOffset <= h.FileInfoOffset ||
+		h.MetaIndexOffset != 0 || h.TrailerOffset <= h.DataIndexOffset || h.TrailerOffset != uint64(len(data)-60) {
+		t.Errorf("got offsets %+v for a file of %d bytes", h, len(data))
+	}
+	if int(h.DataIndexCount) != r.BlockCount() || h.MetaIndexCount != 0 || h.TotalUncompressedDataBytes != r.UncompressedSize() {
+		t.Errorf("got counts %+v", h)
+	}
+	if h.NumDataIndexLevels != 0 || h.ComparatorClassName != "" {
+		t.Errorf("got v2 fields %+v in a v1 file", h)
+	}
+
+	r, err = Parse(writeV2(v2Options{minor: 3, codec: 3, pbInfo: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = r.HeaderInfo()
+	if h.MajorVersion != 2 || h.MinorVersion != 3 || h.NumDataIndexLevels != 1 || h.ComparatorClassName != "cmpr" ||
+		h.FirstDataBlockOffset != r.index[0].offset || h.LastDataBlockOffset != r.index[len(r.index)-1].offset {
+		t.Errorf("got %+v", h)
+	}
+}
+
+func TestHugeLengths(t *testing.T) {
+	// A snappy block claiming 4GB is rejected before that is allocated.
+	var claim bytes.Buffer
+	putUvarint(&claim, math.MaxUint32)
+	claim.Write([]byte{0, 0})
+	if _, err := snappyDecode(claim.Bytes()); err == nil || !strings.Contains(err.Error(), "claims to decode") {
+		t.Errorf("snappy: got %v", err)
+	}
+	big := bytes.Repeat([]byte("a"), 100000)
+	if got, err := snappyDecode(snappy.Encode(nil, big)); err != nil || !bytes.Equal(got, big) {
+		t.Errorf("snappy: got %d bytes, %v", len(got), err)
+	}
+
+	// Gzip stops at the block's recorded size.
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(big)
+	zw.Close()
+	if _, err := gunzip(gz.Bytes(), uint32(len(big)-1)); err == nil {
+		t.Error("gzip: decoded past the recorded size")
+	}
+	if got, err := gunzip(gz.Bytes(), uint32(len(big))); err != nil || !bytes.Equal(got, big) {
+		t.Errorf("gzip: got %d bytes, %v", len(got), err)
+	}
+
+	// LZ4 allocates no more than its input could decode to.
+	if got, err := lz4Decode([]byte{0x10, 'a'}, math.MaxUint32); err != nil || string(got) != "a" {
+		t.Errorf("lz4: got %q, %v", got, err)
+	}
+
+	// Entry lengths are bounded by the block.
+	data := writeEntries(t, WriterOptions{}, sequentialEntries(10))
+	binary.BigEndian.PutUint32(data[8:12], math.MaxUint32)
+	r, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewScanner(r)
+	if _, err, _ := s.GetFirst([]byte("key000005")); err == nil {
+		t.Error("lookup past a 4GB key length got no error")
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ReverseIterator walks every entry in the file in descending key order: the
+// last block first, and each block from its last entry to its first. Entries
+// in a block only record where the next one starts, so on reaching a block it
+// first walks it forward to find where each entry starts, keeping those
+// offsets, 8 bytes an entry, along with the decoded block until it moves on to
+// the one before.
+type ReverseIterator struct {
+	hfile          *Reader
+	dataBlockIndex int
+	block          *bytes.Reader
+	offsets        []int64
+	key            []byte
+	value          []byte
+	err            error
+}
+
+func (hfile *Reader) NewReverseIterator() *ReverseIterator {
+	return &ReverseIterator{hfile: hfile, dataBlockIndex: len(hfile.index)}
+}
+
+func (it *ReverseIterator) Next() bool {
+	if it.err == nil && it.hfile.closed {
+		it.err = ErrClosed
+	}
+	if it.err != nil {
+		return false
+	}
+	for len(it.offsets) == 0 {
+		if it.dataBlockIndex == 0 {
+			return false
+		}
+		it.dataBlockIndex -= 1
+		if it.err = it.loadBlock(); it.err != nil {
+			return false
+		}
+	}
+
+	off := it.offsets[len(it.offsets)-1]
+	it.offsets = it.offsets[:len(it.offsets)-1]
+	it.block.Seek(off, 0)
+	keyLen, valLen, _ := readEntryLengths(it.block)
+	it.key = make([]byte, keyLen)
+	it.value = make([]byte, valLen)
+	if it.err = readEntry(it.block, it.key, it.value); it.err != nil {
+		it.err = fmt.Errorf("block %d: %s", it.dataBlockIndex, it.err)
+		return false
+	}
+	return true
+}
+
+// loadBlock decodes block dataBlockIndex and finds where its entries start.
+func (it *ReverseIterator) loadBlock() error {
+	block, offsets, err := it.hfile.loadEntryOffsets(it.dataBlockIndex)
+	if err != nil {
+		return err
+	}
+	it.block = block
+	it.offsets = offsets
+	return nil
+}
+
+// loadEntryOffsets decodes block i and finds where its entries start,
+// checking that they fill it exactly, for walking it in both directions.
+func (r *Reader) loadEntryOffsets(i int) (*bytes.Reader, []int64, error) {
+	block, err := r.GetBlock(i)
+	if err != nil {
+		return nil, nil, err
+	}
+	offsets := entryOffsets(block)
+
+	end := int64(8)
+	if len(offsets) > 0 {
+		block.Seek(offsets[len(offsets)-1], 0)
+		keyLen, valLen, _ := readEntryLengths(block)
+		end = block.Size() - int64(block.Len()) + int64(keyLen) + int64(valLen)
+	}
+	if end != block.Size() {
+		return nil, nil, fmt.Errorf("truncated entry in block %d", i)
+	}
+	return block, offsets, nil
+}
+
+func (it *ReverseIterator) Key() []byte {
+	return it.key
+}
+
+func (it *ReverseIterator) Value() []byte {
+	return it.value
+}
+
+// Err returns the error that ended iteration early, or nil if Next simply ran
+// out of entries.
+func (it *ReverseIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,57 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readReverse(r *Reader) ([]testEntry, error) {
+	var entries []testEntry
+	it := r.NewReverseIterator()
+	for it.Next() {
+		entries = append(entries, testEntry{string(it.Key()), string(it.Value())})
+	}
+	return entries, it.Err()
+}
+
+func TestReverseIterator(t *testing.T) {
+	entries := append(sequentialEntries(200), testEntry{"last", "1"}, testEntry{"last", "2"})
+	var want []testEntry
+	for i := len(entries) - 1; i >= 0; i-- {
+		want = append(want, entries[i])
+	}
+	for _, codec := range []string{"none", "snappy", "lz4"} {
+		r := parseEntries(t, WriterOptions{Compression: codec, BlockSize: 256}, entries)
+		if got, err := readReverse(r); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, %v", codec, got, err)
+		}
+	}
+
+	if got, err := readReverse(parseEntries(t, WriterOptions{}, nil)); err != nil || got != nil {
+		t.Errorf("empty file: got %v, %v", got, err)
+	}
+}
+
+func TestReverseIteratorTruncated(t *testing.T) {
+	entries := sequentialEntries(50)
+	data := writeEntries(t, WriterOptions{BlockSize: 256}, entries)
+	// The first entry's value runs past the end of the first block.
+	binary.BigEndian.PutUint32(data[12:16], 1<<20)
+	r, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readReverse(r)
+	if err == nil || !strings.Contains(err.Error(), "block 0") {
+		t.Errorf("got %v, want a truncated entry in block 0", err)
+	}
+	// The blocks after it still come back, before the error.
+	first := string(r.index[1].firstKeyBytes)
+	if len(got) == 0 || got[len(got)-1].key != first {
+		t.Errorf("got %v, want every entry down to %s", got, first)
+	}
+}
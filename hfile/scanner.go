@@ -7,19 +7,35 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
-	"log"
+	"io"
 	"sort"
+	"sync/atomic"
 )
 
+// Scanner looks up keys in a Reader, in any order. Each lookup binary searches
+// the whole block index, and reuses the block the last one decoded when key
+// is in it too. Give each goroutine its own.
 type Scanner struct {
 	reader  *Reader
 	idx     int
 	buf     *bytes.Reader
+	ordered bool
 	lastKey *[]byte
+	scratch []byte
 }
 
 func NewScanner(r *Reader) Scanner {
-	return Scanner{r, 0, nil, nil}
+	return Scanner{reader: r}
+}
+
+// Ordered makes lookups assume they come in ascending key order, or after a
+// Reset, so that each searches only forward from the block the last one ended
+// in, and within a block from the entry it ended on. A lookup for a key
+// smaller than the last returns an error. It suits callers walking sorted
+// keys, who save the search of the blocks and entries already passed.
+func (s *Scanner) Ordered(ordered bool) {
+	s.ordered = ordered
+	s.lastKey = nil
 }
 
 func (s *Scanner) Reset() {
@@ -31,32 +47,38 @@ func (s *Scanner) Reset() {
 func (s *Scanner) findBlock(key []byte) int {
 	remaining := len(s.reader.index) - s.idx - 1
 	if s.reader.debug {
-		log.Printf("[Scanner.findBlock] cur %d, remaining %d\n", s.idx, remaining)
+		s.reader.logf("[Scanner.findBlock] cur %d, remaining %d\n", s.idx, remaining)
 	}
 
 	if remaining <= 0 {
 		if s.reader.debug {
-			log.Println("[Scanner.findBlock] last block")
+			s.reader.logf("[Scanner.findBlock] last block\n")
 		}
 		return s.idx // s.cur is the last block, so it is only choice.
 	}
 
-	if s.reader.index[s.idx+1].IsAfter(key) {
+	if s.reader.blockIsAfter(s.idx+1, key) {
 		if s.reader.debug {
-			log.Println("[Scanner.findBlock] next block is past key")
+			s.reader.logf("[Scanner.findBlock] next block is past key\n")
 		}
 		return s.idx
 	}
 
 	offset := sort.Search(remaining, func(i int) bool {
-		return s.reader.index[s.idx+i+1].IsAfter(key)
+		return s.reader.blockIsAfter(s.idx+i+1, key)
 	})
 
-	return s.idx + offset
+	// A block starting with key may be the continuation of a run of entries
+	// for key that began in the block before it.
+	idx := s.idx + offset
+	for idx > s.idx && s.reader.compareKeys(s.reader.index[idx].firstKeyBytes, key) == 0 {
+		idx -= 1
+	}
+	return idx
 }
 
 func (s *Scanner) CheckIfKeyOutOfOrder(key []byte) error {
-	if s.lastKey != nil && bytes.Compare(*s.lastKey, key) > 0 {
+	if s.lastKey != nil && s.reader.compareKeys(*s.lastKey, key) > 0 {
 		return fmt.Errorf("Keys our of order! %v > %v", *s.lastKey, key)
 	}
 	s.lastKey = &key
@@ -64,25 +86,53 @@ func (s *Scanner) CheckIfKeyOutOfOrder(key []byte) error {
 }
 
 func (s *Scanner) blockFor(key []byte) (*bytes.Reader, error, bool) {
-	err := s.CheckIfKeyOutOfOrder(key)
-	if err != nil {
-		return nil, err, false
+	if s.reader.closed {
+		return nil, ErrClosed, false
+	}
+	atomic.AddUint64(&s.reader.lookups, 1)
+
+	if s.ordered {
+		if err := s.CheckIfKeyOutOfOrder(key); err != nil {
+			return nil, err, false
+		}
+	}
+
+	// HBase writes files with no data blocks at all for empty regions.
+	if len(s.reader.index) == 0 {
+		return nil, nil, false
 	}
 
-	if s.reader.index[s.idx].IsAfter(key) {
+	if !s.reader.mightContain(key) {
 		if s.reader.debug {
-			log.Printf("[Scanner.blockFor] curBlock after key %s (cur: %d, start: %s)\n",
-				hex.EncodeToString(key),
-				s.idx,
-				hex.EncodeToString(s.reader.index[s.idx].firstKeyBytes),
-			)
+			s.reader.logf("[Scanner.blockFor] bloom filter rules out key %s\n", hex.EncodeToString(key))
 		}
 		return nil, nil, false
 	}
 
-	idx := s.findBlock(key)
+	var idx int
+	if s.ordered {
+		if s.reader.blockIsAfter(s.idx, key) {
+			if s.reader.debug {
+				s.reader.logf("[Scanner.blockFor] curBlock after key %s (cur: %d, start: %s)\n",
+					hex.EncodeToString(key),
+					s.idx,
+					hex.EncodeToString(s.reader.index[s.idx].firstKeyBytes),
+				)
+			}
+			return nil, nil, false
+		}
+		idx = s.findBlock(key)
+	} else {
+		var ok bool
+		if idx, ok = s.reader.findBlock(key); !ok {
+			if s.reader.debug {
+				s.reader.logf("[Scanner.blockFor] key %s before first block\n", hex.EncodeToString(key))
+			}
+			return nil, nil, false
+		}
+	}
 	if s.reader.debug {
-		log.Printf("[Scanner.blockFor] findBlock (key: %s) picked %d (starts: %s). Cur: %d (starts: %s)\n",
+		s.reader.logf("[Scanner.blockFor] findBlock (key: %s) picked %d (starts: %s). Cur: %d (starts: %s)\n",
 			hex.EncodeToString(key),
 			idx,
 			hex.EncodeToString(s.reader.index[idx].firstKeyBytes),
@@ -95,7 +145,7 @@ func (s *Scanner) blockFor(key []byte) (*bytes.Reader, error, bool) {
 		data, err := s.reader.GetBlock(idx)
 		if err != nil {
 			if s.reader.debug {
-				log.Printf("[Scanner.blockFor] read err %s (key: %s, idx: %d, start: %s)\n",
+				s.reader.logf("[Scanner.blockFor] read err %s (key: %s, idx: %d, start: %s)\n",
 					err,
 					hex.EncodeToString(key),
 					idx,
@@ -108,81 +158,635 @@ func (s *Scanner) blockFor(key []byte) (*bytes.Reader, error, bool) {
 		s.buf = data
 	} else {
 		if s.reader.debug {
-			log.Println("[Scanner.blockFor] Re-using current block")
+			s.reader.logf("[Scanner.blockFor] Re-using current block\n")
+		}
+		if !s.ordered {
+			s.buf.Seek(8, 0) // key may be behind where the last lookup ended
 		}
 	}
 
 	return s.buf, nil, true
 }
 
+// nextBlockFor moves on to the following block when the current one has been
+// read to the end and the next starts with key, so key's entries may continue
+// there. It reports whether it did.
+func (s *Scanner) nextBlockFor(key []byte) (bool, error) {
+	if s.buf.Len() > 0 || s.idx+1 >= len(s.reader.index) || s.reader.compareKeys(s.reader.index[s.idx+1].firstKeyBytes, key) != 0 {
+		return false, nil
+	}
+	data, err := s.reader.GetBlock(s.idx + 1)
+	if err != nil {
+		return false, err
+	}
+	if s.reader.debug {
+		s.reader.logf("[Scanner.nextBlockFor] continuing into block %d (key: %s)\n", s.idx+1, hex.EncodeToString(key))
+	}
+	s.idx += 1
+	s.buf = data
+	return true, nil
+}
+
+// collectValues is getValuesFromBuffer, carrying on into the following blocks
+// for as long as key's entries run on into them.
+func (s *Scanner) collectValues(buf *bytes.Reader, key []byte, limit int) ([][]byte, error) {
+	_, acc, _, err := s.getValuesFromBuffer(buf, key, limit)
+	if err != nil {
+		return nil, err
+	}
+	for limit == 0 || len(acc) < limit {
+		more, err := s.nextBlockFor(key)
+		if !more {
+			return acc, err
+		}
+		rest := 0
+		if limit > 0 {
+			rest = limit - len(acc)
+		}
+		_, found, _, err := s.getValuesFromBuffer(s.buf, key, rest)
+		if err != nil {
+			return nil, err
+		}
+		acc = append(acc, found...)
+	}
+	return acc, nil
+}
+
 func (s *Scanner) GetFirst(key []byte) ([]byte, error, bool) {
 	data, err, ok := s.blockFor(key)
 
 	if !ok {
 		if s.reader.debug {
-			log.Printf("[Scanner.GetFirst] No Block for key: %s (err: %s, found: %s)\n", hex.EncodeToString(key), err, ok)
+			s.reader.logf("[Scanner.GetFirst] No Block for key: %s (err: %s, found: %v)\n", hex.EncodeToString(key), err, ok)
 		}
 		return nil, err, ok
 	}
 
-	value, _, found := s.getValuesFromBuffer(data, key, true)
-	return value, nil, found
+	values, err := s.collectValues(data, key, 1)
+	if len(values) == 0 {
+		return nil, err, false
+	}
+	return values[0], nil, true
 }
 
-func (s *Scanner) GetAll(key []byte) ([][]byte, error) {
+// GetFirstWithKey is GetFirst, also returning a copy of the key stored in the
+// file. That is key itself when keys compare bytewise, but with a comparator
+// from SetComparator the stored key can differ from an equal one looked up.
+// For the nearest key rather than an equal one, see Reader.Floor and Ceiling.
+func (s *Scanner) GetFirstWithKey(key []byte) ([]byte, []byte, error, bool) {
+	buf, err, ok := s.blockFor(key)
+
+	if !ok {
+		if s.reader.debug {
+			s.reader.logf("[Scanner.GetFirstWithKey] No Block for key: %s (err: %s, found: %v)\n", hex.EncodeToString(key), err, ok)
+		}
+		return nil, nil, err, ok
+	}
+
+	for {
+		s.skipTo(buf, key)
+		for buf.Len() > 0 {
+			keyLen, valLen, ok := readEntryLengths(buf)
+			if !ok {
+				return nil, nil, fmt.Errorf("truncated entry in block %d", s.idx), false
+			}
+			matched := make([]byte, keyLen)
+			if _, err := io.ReadFull(buf, matched); err != nil {
+				return nil, nil, fmt.Errorf("block %d: %s", s.idx, err), false
+			}
+			cmp := s.reader.compareKeys(matched, key)
+			if cmp > 0 {
+				buf.Seek(-(int64(keyLen) + 8), 1)
+				return nil, nil, nil, false
+			}
+			if cmp == 0 {
+				value := make([]byte, valLen)
+				if _, err := io.ReadFull(buf, value); err != nil {
+					return nil, nil, fmt.Errorf("block %d: %s", s.idx, err), false
+				}
+				return matched, value, nil, true
+			}
+			buf.Seek(int64(valLen), 1)
+		}
+		more, err := s.nextBlockFor(key)
+		if !more {
+			return nil, nil, err, false
+		}
+		buf = s.buf
+	}
+}
+
+// GetFirstInto is GetFirst, copying the value into dst, grown only if it is
+// too small, and returning the slice of it holding the value. Lookups that
+// pass the same buffer each time allocate nothing once it is big enough, but
+// the value returned is only valid until dst is next reused.
+func (s *Scanner) GetFirstInto(key []byte, dst []byte) ([]byte, error, bool) {
+	buf, err, ok := s.blockFor(key)
+
+	if !ok {
+		if s.reader.debug {
+			s.reader.logf("[Scanner.GetFirstInto] No Block for key: %s (err: %s, found: %v)\n", hex.EncodeToString(key), err, ok)
+		}
+		return nil, err, ok
+	}
+
+	for {
+		s.skipTo(buf, key)
+		for buf.Len() > 0 {
+			keyLen, valLen, ok := readEntryLengths(buf)
+			if !ok {
+				return nil, fmt.Errorf("truncated entry in block %d", s.idx), false
+			}
+			s.scratch = resize(s.scratch, keyLen)
+			if _, err := io.ReadFull(buf, s.scratch); err != nil {
+				return nil, fmt.Errorf("block %d: %s", s.idx, err), false
+			}
+			cmp := s.reader.compareKeys(s.scratch, key)
+			if cmp > 0 {
+				buf.Seek(-(int64(keyLen) + 8), 1)
+				return nil, nil, false
+			}
+			if cmp == 0 {
+				dst = resize(dst, valLen)
+				if _, err := io.ReadFull(buf, dst); err != nil {
+					return nil, fmt.Errorf("block %d: %s", s.idx, err), false
+				}
+				return dst, nil, true
+			}
+			buf.Seek(int64(valLen), 1)
+		}
+		more, err := s.nextBlockFor(key)
+		if !more {
+			return nil, err, false
+		}
+		buf = s.buf
+	}
+}
+
+// GetFirstCellTags returns the tags of the first cell for key, and whether
+// the file has key at all. Only version 3 files carry tags; for others a key
+// found has none. The tags are not kept in decoded blocks, so each lookup
+// that finds a file with them reads and decompresses its blocks afresh,
+// without the block cache.
+func (s *Scanner) GetFirstCellTags(key []byte) ([]Tag, bool, error) {
+	if !s.reader.includesTags {
+		_, err, ok := s.GetFirst(key)
+		return nil, ok, err
+	}
+
+	_, err, ok := s.blockFor(key)
+	if !ok {
+		if s.reader.debug {
+			s.reader.logf("[Scanner.GetFirstCellTags] No Block for key: %s (err: %s, found: %v)\n", hex.EncodeToString(key), err, ok)
+		}
+		return nil, false, err
+	}
+
+	// Like GetFirst, carry on into the blocks after for as long as they
+	// start with key.
+	for i := s.idx; i < len(s.reader.index); i++ {
+		if i > s.idx && s.reader.compareKeys(s.reader.index[i].firstKeyBytes, key) != 0 {
+			break
+		}
+		tags, found, past, err := s.reader.cellTags(i, key)
+		if err != nil || found || past {
+			return tags, found, err
+		}
+	}
+	return nil, false, nil
+}
+
+// GetAll returns every value stored under key, in file order. Like
+// GetFirst, ok reports whether the file has key at all; the values are nil
+// when it does not, and otherwise hold at least one value, which may itself
+// be empty.
+func (s *Scanner) GetAll(key []byte) ([][]byte, error, bool) {
+	return s.GetAllLimit(key, 0)
+}
+
+// GetAllLimit is GetAll, but stops after the first n values for key, so that
+// a key with a great many of them costs no more than the n it returns. HBase
+// writes a key's newest versions first, so this returns the n newest. An n
+// of 0 or less means no limit.
+func (s *Scanner) GetAllLimit(key []byte, n int) ([][]byte, error, bool) {
 	data, err, ok := s.blockFor(key)
 
 	if !ok {
 		if s.reader.debug {
-			log.Printf("[Scanner.GetAll] No Block for key: %s (err: %s, found: %s)\n", hex.EncodeToString(key), err, ok)
+			s.reader.logf("[Scanner.GetAllLimit] No Block for key: %s (err: %s, found: %v)\n", hex.EncodeToString(key), err, ok)
 		}
-		return nil, err
+		return nil, err, ok
 	}
 
-	_, found, _ := s.getValuesFromBuffer(data, key, false)
-	return found, err
+	if n < 0 {
+		n = 0
+	}
+	values, err := s.collectValues(data, key, n)
+	if err != nil || len(values) == 0 {
+		return nil, err, false
+	}
+	return values, nil, true
 }
 
-func (s *Scanner) getValuesFromBuffer(buf *bytes.Reader, key []byte, first bool) ([]byte, [][]byte, bool) {
+// GetVersions returns every entry whose key compares equal to key, with the
+// key each is stored under, in file order. With a comparator from
+// SetComparator that ignores the timestamp at the end of an HBase KeyValue
+// key, that is every version of a cell, newest first, each stored key
+// carrying its version's timestamp. Like GetAll, the entries may run on
+// across blocks.
+func (s *Scanner) GetVersions(key []byte) ([][]byte, [][]byte, error) {
+	buf, err, ok := s.blockFor(key)
+
+	if !ok {
+		if s.reader.debug {
+			s.reader.logf("[Scanner.GetVersions] No Block for key: %s (err: %s, found: %v)\n", hex.EncodeToString(key), err, ok)
+		}
+		return nil, nil, err
+	}
+
+	var keys, values [][]byte
+	for {
+		s.skipTo(buf, key)
+		for buf.Len() > 0 {
+			keyLen, valLen, ok := readEntryLengths(buf)
+			if !ok {
+				return nil, nil, fmt.Errorf("truncated entry in block %d", s.idx)
+			}
+			stored := make([]byte, keyLen)
+			if _, err := io.ReadFull(buf, stored); err != nil {
+				return nil, nil, fmt.Errorf("block %d: %s", s.idx, err)
+			}
+			cmp := s.reader.compareKeys(stored, key)
+			if cmp > 0 {
+				buf.Seek(-(int64(keyLen) + 8), 1)
+				return keys, values, nil
+			}
+			if cmp < 0 {
+				buf.Seek(int64(valLen), 1)
+				continue
+			}
+			value := make([]byte, valLen)
+			if _, err := io.ReadFull(buf, value); err != nil {
+				return nil, nil, fmt.Errorf("block %d: %s", s.idx, err)
+			}
+			keys = append(keys, stored)
+			values = append(values, value)
+		}
+		more, err := s.nextBlockFor(key)
+		if !more {
+			return keys, values, err
+		}
+		buf = s.buf
+	}
+}
+
+// GetN is GetAllLimit, except that an n of 0 or less returns no values
+// rather than every one of them.
+//
+// Deprecated: use GetAllLimit, whose n of 0 means no limit as it does for
+// GetRangeLimit and PrefixIterator.Limit.
+func (s *Scanner) GetN(key []byte, n int) ([][]byte, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	values, err, _ := s.GetAllLimit(key, n)
+	return values, err
+}
+
+// Count returns how many values key has, across blocks like GetAll, but
+// skips over the values rather than copying them.
+func (s *Scanner) Count(key []byte) (int, error) {
+	data, err, ok := s.blockFor(key)
+
+	if !ok {
+		if s.reader.debug {
+			s.reader.logf("[Scanner.Count] No Block for key: %s (err: %s, found: %v)\n", hex.EncodeToString(key), err, ok)
+		}
+		return 0, err
+	}
+
+	return s.countValues(data, key, 0)
+}
+
+// Contains reports whether key is in the file. It allocates nothing for the
+// value, seeking past it instead, and when the bloom filter rules key out it
+// answers without decoding a block at all.
+func (s *Scanner) Contains(key []byte) (bool, error) {
+	data, err, ok := s.blockFor(key)
+
+	if !ok {
+		if s.reader.debug {
+			s.reader.logf("[Scanner.Contains] No Block for key: %s (err: %s, found: %v)\n", hex.EncodeToString(key), err, ok)
+		}
+		return false, err
+	}
+
+	n, err := s.countValues(data, key, 1)
+	return n > 0, err
+}
+
+// countValues is collectValues, counting key's entries instead of copying
+// their values. It stops once it has counted limit of them, or at the end of
+// the run if limit is 0.
+func (s *Scanner) countValues(buf *bytes.Reader, key []byte, limit int) (int, error) {
+	count := 0
+	for {
+		s.skipTo(buf, key)
+		for buf.Len() > 0 {
+			keyLen, valLen, ok := readEntryLengths(buf)
+			if !ok {
+				return 0, fmt.Errorf("truncated entry in block %d", s.idx)
+			}
+			s.scratch = resize(s.scratch, keyLen)
+			if _, err := io.ReadFull(buf, s.scratch); err != nil {
+				return 0, fmt.Errorf("block %d: %s", s.idx, err)
+			}
+			cmp := s.reader.compareKeys(s.scratch, key)
+			if cmp > 0 {
+				buf.Seek(-(int64(keyLen) + 8), 1)
+				return count, nil
+			}
+			buf.Seek(int64(valLen), 1)
+			if cmp == 0 {
+				count += 1
+				if count == limit {
+					return count, nil
+				}
+			}
+		}
+		more, err := s.nextBlockFor(key)
+		if !more {
+			return count, err
+		}
+		buf = s.buf
+	}
+}
+
+// skipTo moves buf, which holds block s.idx, forward to the first entry with
+// a key >= key, binary searching the block's entry offsets rather than
+// decoding every entry on the way. It never moves buf back.
+func (s *Scanner) skipTo(buf *bytes.Reader, key []byte) {
+	if s.reader.fixedWidth(buf) {
+		s.skipToFixed(buf, key)
+		return
+	}
+	offsets := s.reader.blockEntryOffsets(s.idx, buf)
+
+	pos := buf.Size() - int64(buf.Len())
+	lo := sort.Search(len(offsets), func(i int) bool {
+		return offsets[i] >= pos
+	})
+	i := lo + sort.Search(len(offsets)-lo, func(i int) bool {
+		return s.reader.compareKeys(s.keyAt(buf, offsets[lo+i]), key) >= 0
+	})
+	if i < len(offsets) {
+		buf.Seek(offsets[i], 0)
+	} else if lo < len(offsets) {
+		// Every key is smaller. Leave the last entry for the caller to step
+		// over, so it notices if anything after it is truncated.
+		buf.Seek(offsets[len(offsets)-1], 0)
+	}
+}
+
+// skipToFixed is skipTo for blocks whose entries all take up the reader's
+// entryWidth, where entry i starts at 8+i*entryWidth and its key is the
+// keyWidth bytes 8 past that, so the search needs neither the entry offsets
+// nor any lengths read.
+func (s *Scanner) skipToFixed(buf *bytes.Reader, key []byte) {
+	width := s.reader.entryWidth
+	n := (buf.Size() - 8) / width
+	s.scratch = resize(s.scratch, s.reader.keyWidth)
+
+	pos := buf.Size() - int64(buf.Len())
+	lo := (pos - 8 + width - 1) / width // the first entry at or after pos
+	i := lo + int64(sort.Search(int(n-lo), func(i int) bool {
+		buf.ReadAt(s.scratch, 8+(lo+int64(i))*width+8)
+		return s.reader.compareKeys(s.scratch, key) >= 0
+	}))
+	if i < n {
+		buf.Seek(8+i*width, 0)
+	} else if lo < n {
+		// As in skipTo, leave the last entry for the caller to step over.
+		buf.Seek(8+(n-1)*width, 0)
+	}
+}
+
+// keyAt returns the key of the entry starting at off in buf, without moving
+// buf. It is only valid until the next call.
+func (s *Scanner) keyAt(buf *bytes.Reader, off int64) []byte {
+	var keyLen [4]byte
+	buf.ReadAt(keyLen[:], off)
+	s.scratch = resize(s.scratch, binary.BigEndian.Uint32(keyLen[:]))
+	buf.ReadAt(s.scratch, off+8)
+	return s.scratch
+}
+
+// fixedWidth reports whether the entries in buf, a block from GetBlock, can
+// be found at the fixed stride FileInfo gives: the block must hold a whole
+// number of them, and its first must have the widths it says.
+func (r *Reader) fixedWidth(buf *bytes.Reader) bool {
+	if r.entryWidth == 0 || (buf.Size()-8)%r.entryWidth != 0 {
+		return false
+	}
+	var lens [8]byte
+	if n, _ := buf.ReadAt(lens[:], 8); n < len(lens) {
+		return buf.Size() == 8
+	}
+	keyLen, valLen := binary.BigEndian.Uint32(lens[0:4]), binary.BigEndian.Uint32(lens[4:8])
+	return keyLen == r.keyWidth && 8+int64(keyLen)+int64(valLen) == r.entryWidth
+}
+
+// entryOffsets returns where each entry in a block returned by GetBlock
+// starts, reading only their lengths. It stops at the first entry that runs
+// past the end of the block, leaving that one for the linear scan to report.
+func entryOffsets(buf *bytes.Reader) []int64 {
+	var offsets []int64
+	var lens [8]byte
+	for off := int64(8); off < buf.Size(); {
+		if n, _ := buf.ReadAt(lens[:], off); n < len(lens) {
+			break
+		}
+		next := off + 8 + int64(binary.BigEndian.Uint32(lens[0:4])) + int64(binary.BigEndian.Uint32(lens[4:8]))
+		if next > buf.Size() {
+			break
+		}
+		offsets = append(offsets, off)
+		off = next
+	}
+	return offsets
+}
+
+// GetBatch looks up the first value of each of keys, returning the values in
+// the same order as keys along with whether each was found. The keys are
+// looked up in sorted order through one Scanner, so each block is decoded at
+// most once no matter how many of the keys fall in it. A key that cannot be
+// read counts as not found.
+func (r *Reader) GetBatch(keys [][]byte) ([][]byte, []bool) {
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Sort(keyOrder{keys, order, r.compareKeys})
+
+	values := make([][]byte, len(keys))
+	found := make([]bool, len(keys))
+	s := NewScanner(r)
+	s.Ordered(true)
+	for n, i := range order {
+		// The scanner has moved past a key once it has been looked up.
+		if n > 0 && r.compareKeys(keys[i], keys[order[n-1]]) == 0 {
+			values[i], found[i] = values[order[n-1]], found[order[n-1]]
+			continue
+		}
+		values[i], _, found[i] = s.GetFirst(keys[i])
+	}
+	return values, found
+}
+
+// GetAllBatch is GetBatch for every value of each of keys, as GetAll returns
+// them, including those that run on into following blocks. Keys found are
+// in the map, keyed by string(key); those that are not are left out. Unlike
+// GetBatch, it stops at the first key that cannot be read and returns the
+// error, with no map.
+func (r *Reader) GetAllBatch(keys [][]byte) (map[string][][]byte, error) {
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Sort(keyOrder{keys, order, r.compareKeys})
+
+	found := make(map[string][][]byte)
+	s := NewScanner(r)
+	s.Ordered(true)
+	var last [][]byte
+	for n, i := range order {
+		// The scanner has moved past a key once it has been looked up.
+		if n > 0 && r.compareKeys(keys[i], keys[order[n-1]]) == 0 {
+			if last != nil {
+				found[string(keys[i])] = last
+			}
+			continue
+		}
+		var err error
+		if last, err, _ = s.GetAll(keys[i]); err != nil {
+			return nil, err
+		}
+		if last != nil {
+			found[string(keys[i])] = last
+		}
+	}
+	return found, nil
+}
+
+// keyOrder sorts order by the keys it indexes.
+type keyOrder struct {
+	keys    [][]byte
+	order   []int
+	compare func(a, b []byte) int
+}
+
+func (k keyOrder) Len() int      { return len(k.order) }
+func (k keyOrder) Swap(i, j int) { k.order[i], k.order[j] = k.order[j], k.order[i] }
+func (k keyOrder) Less(i, j int) bool {
+	return k.compare(k.keys[k.order[i]], k.keys[k.order[j]]) < 0
+}
+
+// getValuesFromBuffer collects the values for key from buf, returning as
+// soon as it has limit of them. A limit of 0 collects every one. An entry that
+// runs past the end of the block is an error rather than the end of the
+// search.
+func (s *Scanner) getValuesFromBuffer(buf *bytes.Reader, key []byte, limit int) ([]byte, [][]byte, bool, error) {
 	var acc [][]byte
 
+	s.skipTo(buf, key)
+
 	if s.reader.debug {
-		log.Printf("[Scanner.getValuesFromBuffer] buf before %d\n", buf.Len())
+		s.reader.logf("[Scanner.getValuesFromBuffer] buf before %d\n", buf.Len())
 	}
 
 	for buf.Len() > 0 {
-		var keyLen, valLen uint32
-		binary.Read(buf, binary.BigEndian, &keyLen)
-		binary.Read(buf, binary.BigEndian, &valLen)
+		start := buf.Size() - int64(buf.Len())
+		keyLen, valLen, ok := readEntryLengths(buf)
+		if !ok {
+			err := fmt.Errorf("truncated entry in block %d", s.idx)
+			if s.reader.skipBadEntry(buf, start, err) {
+				break
+			}
+			return nil, nil, false, err
+		}
 		keyBytes := make([]byte, keyLen)
 		valBytes := make([]byte, valLen)
-		buf.Read(keyBytes)
-		buf.Read(valBytes)
-		cmp := bytes.Compare(keyBytes, key)
+		if err := readEntry(buf, keyBytes, valBytes); err != nil {
+			err = fmt.Errorf("block %d: %s", s.idx, err)
+			if s.reader.skipBadEntry(buf, start, err) {
+				break
+			}
+			return nil, nil, false, err
+		}
+		cmp := s.reader.compareKeys(keyBytes, key)
 		if cmp == 0 {
-			if first {
+			acc = append(acc, valBytes)
+			if len(acc) == limit {
 				if s.reader.debug {
-					log.Printf("[Scanner.getValuesFromBuffer] buf after %d\n", buf.Len())
+					s.reader.logf("[Scanner.getValuesFromBuffer] buf after %d\n", buf.Len())
 				}
-				return valBytes, nil, true
-			} else {
-				acc = append(acc, valBytes)
+				return valBytes, acc, true, nil
 			}
 		}
 		if cmp > 0 {
 			if s.reader.debug {
-				log.Printf("[Scanner.getValuesFromBuffer] past key %s vs %s. buf remaining %d\n",
+				s.reader.logf("[Scanner.getValuesFromBuffer] past key %s vs %s. buf remaining %d\n",
 					hex.EncodeToString(key),
 					hex.EncodeToString(keyBytes),
 					buf.Len(),
 				)
 			}
 			buf.Seek(-(int64(keyLen + valLen + 8)), 1)
-			return nil, acc, len(acc) > 0
+			return nil, acc, len(acc) > 0, nil
 		}
 	}
 	if s.reader.debug {
-		log.Printf("[Scanner.getValuesFromBuffer] walked off block\n")
+		s.reader.logf("[Scanner.getValuesFromBuffer] walked off block\n")
+	}
+	return nil, acc, len(acc) > 0, nil
+}
+
+// OnDiskValueSize returns how many bytes the first entry for key takes up in
+// its block: the 8 bytes of key and value lengths plus the key and the value.
+// That differs from len of the value GetFirst returns, which is just the
+// logical value. The value itself is skipped over rather than copied.
+func (s *Scanner) OnDiskValueSize(key []byte) (int, bool) {
+	buf, _, ok := s.blockFor(key)
+	if !ok {
+		return 0, false
+	}
+
+	var keyBytes []byte
+	for {
+		s.skipTo(buf, key)
+		for buf.Len() > 0 {
+			keyLen, valLen, ok := readEntryLengths(buf)
+			if !ok {
+				return 0, false
+			}
+			keyBytes = resize(keyBytes, keyLen)
+			if _, err := io.ReadFull(buf, keyBytes); err != nil {
+				return 0, false
+			}
+			cmp := s.reader.compareKeys(keyBytes, key)
+			if cmp == 0 {
+				buf.Seek(int64(valLen), 1)
+				return 8 + int(keyLen) + int(valLen), true
+			}
+			if cmp > 0 {
+				buf.Seek(-(int64(keyLen) + 8), 1)
+				return 0, false
+			}
+			buf.Seek(int64(valLen), 1)
+		}
+		if more, _ := s.nextBlockFor(key); !more {
+			return 0, false
+		}
+		buf = s.buf
 	}
-	return nil, acc, len(acc) > 0
 }
@@ -0,0 +1,771 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestScannerAcrossBlocks looks up every key of a many-block file, and the
+// gaps between them, both in key order with Ordered and shuffled without.
+func TestScannerAcrossBlocks(t *testing.T) {
+	entries := make([]testEntry, 2000)
+	for i := range entries {
+		entries[i] = testEntry{fmt.Sprintf("key%06d", 2*i), fmt.Sprintf("value%d", i)}
+	}
+	r := parseEntries(t, WriterOptions{BlockSize: 512}, entries)
+	if len(r.index) < 10 {
+		t.Fatalf("got %d blocks, want many", len(r.index))
+	}
+
+	check := func(s *Scanner, i int) {
+		key := []byte(fmt.Sprintf("key%06d", i))
+		value, err, ok := s.GetFirst(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 0 || i%2 == 1 || i/2 >= len(entries) {
+			if ok {
+				t.Errorf("%s: found %q", key, value)
+			}
+			return
+		}
+		if want := entries[i/2].value; !ok || string(value) != want {
+			t.Errorf("%s: got %q, %v, want %q", key, value, ok, want)
+		}
+	}
+
+	s := NewScanner(r)
+	s.Ordered(true)
+	for i := -1; i <= 2*len(entries); i++ {
+		check(&s, i)
+	}
+
+	s = NewScanner(r)
+	for _, i := range rand.New(rand.NewSource(1)).Perm(2*len(entries) + 1) {
+		check(&s, i)
+	}
+}
+
+// TestScannerReusesBlock checks that consecutive lookups in one block decode
+// it only once.
+func TestScannerReusesBlock(t *testing.T) {
+	entries := sequentialEntries(1000)
+	r := parseEntries(t, WriterOptions{BlockSize: 1 << 10}, entries)
+	decoded := 0
+	r.onBlockDecoded = func(int, []byte) { decoded++ }
+
+	for _, ordered := range []bool{true, false} {
+		decoded = 0
+		s := NewScanner(r)
+		s.Ordered(ordered)
+		for _, e := range entries {
+			if _, err, ok := s.GetFirst([]byte(e.key)); err != nil || !ok {
+				t.Fatalf("%s: got %v, %v", e.key, err, ok)
+			}
+		}
+		if decoded != len(r.index) {
+			t.Errorf("ordered=%v: decoded %d blocks, want %d", ordered, decoded, len(r.index))
+		}
+	}
+}
+
+// TestGetAllAcrossBlocks looks up a key whose values run on over several
+// blocks, and the keys either side of it.
+func TestGetAllAcrossBlocks(t *testing.T) {
+	var entries []testEntry
+	var want [][]byte
+	entries = append(entries, testEntry{"a", "before"})
+	for i := 0; i < 100; i++ {
+		value := fmt.Sprintf("value%03d", i)
+		entries = append(entries, testEntry{"b", value})
+		want = append(want, []byte(value))
+	}
+	entries = append(entries, testEntry{"c", "after"})
+	r := parseEntries(t, WriterOptions{BlockSize: 128}, entries)
+	spanned := 0
+	for _, blk := range r.index {
+		if string(blk.firstKeyBytes) == "b" {
+			spanned++
+		}
+	}
+	if spanned < 3 {
+		t.Fatalf("b starts %d blocks, want several", spanned)
+	}
+
+	for _, ordered := range []bool{true, false} {
+		s := NewScanner(r)
+		s.Ordered(ordered)
+		if value, err, ok := s.GetFirst([]byte("a")); err != nil || !ok || string(value) != "before" {
+			t.Errorf("ordered=%v: a: got %q, %v, %v", ordered, value, err, ok)
+		}
+		values, err, ok := s.GetAll([]byte("b"))
+		if err != nil || !ok || !reflect.DeepEqual(values, want) {
+			t.Errorf("ordered=%v: b: got %d values, %v, %v, want %d", ordered, len(values), err, ok, len(want))
+		}
+		if value, err, ok := s.GetFirst([]byte("c")); err != nil || !ok || string(value) != "after" {
+			t.Errorf("ordered=%v: c: got %q, %v, %v", ordered, value, err, ok)
+		}
+	}
+
+	s := NewScanner(r)
+	if n, err := s.Count([]byte("b")); err != nil || n != len(want) {
+		t.Errorf("Count: got %d, %v, want %d", n, err, len(want))
+	}
+	s.Reset()
+	if _, values, err := s.GetVersions([]byte("b")); err != nil || !reflect.DeepEqual(values, want) {
+		t.Errorf("GetVersions: got %d values, %v, want %d", len(values), err, len(want))
+	}
+}
+
+// TestFixedWidthEntries checks that lookups in a file whose keys and values
+// all have the same widths find entries by their position in each block, and
+// that a file which only claims to have them still reads correctly.
+func TestFixedWidthEntries(t *testing.T) {
+	entries := make([]testEntry, 2000)
+	for i := range entries {
+		entries[i] = testEntry{fmt.Sprintf("%016d", 2*i), fmt.Sprintf("%08d", i)}
+	}
+	for _, test := range []struct {
+		name  string
+		info  map[string][]byte
+		fixed bool
+	}{
+		{"fixed", nil, true},
+		// The same stride as the real widths, so only the lengths in the
+		// blocks tell them apart.
+		{"wrong widths", map[string][]byte{keyWidthInfo: uint32Bytes(12), valueWidthInfo: uint32Bytes(12)}, false},
+	} {
+		r := parseEntries(t, WriterOptions{Compression: "snappy", BlockSize: 1024, FileInfo: test.info}, entries)
+		if r.entryWidth != 32 {
+			t.Fatalf("%s: got an entry width of %d, want 32", test.name, r.entryWidth)
+		}
+		for _, ordered := range []bool{false, true} {
+			s := NewScanner(r)
+			s.Ordered(ordered)
+			for i := 0; i < 2*len(entries); i++ {
+				value, err, ok := s.GetFirst([]byte(fmt.Sprintf("%016d", i)))
+				if err != nil || ok != (i%2 == 0) || ok && string(value) != entries[i/2].value {
+					t.Fatalf("%s, ordered %v: key %d: got %q, %v, %v", test.name, ordered, i, value, err, ok)
+				}
+			}
+		}
+		for i := range r.index {
+			if built := r.index[i].offsets != nil; built == test.fixed {
+				t.Errorf("%s: block %d: built offsets %v", test.name, i, built)
+			}
+		}
+	}
+
+	// Values of different widths leave the entries' stride unknown.
+	entries[7].value = "longer value"
+	r := parseEntries(t, WriterOptions{}, entries)
+	if _, ok := r.FileInfo()[valueWidthInfo]; ok || r.entryWidth != 0 {
+		t.Errorf("got an entry width of %d", r.entryWidth)
+	}
+	if !bytes.Equal(r.FileInfo()[keyWidthInfo], uint32Bytes(16)) {
+		t.Errorf("got a key width of %v", r.FileInfo()[keyWidthInfo])
+	}
+}
+
+// BenchmarkGetFirstFixedKeys looks up random keys of a file whose keys and
+// values all have the same widths, as time series files often do, finding
+// entries by their position in each block or, as for any other file, by
+// searching the blocks' entry offsets.
+func BenchmarkGetFirstFixedKeys(b *testing.B) {
+	entries := make([]testEntry, 100000)
+	for i := range entries {
+		entries[i] = testEntry{fmt.Sprintf("%016d", i), "value"}
+	}
+	keys := make([][]byte, 1024)
+	for i := range keys {
+		keys[i] = []byte(entries[rand.Intn(len(entries))].key)
+	}
+	for _, blockSize := range []int{4 << 10, 64 << 10, 1 << 20} {
+		for _, fixed := range []bool{true, false} {
+			b.Run(fmt.Sprintf("block=%d/fixed=%v", blockSize, fixed), func(b *testing.B) {
+				r := parseEntries(b, WriterOptions{BlockSize: blockSize}, entries)
+				if !fixed {
+					r.entryWidth = 0
+				}
+				s := NewScanner(r)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err, ok := s.GetFirst(keys[i%len(keys)]); err != nil || !ok {
+						b.Fatalf("got %v, %v", err, ok)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkGetFirstClustered looks up runs of neighbouring keys, which mostly
+// land in the block the lookup before decoded.
+func BenchmarkGetFirstClustered(b *testing.B) {
+	entries := sequentialEntries(100000)
+	r := parseEntries(b, WriterOptions{}, entries)
+	keys := make([][]byte, 1024)
+	for i := 0; i < len(keys); i += 16 {
+		start := rand.Intn(len(entries) - 16)
+		for j := 0; j < 16; j++ {
+			keys[i+j] = []byte(entries[start+j].key)
+		}
+	}
+	s := NewScanner(r)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err, ok := s.GetFirst(keys[i%len(keys)]); err != nil || !ok {
+			b.Fatalf("got %v, %v", err, ok)
+		}
+	}
+}
+
+// linearSkipTo is skipTo as it was before entry offsets: it steps over every
+// entry ahead of key.
+func linearSkipTo(buf *bytes.Reader, key []byte) {
+	var lens [8]byte
+	for buf.Len() > 0 {
+		pos := buf.Size() - int64(buf.Len())
+		if n, _ := buf.Read(lens[:]); n < len(lens) {
+			buf.Seek(pos, 0)
+			return
+		}
+		keyLen, valLen := binary.BigEndian.Uint32(lens[0:4]), binary.BigEndian.Uint32(lens[4:8])
+		stored := make([]byte, keyLen)
+		buf.Read(stored)
+		if bytes.Compare(stored, key) >= 0 {
+			buf.Seek(pos, 0)
+			return
+		}
+		buf.Seek(int64(valLen), 1)
+	}
+}
+
+// TestSkipTo checks that skipTo finds the entry a linear scan does, for
+// every key in a large block and those between them.
+func TestSkipTo(t *testing.T) {
+	entries := make([]testEntry, 5000)
+	for i := range entries {
+		entries[i] = testEntry{fmt.Sprintf("key%06d", 2*i+1), fmt.Sprintf("value%d", i)}
+	}
+	r := parseEntries(t, WriterOptions{BlockSize: 1 << 20}, entries)
+	if len(r.index) != 1 {
+		t.Fatalf("got %d blocks, want 1", len(r.index))
+	}
+	s := NewScanner(r)
+	buf, err := r.GetBlock(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linear, err := r.GetBlock(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2*len(entries); i++ {
+		key := []byte(fmt.Sprintf("key%06d", i))
+		buf.Seek(8, 0)
+		s.skipTo(buf, key)
+		linear.Seek(8, 0)
+		linearSkipTo(linear, key)
+		if got, want := buf.Len(), linear.Len(); got != want {
+			t.Fatalf("%s: skipTo left %d bytes, a linear scan %d", key, got, want)
+		}
+	}
+
+	// The offsets are kept with the block, not rebuilt for another Scanner
+	// or decode of it.
+	offsets := r.index[0].offsets
+	if len(offsets) != len(entries) {
+		t.Fatalf("got %d offsets, want %d", len(offsets), len(entries))
+	}
+	other := NewScanner(r)
+	if _, err, ok := other.GetFirst([]byte(entries[10].key)); err != nil || !ok {
+		t.Fatalf("got %v, %v", err, ok)
+	}
+	if &r.index[0].offsets[0] != &offsets[0] {
+		t.Error("another Scanner rebuilt the offsets")
+	}
+}
+
+// BenchmarkSkipTo compares point gets, which binary search each block's
+// entry offsets, with a linear scan of the block each key is in, for keys
+// spread across compressed blocks of thousands of entries. Most lookups land
+// in a different block than the one before, so each decodes its block again.
+func BenchmarkSkipTo(b *testing.B) {
+	entries := sequentialEntries(20000)
+	r := parseEntries(b, WriterOptions{Compression: "snappy", BlockSize: 1 << 17}, entries)
+	if len(r.index) < 4 {
+		b.Fatalf("got %d blocks, want several", len(r.index))
+	}
+	keys := make([][]byte, 1024)
+	for i := range keys {
+		keys[i] = []byte(entries[rand.Intn(len(entries))].key)
+	}
+	b.Run("search", func(b *testing.B) {
+		s := NewScanner(r)
+		for i := 0; i < b.N; i++ {
+			if _, err, ok := s.GetFirst(keys[i%len(keys)]); err != nil || !ok {
+				b.Fatalf("got %v, %v", err, ok)
+			}
+		}
+	})
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			key := keys[i%len(keys)]
+			idx, _ := r.findBlock(key)
+			buf, err := r.GetBlock(idx)
+			if err != nil {
+				b.Fatal(err)
+			}
+			linearSkipTo(buf, key)
+			keyLen, valLen, ok := readEntryLengths(buf)
+			if !ok || readEntry(buf, make([]byte, keyLen), make([]byte, valLen)) != nil {
+				b.Fatal("bad entry")
+			}
+		}
+	})
+}
+
+// TestKeyBeforeFirstBlock checks that looking up a key below the file's first
+// key decodes no block.
+func TestKeyBeforeFirstBlock(t *testing.T) {
+	r := parseEntries(t, WriterOptions{Compression: "snappy", BlockSize: 256}, sequentialEntries(100))
+	r.SetBlockCacheBytes(1 << 20)
+	for _, ordered := range []bool{true, false} {
+		s := NewScanner(r)
+		s.Ordered(ordered)
+		for _, key := range []string{"", "a", "key"} {
+			if _, err, ok := s.GetFirst([]byte(key)); err != nil || ok {
+				t.Errorf("ordered=%v: GetFirst(%q): got %v, %v", ordered, key, err, ok)
+			}
+			if _, err, ok := s.GetAll([]byte(key)); err != nil || ok {
+				t.Errorf("ordered=%v: GetAll(%q): got %v, %v", ordered, key, err, ok)
+			}
+			if ok, err := s.Contains([]byte(key)); err != nil || ok {
+				t.Errorf("ordered=%v: Contains(%q): got %v, %v", ordered, key, ok, err)
+			}
+		}
+	}
+	if stats := r.Stats(); stats.BlockCacheHits != 0 || stats.BlockCacheMisses != 0 {
+		t.Errorf("got %d block cache hits and %d misses, want none", stats.BlockCacheHits, stats.BlockCacheMisses)
+	}
+}
+
+// TestRepeatedFirstKey looks up the key two consecutive blocks both start
+// with, which must be found from the first of them, whether or not the file
+// starts with it.
+func TestRepeatedFirstKey(t *testing.T) {
+	// Entries of 8+1+2 bytes, two to a block of 20.
+	for _, entries := range [][]testEntry{
+		{{"b", "01"}, {"b", "02"}, {"b", "03"}, {"c", "04"}},
+		{{"a", "00"}, {"b", "01"}, {"b", "02"}, {"b", "03"}, {"b", "04"}, {"c", "05"}},
+	} {
+		r := parseEntries(t, WriterOptions{BlockSize: 20}, entries)
+		var want [][]byte
+		for _, e := range entries {
+			if e.key == "b" {
+				want = append(want, []byte(e.value))
+			}
+		}
+		first := -1
+		for i := 0; i+1 < len(r.index); i++ {
+			if string(r.index[i].firstKeyBytes) == "b" && string(r.index[i+1].firstKeyBytes) == "b" {
+				first = i
+				break
+			}
+		}
+		if first < 0 {
+			t.Fatalf("no two blocks starting with b in %v", r.index)
+		}
+
+		for _, ordered := range []bool{true, false} {
+			s := NewScanner(r)
+			s.Ordered(ordered)
+			if value, err, ok := s.GetFirst([]byte("b")); err != nil || !ok || string(value) != string(want[0]) {
+				t.Errorf("ordered=%v: GetFirst: got %q, %v, %v, want %q", ordered, value, err, ok, want[0])
+			}
+			s.Reset()
+			if values, err, ok := s.GetAll([]byte("b")); err != nil || !ok || !reflect.DeepEqual(values, want) {
+				t.Errorf("ordered=%v: GetAll: got %q, %v, %v, want %q", ordered, values, err, ok, want)
+			}
+			if value, err, ok := s.GetFirst([]byte("c")); err != nil || !ok {
+				t.Errorf("ordered=%v: c: got %q, %v, %v", ordered, value, err, ok)
+			}
+		}
+	}
+}
+
+// TestGetAllLimit checks each limit on a key whose values span blocks, and
+// GetN, which differs only in returning nothing for n <= 0.
+func TestGetAllLimit(t *testing.T) {
+	entries := []testEntry{{"a", "a"}}
+	var all [][]byte
+	for i := 0; i < 10; i++ {
+		entries = append(entries, testEntry{"b", fmt.Sprintf("b%d", i)})
+		all = append(all, []byte(fmt.Sprintf("b%d", i)))
+	}
+	entries = append(entries, testEntry{"c", "c"})
+	r := parseEntries(t, WriterOptions{BlockSize: 32}, entries)
+	s := NewScanner(r)
+
+	for n := -1; n <= len(all)+1; n++ {
+		want := all
+		if n > 0 && n < len(all) {
+			want = all[:n]
+		}
+		if values, err, ok := s.GetAllLimit([]byte("b"), n); err != nil || !ok || !reflect.DeepEqual(values, want) {
+			t.Errorf("GetAllLimit(%d): got %q, %v, %v, want %q", n, values, err, ok, want)
+		}
+
+		if n <= 0 {
+			want = nil
+		}
+		if values, err := s.GetN([]byte("b"), n); err != nil || !reflect.DeepEqual(values, want) {
+			t.Errorf("GetN(%d): got %q, %v, want %q", n, values, err, want)
+		}
+	}
+
+	if values, err, ok := s.GetAllLimit([]byte("bb"), 1); err != nil || ok || values != nil {
+		t.Errorf("absent key: got %q, %v, %v", values, err, ok)
+	}
+	if values, err := s.GetN([]byte("bb"), 1); err != nil || values != nil {
+		t.Errorf("GetN of an absent key: got %q, %v", values, err)
+	}
+}
+
+func TestGetAllBatch(t *testing.T) {
+	entries := []testEntry{{"a", "a"}}
+	for i := 0; i < 10; i++ {
+		entries = append(entries, testEntry{"b", fmt.Sprintf("b%d", i)})
+	}
+	entries = append(entries, testEntry{"c", "c"}, testEntry{"d", "d"})
+	data := writeEntries(t, WriterOptions{BlockSize: 1}, entries)
+	r, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := [][]byte{[]byte("c"), []byte("b"), []byte("bb"), []byte("a"), []byte("b"), []byte("0")}
+	got, err := r.GetAllBatch(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][][]byte{"a": {[]byte("a")}, "c": {[]byte("c")}}
+	for _, e := range entries[1:11] {
+		want["b"] = append(want["b"], []byte(e.value))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Make d's value run past the end of its block, so that reading it fails.
+	at := bytes.Index(data, []byte("\x00\x00\x00\x01\x00\x00\x00\x01d"))
+	binary.BigEndian.PutUint32(data[at+4:], 1000)
+	if r, err = Parse(data); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r.GetAllBatch(keys); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("without d: got %q, %v", got, err)
+	}
+	if got, err := r.GetAllBatch(append(keys, []byte("d"))); err == nil || got != nil {
+		t.Errorf("with d: got %q, %v, want an error", got, err)
+	}
+}
+
+func TestOnDiskValueSize(t *testing.T) {
+	entries := []testEntry{{"a", ""}, {"bb", "first"}, {"bb", "second"}, {"c", strings.Repeat("x", 1000)}}
+	r := parseEntries(t, WriterOptions{Compression: "snappy", BlockSize: 16}, entries)
+	s := NewScanner(r)
+	for _, test := range []struct {
+		key  string
+		size int
+		ok   bool
+	}{
+		{"a", 8 + 1, true},
+		{"bb", 8 + 2 + 5, true}, // the first entry only
+		{"b", 0, false},
+		{"c", 8 + 1 + 1000, true},
+		{"d", 0, false},
+	} {
+		if size, ok := s.OnDiskValueSize([]byte(test.key)); size != test.size || ok != test.ok {
+			t.Errorf("%q: got %d, %v, want %d, %v", test.key, size, ok, test.size, test.ok)
+		}
+	}
+}
+
+func TestGetBatch(t *testing.T) {
+	entries := sequentialEntries(100)
+	r := parseEntries(t, WriterOptions{BlockSize: 128}, entries)
+	decoded := map[int]int{}
+	r.onBlockDecoded = func(i int, _ []byte) { decoded[i]++ }
+
+	// Unsorted, with repeats and misses.
+	want := map[string]string{}
+	for _, i := range []int{90, 1, 50} {
+		want[entries[i].key] = entries[i].value
+	}
+	keys := [][]byte{[]byte("key000090"), []byte("key000001"), []byte("nope"), []byte("key000050"), []byte("key000001"), []byte("a")}
+	values, found := r.GetBatch(keys)
+	for i, key := range keys {
+		value, ok := want[string(key)]
+		if found[i] != ok || string(values[i]) != value {
+			t.Errorf("%s: got %q, %v, want %q, %v", key, values[i], found[i], value, ok)
+		}
+	}
+	for i, n := range decoded {
+		if n > 1 {
+			t.Errorf("decoded block %d %d times", i, n)
+		}
+	}
+}
+
+// TestLookupErrors checks that lookups in a damaged block report an error
+// rather than not finding the key.
+func TestLookupErrors(t *testing.T) {
+	entries := sequentialEntries(100)
+	for _, damage := range []struct {
+		name, codec string
+		do          func(data []byte, r *Reader)
+	}{
+		{"magic", "none", func(data []byte, r *Reader) { copy(data[r.index[1].offset:], "XXXXXXXX") }},
+		{"compressed bytes", "snappy", func(data []byte, r *Reader) {
+			for i := r.index[1].offset + 8; i < r.index[1].offset+20; i++ {
+				data[i] = 0xff
+			}
+		}},
+	} {
+		data := writeEntries(t, WriterOptions{Compression: damage.codec, BlockSize: 256}, entries)
+		r, err := Parse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		damage.do(data, r)
+		key := r.index[1].firstKeyBytes
+
+		s := NewScanner(r)
+		if _, err, ok := s.GetFirst(key); err == nil || ok {
+			t.Errorf("%s: GetFirst: got %v, %v", damage.name, err, ok)
+		}
+		if _, err, ok := s.GetAll(key); err == nil || ok {
+			t.Errorf("%s: GetAll: got %v, %v", damage.name, err, ok)
+		}
+		if _, err := s.Count(key); err == nil {
+			t.Errorf("%s: Count: got no error", damage.name)
+		}
+		// Other blocks are unaffected.
+		if _, err, ok := s.GetFirst([]byte(entries[0].key)); err != nil || !ok {
+			t.Errorf("%s: block 0: got %v, %v", damage.name, err, ok)
+		}
+	}
+}
+
+func TestComparator(t *testing.T) {
+	// Descending keys, which only a reversed comparator finds.
+	var entries []testEntry
+	for i := 99; i >= 0; i-- {
+		entries = append(entries, testEntry{fmt.Sprintf("key%06d", 2*i), fmt.Sprintf("value%d", i)})
+	}
+	descending := func(a, b []byte) int { return bytes.Compare(b, a) }
+	data := writeUnsorted(t, WriterOptions{BlockSize: 128}, entries)
+	if _, err := NewReaderAtWithOptions(bytes.NewReader(data), int64(len(data)), ReaderOptions{StrictOrder: true}); err == nil {
+		t.Error("StrictOrder accepted descending blocks compared bytewise")
+	}
+	r, err := NewReaderAtWithOptions(bytes.NewReader(data), int64(len(data)), ReaderOptions{StrictOrder: true, Comparator: descending})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.index) < 10 {
+		t.Fatalf("got %d blocks, want a many-block file", len(r.index))
+	}
+	if err := r.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	s := NewScanner(r)
+	for _, e := range entries {
+		if value, err, ok := s.GetFirst([]byte(e.key)); err != nil || !ok || string(value) != e.value {
+			t.Errorf("%s: got %q, %v, %v", e.key, value, err, ok)
+		}
+		if count, err := s.Count([]byte(e.key)); err != nil || count != 1 {
+			t.Errorf("%s: got a count of %d, %v", e.key, count, err)
+		}
+	}
+	s = NewScanner(r)
+	for i := 199; i >= -1; i -= 2 {
+		key := fmt.Sprintf("key%06d", i)
+		if value, err, ok := s.GetFirst([]byte(key)); err != nil || ok {
+			t.Errorf("%s: got %q, %v, %v", key, value, err, ok)
+		}
+	}
+	if k, v, ok := r.Ceiling([]byte("key000101")); !ok || string(k) != "key000100" || string(v) != "value50" {
+		t.Errorf("Ceiling: got %q, %q, %v", k, v, ok)
+	}
+
+	// Compared bytewise again, the file is out of order.
+	r.SetComparator(nil)
+	if err := r.Validate(); err == nil {
+		t.Error("Validate accepted descending keys compared bytewise")
+	}
+}
+
+func TestCount(t *testing.T) {
+	var entries []testEntry
+	for i := 0; i < 10; i++ {
+		for j := 0; j < i; j++ {
+			entries = append(entries, testEntry{fmt.Sprintf("key%02d", i), fmt.Sprintf("value%d", j)})
+		}
+	}
+	r := parseEntries(t, WriterOptions{BlockSize: 40}, entries)
+	if len(r.index) < 10 {
+		t.Fatalf("got %d blocks, want runs across blocks", len(r.index))
+	}
+	check := func(s *Scanner, i int) {
+		key := []byte(fmt.Sprintf("key%02d", i))
+		if count, err := s.Count(key); err != nil || count != i {
+			t.Errorf("%s: got a count of %d, %v, want %d", key, count, err, i)
+		}
+	}
+	s := NewScanner(r)
+	for i := 0; i < 10; i++ {
+		check(&s, i)
+	}
+	s = NewScanner(r)
+	for i := 9; i >= 0; i-- {
+		check(&s, i)
+	}
+}
+
+func TestContains(t *testing.T) {
+	var entries []testEntry
+	for i := 0; i < 100; i += 2 {
+		entries = append(entries, testEntry{fmt.Sprintf("key%06d", i), strings.Repeat("v", 1000)})
+	}
+	r, err := Parse(writeBloomEntries(t, 1, entries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := 0
+	r.onBlockDecoded = func(int, []byte) { decoded++ }
+
+	s := NewScanner(r)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%06d", i)
+		if ok, err := s.Contains([]byte(key)); err != nil || ok != (i%2 == 0) {
+			t.Errorf("%s: got %v, %v", key, ok, err)
+		}
+	}
+	if ok, err := s.Contains([]byte("zzz")); err != nil || ok {
+		t.Errorf("zzz: got %v, %v", ok, err)
+	}
+	if decoded != len(r.index) {
+		t.Errorf("decoded %d blocks, want each of the %d once", decoded, len(r.index))
+	}
+
+	// The bloom filter answers for keys it rules out, without a block.
+	decoded = 0
+	s = NewScanner(r)
+	misses := 0
+	for i := 1; i < 100; i += 2 {
+		if r.mightContain([]byte(fmt.Sprintf("key%06d", i))) {
+			continue
+		}
+		misses++
+		s.Contains([]byte(fmt.Sprintf("key%06d", i)))
+	}
+	if misses == 0 || decoded != 0 {
+		t.Errorf("decoded %d blocks for %d keys the filter ruled out", decoded, misses)
+	}
+
+	// The value is skipped, not copied as GetFirst copies it.
+	s = NewScanner(r)
+	key := []byte(entries[10].key)
+	contains := testing.AllocsPerRun(100, func() { s.Contains(key) })
+	getFirst := testing.AllocsPerRun(100, func() { s.GetFirst(key) })
+	if contains >= getFirst {
+		t.Errorf("got %v allocations a lookup, and %v for GetFirst", contains, getFirst)
+	}
+}
+
+func TestGetFirstWithKey(t *testing.T) {
+	// Keys compared case-insensitively, so that a lookup matches a stored
+	// key that differs from it.
+	entries := []testEntry{{"Apple", "1"}, {"banana", "2"}, {"Banana", "3"}, {"CHERRY", "4"}, {"date", "5"}}
+	foldCase := func(a, b []byte) int { return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b)) }
+	data := writeUnsorted(t, WriterOptions{BlockSize: 16}, entries)
+	r, err := NewReaderAtWithOptions(bytes.NewReader(data), int64(len(data)), ReaderOptions{Comparator: foldCase})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewScanner(r)
+	for _, test := range []struct{ key, stored, value string }{
+		{"APPLE", "Apple", "1"},
+		{"avocado", "", ""},
+		{"BANANA", "banana", "2"},
+		{"cherry", "CHERRY", "4"},
+		{"Date", "date", "5"},
+		{"fig", "", ""},
+	} {
+		stored, value, err, ok := s.GetFirstWithKey([]byte(test.key))
+		if err != nil || ok != (test.stored != "") || string(stored) != test.stored || string(value) != test.value {
+			t.Errorf("%s: got %q, %q, %v, %v", test.key, stored, value, err, ok)
+		}
+	}
+}
+
+func TestGetFirstInto(t *testing.T) {
+	entries := []testEntry{{"a", "short"}, {"b", strings.Repeat("long", 100)}, {"c", "mid-length"}}
+	r := parseEntries(t, WriterOptions{BlockSize: 64}, entries)
+	s := NewScanner(r)
+	var buf []byte
+	for _, e := range entries {
+		value, err, ok := s.GetFirstInto([]byte(e.key), buf)
+		if err != nil || !ok || string(value) != e.value {
+			t.Fatalf("%s: got %q, %v, %v", e.key, value, err, ok)
+		}
+		buf = value[:cap(value)]
+	}
+	// The buffer grew to the long value and was reused for the one after it.
+	if cap(buf) < 400 {
+		t.Errorf("got a buffer of %d bytes", cap(buf))
+	}
+	if value, err, ok := s.GetFirstInto([]byte("d"), buf); err != nil || ok || value != nil {
+		t.Errorf("d: got %q, %v, %v", value, err, ok)
+	}
+
+	s = NewScanner(r)
+	key := []byte("c")
+	if allocs := testing.AllocsPerRun(100, func() { s.GetFirstInto(key, buf) }); allocs >= testing.AllocsPerRun(100, func() { s.GetFirst(key) }) {
+		t.Errorf("got %v allocations a lookup, no fewer than GetFirst", allocs)
+	}
+}
+
+func TestGetAllEmptyValue(t *testing.T) {
+	r := parseEntries(t, WriterOptions{BlockSize: 16}, []testEntry{{"a", ""}, {"b", ""}, {"b", "x"}, {"d", "1"}})
+	s := NewScanner(r)
+	for _, test := range []struct {
+		key  string
+		want []string // nil if the file does not have key
+	}{
+		{"a", []string{""}},
+		{"b", []string{"", "x"}},
+		{"c", nil},
+		{"d", []string{"1"}},
+		{"e", nil},
+	} {
+		values, err, ok := s.GetAll([]byte(test.key))
+		var got []string
+		for _, v := range values {
+			got = append(got, string(v))
+		}
+		if err != nil || ok != (test.want != nil) || !reflect.DeepEqual(got, test.want) || (values == nil) != (test.want == nil) {
+			t.Errorf("%s: got %q, %v, %v, want %q", test.key, got, err, ok, test.want)
+		}
+	}
+}
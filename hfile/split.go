@@ -0,0 +1,120 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Split rewrites src as n files at dstPaths, each a valid HFile holding a
+// contiguous range of src's keys, for resharding data across more nodes. The
+// ranges are disjoint and together cover src, and are cut at data block
+// boundaries, from BlockIndex, so that each file gets about the same share
+// of src's bytes. A key's entries always go to the same file, even where they
+// run across blocks, so a file that would have to start partway through a
+// key gets fewer blocks instead; for the same reason, when src has fewer
+// blocks than n, some of the files are left empty. The files are written
+// with src's codec where Writer has it, otherwise uncompressed. If a write
+// fails, the files already written are removed.
+func Split(src *Reader, n int, dstPaths []string) error {
+	if n < 1 || len(dstPaths) != n {
+		return fmt.Errorf("split into %d files with %d paths", n, len(dstPaths))
+	}
+	if src.closed {
+		return ErrClosed
+	}
+	if src.compare != nil {
+		return errors.New("split needs a file sorted bytewise, as Writer writes them")
+	}
+
+	opts := WriterOptions{}
+	switch codec := src.CompressionCodec(); codec {
+	case "none", "snappy", "lz4":
+		opts.Compression = codec
+	}
+
+	bounds := splitKeys(src, n)
+	it := src.NewIterator()
+	ok := it.Next()
+	for i, path := range dstPaths {
+		var bound []byte // the first key of the next file, nil for none
+		if i < len(bounds) {
+			bound = bounds[i]
+		}
+		err := writeSplit(path, opts, func(w *Writer) error {
+			for ; ok && (bound == nil || bytes.Compare(it.Key(), bound) < 0); ok = it.Next() {
+				if err := w.Add(it.Key(), it.Value()); err != nil {
+					return err
+				}
+			}
+			return it.Err()
+		})
+		if err != nil {
+			for _, written := range dstPaths[:i+1] {
+				os.Remove(written)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// splitKeys returns the first keys of the files Split makes after the
+// first, in increasing order: the first keys of the blocks starting closest
+// after each n-th of the file's data blocks' bytes. There are fewer than
+// n-1 of them when blocks share a first key or src has fewer than n blocks.
+func splitKeys(src *Reader, n int) [][]byte {
+	blocks := src.BlockIndex()
+	var total uint64
+	for _, blk := range blocks {
+		total += uint64(blk.Size)
+	}
+
+	var bounds [][]byte
+	var before uint64 // the size of the blocks before j
+	j, last := 0, 0   // last is the block the last file cut at starts
+	for k := uint64(1); k < uint64(n); k++ {
+		target := total * k / uint64(n)
+		for j < len(blocks) && (j <= last || before < target) {
+			before += uint64(blocks[j].Size)
+			j += 1
+		}
+		if j >= len(blocks) {
+			break
+		}
+		last = j
+		key := blocks[j].FirstKey
+		if len(bounds) > 0 && bytes.Compare(key, bounds[len(bounds)-1]) <= 0 {
+			continue
+		}
+		bounds = append(bounds, key)
+	}
+	return bounds
+}
+
+// writeSplit creates the file at path and writes it with add.
+func writeSplit(path string, opts WriterOptions, add func(w *Writer) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(file)
+	w, err := NewWriter(out, opts)
+	if err == nil {
+		err = add(w)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	// Make some keys' entries run on across blocks.
+	var entries []testEntry
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		entries = append(entries, testEntry{key, "value"})
+		if i%50 == 0 {
+			for j := 0; j < 10; j++ {
+				entries = append(entries, testEntry{key, fmt.Sprintf("dup%d", j)})
+			}
+		}
+	}
+
+	for _, codec := range []string{"none", "snappy"} {
+		src := parseEntries(t, WriterOptions{Compression: codec, BlockSize: 128}, entries)
+		for _, n := range []int{1, 2, 4, 7, src.BlockCount() + 3} {
+			dir := t.TempDir()
+			paths := make([]string, n)
+			for i := range paths {
+				paths[i] = filepath.Join(dir, fmt.Sprint(i))
+			}
+			if err := Split(src, n, paths); err != nil {
+				t.Fatalf("%s into %d: %s", codec, n, err)
+			}
+
+			var union []testEntry
+			var lastKey []byte
+			nonEmpty := 0
+			for i, path := range paths {
+				r, err := NewReaderFromPath(path)
+				if err != nil {
+					t.Fatalf("%s into %d: file %d: %s", codec, n, i, err)
+				}
+				if err := r.Validate(); err != nil {
+					t.Fatalf("%s into %d: file %d: %s", codec, n, i, err)
+				}
+				if got := r.CompressionCodec(); got != codec {
+					t.Errorf("%s into %d: file %d written with %s", codec, n, i, got)
+				}
+				part := readAll(t, r)
+				if len(part) > 0 {
+					nonEmpty += 1
+					if lastKey != nil && bytes.Compare([]byte(part[0].key), lastKey) <= 0 {
+						t.Errorf("%s into %d: file %d starts at %s, overlapping the file before ending at %s", codec, n, i, part[0].key, lastKey)
+					}
+					lastKey = []byte(part[len(part)-1].key)
+				}
+				union = append(union, part...)
+				r.Close()
+			}
+			if !reflect.DeepEqual(union, entries) {
+				t.Errorf("%s into %d: files hold %d entries, source %d", codec, n, len(union), len(entries))
+			}
+			if expected := n; n <= src.BlockCount() && nonEmpty != expected {
+				t.Errorf("%s into %d: only %d files have entries", codec, n, nonEmpty)
+			}
+		}
+	}
+}
+
+func TestSplitArguments(t *testing.T) {
+	src := parseEntries(t, WriterOptions{}, sequentialEntries(10))
+	if err := Split(src, 2, []string{filepath.Join(t.TempDir(), "0")}); err == nil {
+		t.Error("split into 2 files with 1 path")
+	}
+	if err := Split(src, 0, nil); err == nil {
+		t.Error("split into 0 files")
+	}
+}
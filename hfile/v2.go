@@ -0,0 +1,636 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Version 2 files end in a fixed 212 byte trailer. From minor version 2 on
+// its fields are a protobuf message instead of fixed width, and from minor
+// version 1 on every block header carries checksum fields. Version 3 files
+// number their minor versions the same way, and differ only in that each
+// cell may carry tags after its value.
+const (
+	v2TrailerSize = 212
+
+	v2BlockHeaderSize             = 24
+	v2BlockHeaderSizeWithChecksum = 33
+)
+
+func (r *Reader) newHeaderV2() (Header, error) {
+	header := Header{}
+
+	if r.minorVersion > 3 {
+		return header, fmt.Errorf("unsupported version %d.%d", r.majorVersion, r.minorVersion)
+	}
+	if r.size < v2TrailerSize {
+		return header, errors.New("file too small to contain an HFile v2 trailer")
+	}
+
+	header.index = r.size - v2TrailerSize
+	trailer, err := r.readAt(header.index, v2TrailerSize-4)
+	if err != nil {
+		return header, err
+	}
+	if bytes.Compare(trailer[:8], []byte("TRABLK\"$")) != 0 {
+		return header, fmt.Errorf("bad header magic %x (%s)", trailer[:8], r.describeBadTrailer(trailer[:8]))
+	}
+
+	if r.minorVersion >= 2 {
+		return header, readTrailerProto(trailer[8:], &header)
+	}
+
+	buf := bytes.NewReader(trailer[8:])
+	var uncompressedDataIndexSize uint64
+	binary.Read(buf, binary.BigEndian, &header.fileInfoOffset)
+	binary.Read(buf, binary.BigEndian, &header.dataIndexOffset) // the load-on-open section
+	binary.Read(buf, binary.BigEndian, &header.dataIndexCount)
+	binary.Read(buf, binary.BigEndian, &uncompressedDataIndexSize)
+	binary.Read(buf, binary.BigEndian, &header.metaIndexCount)
+	binary.Read(buf, binary.BigEndian, &header.totalUncompressedDataBytes)
+	binary.Read(buf, binary.BigEndian, &header.entryCount)
+	binary.Read(buf, binary.BigEndian, &header.compressionCodec)
+	binary.Read(buf, binary.BigEndian, &header.numDataIndexLevels)
+	binary.Read(buf, binary.BigEndian, &header.firstDataBlockOffset)
+	binary.Read(buf, binary.BigEndian, &header.lastDataBlockOffset)
+	comparator := make([]byte, 128)
+	buf.Read(comparator)
+	if end := bytes.IndexByte(comparator, 0); end >= 0 {
+		comparator = comparator[:end]
+	}
+	header.comparatorClassName = string(comparator)
+	return header, nil
+}
+
+// readTrailerProto decodes the length-delimited FileTrailerProto that follows
+// the magic in a protobuf trailer.
+func readTrailerProto(data []byte, header *Header) error {
+	msgLen, n := binary.Uvarint(data)
+	if n <= 0 || msgLen > uint64(len(data)-n) {
+		return errors.New("truncated trailer")
+	}
+
+	return walkProto(data[n:n+int(msgLen)], func(field uint64, v uint64, b []byte) {
+		switch field {
+		case 1:
+			header.fileInfoOffset = v
+		case 2:
+			header.dataIndexOffset = v // the load-on-open section
+		case 4:
+			header.totalUncompressedDataBytes = v
+		case 5:
+			header.dataIndexCount = uint32(v)
+		case 6:
+			header.metaIndexCount = uint32(v)
+		case 7:
+			header.entryCount = v
+		case 8:
+			header.numDataIndexLevels = uint32(v)
+		case 9:
+			header.firstDataBlockOffset = v
+		case 10:
+			header.lastDataBlockOffset = v
+		case 11:
+			header.comparatorClassName = string(b)
+		case 12:
+			header.compressionCodec = uint32(v)
+		}
+	})
+}
+
+// loadIndexV2 reads the load-on-open section: the root data index, then the
+// root meta index right behind it, and the FileInfo block, which says how the
+// entries in data blocks are laid out.
+func (r *Reader) loadIndexV2() error {
+	// Writers split the data index of a large file into leaf and
+	// intermediate index blocks below the root. The root's entries then
+	// point at those rather than at data blocks, which would be misread.
+	if r.header.numDataIndexLevels > 1 {
+		return fmt.Errorf("multi-level block index not supported (%d levels)", r.header.numDataIndexLevels)
+	}
+
+	trailer := r.header.index
+	if r.header.fileInfoOffset > trailer || r.header.dataIndexOffset > trailer {
+		return errors.New("trailer offsets point past the trailer")
+	}
+
+	magic, body, size, err := r.readBlockV2(r.header.dataIndexOffset)
+	if err != nil {
+		return err
+	}
+	if bytes.Compare(magic, []byte("IDXROOT2")) != 0 {
+		return errors.New("bad data index magic")
+	}
+	r.index, err = readRootIndex(body, r.header.dataIndexCount, "data")
+	if err != nil {
+		return err
+	}
+	r.header.metaIndexOffset = r.header.dataIndexOffset + size
+
+	magic, body, _, err = r.readBlockV2(r.header.fileInfoOffset)
+	if err != nil {
+		return err
+	}
+	if bytes.Compare(magic, []byte("FILEINF2")) != 0 {
+		return errors.New("bad file info magic")
+	}
+	r.fileInfo, err = readFileInfo(body)
+	if err != nil {
+		return err
+	}
+
+	if encoding, ok := r.fileInfo["DATA_BLOCK_ENCODING"]; ok && string(encoding) != "NONE" {
+		return fmt.Errorf("data block encoding %s not supported", encoding)
+	}
+	// Writers from key/value format version 1 on follow each entry with the
+	// memstore timestamp it was flushed with.
+	if version, ok := r.fileInfo["KEY_VALUE_VERSION"]; ok && len(version) == 4 {
+		r.includesMemstoreTS = binary.BigEndian.Uint32(version) == 1
+	}
+	// v3 writers that write tags record the longest they wrote, even if
+	// that is 0.
+	if r.majorVersion == 3 {
+		_, r.includesTags = r.fileInfo["hfile.MAX_TAGS_LEN"]
+	}
+	return nil
+}
+
+func (r *Reader) metaIndexV2() ([]Block, error) {
+	magic, body, _, err := r.readBlockV2(r.header.metaIndexOffset)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Compare(magic, []byte("IDXROOT2")) != 0 {
+		return nil, errors.New("bad meta index magic")
+	}
+	return readRootIndex(body, r.header.metaIndexCount, "meta")
+}
+
+// readRootIndex parses the entries of a root index block: each is the offset
+// and on-disk size of a block, followed by its first key (or meta block
+// name).
+func readRootIndex(body []byte, count uint32, kind string) ([]Block, error) {
+	var index []Block
+	for i := uint32(0); i < count; i++ {
+		if len(body) < 12 {
+			return nil, fmt.Errorf("truncated %s index entry %d", kind, i)
+		}
+		block := Block{entries: -1}
+		block.offset = binary.BigEndian.Uint64(body[0:8])
+		block.size = binary.BigEndian.Uint32(body[8:12])
+		body = body[12:]
+
+		keyLen, n, err := readVLong(body)
+		if err != nil || keyLen < 0 || uint64(keyLen) > uint64(len(body)-n) {
+			return nil, fmt.Errorf("truncated %s index entry %d", kind, i)
+		}
+		block.firstKeyBytes = append([]byte(nil), body[n:n+int(keyLen)]...)
+		body = body[n+int(keyLen):]
+
+		index = append(index, block)
+	}
+	return index, nil
+}
+
+// readFileInfo parses a FileInfo block. Writers since HBase 0.96 emit a
+// "PBUF" prefixed FileInfoProto; older ones a count followed by Writable
+// serialized key, type code, value triples.
+func readFileInfo(body []byte) (map[string][]byte, error) {
+	info := make(map[string][]byte)
+
+	if bytes.HasPrefix(body, []byte("PBUF")) {
+		body = body[4:]
+		msgLen, n := binary.Uvarint(body)
+		if n <= 0 || msgLen > uint64(len(body)-n) {
+			return nil, errors.New("truncated file info")
+		}
+		var pairErr error
+		err := walkProto(body[n:n+int(msgLen)], func(field uint64, v uint64, pair []byte) {
+			if field != 1 {
+				return
+			}
+			var key, value []byte
+			if err := walkProto(pair, func(field uint64, v uint64, b []byte) {
+				switch field {
+				case 1:
+					key = b
+				case 2:
+					value = b
+				}
+			}); err != nil {
+				pairErr = err
+			}
+			info[string(key)] = value
+		})
+		if err == nil {
+			err = pairErr
+		}
+		return info, err
+	}
+
+	if len(body) < 4 {
+		return nil, errors.New("truncated file info")
+	}
+	count := binary.BigEndian.Uint32(body[0:4])
+	body = body[4:]
+	for i := uint32(0); i < count; i++ {
+		key, rest, err := readByteArray(body)
+		if err != nil || len(rest) < 1 {
+			return nil, errors.New("truncated file info")
+		}
+		// rest[0] is the Writable type code of the value, always a byte array.
+		value, rest, err := readByteArray(rest[1:])
+		if err != nil {
+			return nil, errors.New("truncated file info")
+		}
+		info[string(key)] = value
+		body = rest
+	}
+	return info, nil
+}
+
+// getBlockV2 reads data block i and rewrites it into the v1 layout the rest
+// of the package decodes: the DATABLK* magic followed by entries, without the
+// tags v3 writers and the memstore timestamps v2 writers may interleave.
+func (r *Reader) getBlockV2(i int) ([]byte, error) {
+	body, err := r.readDataBlockV2(i)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, 8+len(body))
+	data = append(data, "DATABLK*"...)
+	if !r.includesMemstoreTS && !r.includesTags {
+		return append(data, body...), nil
+	}
+
+	for len(body) > 0 {
+		entry, _, rest, err := r.nextCell(body, i)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, entry...)
+		body = rest
+	}
+	return data, nil
+}
+
+// readDataBlockV2 reads and decompresses data block i, returning its cells
+// as the file lays them out.
+func (r *Reader) readDataBlockV2(i int) ([]byte, error) {
+	magic, body, _, err := r.readBlockV2(r.index[i].offset)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Compare(magic, []byte("DATABLK*")) != 0 {
+		return nil, errors.New("bad data block magic")
+	}
+	return body, nil
+}
+
+// nextCell splits the first cell off body, the cells of data block i: its
+// entry in the v1 layout, the key and value with their lengths, then its
+// tags, if the file has them, and what follows its memstore timestamp.
+func (r *Reader) nextCell(body []byte, i int) ([]byte, []byte, []byte, error) {
+	if len(body) < 8 {
+		return nil, nil, nil, fmt.Errorf("truncated entry in block %d", i)
+	}
+	n := 8 + uint64(binary.BigEndian.Uint32(body[0:4])) + uint64(binary.BigEndian.Uint32(body[4:8]))
+	if n > uint64(len(body)) {
+		return nil, nil, nil, fmt.Errorf("truncated entry in block %d", i)
+	}
+	entry, rest := body[:n], body[n:]
+
+	var tags []byte
+	if r.includesTags {
+		if len(rest) < 2 {
+			return nil, nil, nil, fmt.Errorf("truncated tags in block %d", i)
+		}
+		tagsLen := int(binary.BigEndian.Uint16(rest[0:2]))
+		if tagsLen > len(rest)-2 {
+			return nil, nil, nil, fmt.Errorf("truncated tags in block %d", i)
+		}
+		tags, rest = rest[2:2+tagsLen], rest[2+tagsLen:]
+	}
+	if r.includesMemstoreTS {
+		_, tsLen, err := readVLong(rest)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("truncated entry in block %d", i)
+		}
+		rest = rest[tsLen:]
+	}
+	return entry, tags, rest, nil
+}
+
+// Tag is one of the typed pieces of metadata a version 3 file may attach to a
+// cell, such as HBase's visibility labels or per-cell TTLs.
+type Tag struct {
+	Type  byte
+	Value []byte
+}
+
+// readTags parses a cell's tags, each a 2 byte length, counting the type
+// byte, then the type and the value.
+func readTags(b []byte) ([]Tag, error) {
+	var tags []Tag
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, errors.New("truncated tag")
+		}
+		n := int(binary.BigEndian.Uint16(b[0:2]))
+		if n < 1 || n > len(b)-2 {
+			return nil, errors.New("truncated tag")
+		}
+		tags = append(tags, Tag{b[2], append([]byte(nil), b[3:2+n]...)})
+		b = b[2+n:]
+	}
+	return tags, nil
+}
+
+// cellTags returns the tags of the first cell in data block i with key, and
+// whether the block has one. It also reports whether the block goes on past
+// key, so there is no use looking in the next.
+func (r *Reader) cellTags(i int, key []byte) ([]Tag, bool, bool, error) {
+	body, err := r.readDataBlockV2(i)
+	if err != nil {
+		return nil, false, false, err
+	}
+	for len(body) > 0 {
+		entry, tags, rest, err := r.nextCell(body, i)
+		if err != nil {
+			return nil, false, false, err
+		}
+		cmp := r.compareKeys(entry[8:8+binary.BigEndian.Uint32(entry[0:4])], key)
+		if cmp == 0 {
+			tags, err := readTags(tags)
+			if err != nil {
+				return nil, false, false, fmt.Errorf("block %d: %s", i, err)
+			}
+			return tags, true, true, nil
+		}
+		if cmp > 0 {
+			return nil, false, true, nil
+		}
+		body = rest
+	}
+	return nil, false, false, nil
+}
+
+func (r *Reader) v2BlockHeaderSize() uint64 {
+	if r.minorVersion >= 1 {
+		return v2BlockHeaderSizeWithChecksum
+	}
+	return v2BlockHeaderSize
+}
+
+// readBlockV2 reads the block at offset, returning its magic, decompressed
+// contents and total size on disk. The header is the magic, the on-disk and
+// uncompressed sizes of the rest of the block and the previous block's
+// offset, then with checksums the checksum type, bytes per checksum and the
+// on-disk size of the header plus data, after which the checksums follow.
+func (r *Reader) readBlockV2(offset uint64) ([]byte, []byte, uint64, error) {
+	headerSize := r.v2BlockHeaderSize()
+	if !r.inBounds(offset, headerSize) {
+		return nil, nil, 0, fmt.Errorf("block at %d extends past the end of the file", offset)
+	}
+	header, err := r.readAt(offset, headerSize)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	onDiskSize := headerSize + uint64(binary.BigEndian.Uint32(header[8:12]))
+	uncompressedSize := binary.BigEndian.Uint32(header[12:16])
+	dataEnd := onDiskSize
+	if r.minorVersion >= 1 {
+		dataEnd = uint64(binary.BigEndian.Uint32(header[29:33]))
+	}
+	if dataEnd < headerSize || dataEnd > onDiskSize || !r.inBounds(offset, onDiskSize) {
+		return nil, nil, 0, fmt.Errorf("block at %d extends past the end of the file", offset)
+	}
+
+	if r.verifyChecksums && r.minorVersion >= 1 {
+		if err := r.verifyBlockChecksums(offset, header, dataEnd, onDiskSize); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	data, err := r.readAt(offset+headerSize, dataEnd-headerSize)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	body, err := r.decompressV2(data, uncompressedSize)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("block at %d: %s", offset, err)
+	}
+	return header[:8], body, onDiskSize, nil
+}
+
+// checkBlockChecksums reads the header of the block at offset and checks the
+// block against its checksums, without decoding it. Only files from minor
+// version 1 on have them.
+func (r *Reader) checkBlockChecksums(offset uint64) error {
+	headerSize := r.v2BlockHeaderSize()
+	if !r.inBounds(offset, headerSize) {
+		return fmt.Errorf("block at %d extends past the end of the file", offset)
+	}
+	header, err := r.readAt(offset, headerSize)
+	if err != nil {
+		return err
+	}
+	onDiskSize := headerSize + uint64(binary.BigEndian.Uint32(header[8:12]))
+	dataEnd := uint64(binary.BigEndian.Uint32(header[29:33]))
+	if dataEnd < headerSize || dataEnd > onDiskSize || !r.inBounds(offset, onDiskSize) {
+		return fmt.Errorf("block at %d extends past the end of the file", offset)
+	}
+	return r.verifyBlockChecksums(offset, header, dataEnd, onDiskSize)
+}
+
+// verifyBlockChecksums checks the block at offset against the checksums that
+// follow its data: one for every bytesPerChecksum bytes of the header plus
+// data, in the CRC the header names.
+func (r *Reader) verifyBlockChecksums(offset uint64, header []byte, dataEnd, onDiskSize uint64) error {
+	var table *crc32.Table
+	switch header[24] {
+	case 0: // NULL, written without checksums
+		return nil
+	case 1:
+		table = crc32.IEEETable
+	case 2:
+		table = crc32.MakeTable(crc32.Castagnoli)
+	default:
+		return fmt.Errorf("block at %d has unknown checksum type %d", offset, header[24])
+	}
+
+	bytesPerChecksum := uint64(binary.BigEndian.Uint32(header[25:29]))
+	if bytesPerChecksum == 0 {
+		return fmt.Errorf("block at %d has zero bytes per checksum", offset)
+	}
+	chunks := (dataEnd + bytesPerChecksum - 1) / bytesPerChecksum
+	if onDiskSize-dataEnd < 4*chunks {
+		return fmt.Errorf("block at %d is missing checksums", offset)
+	}
+
+	covered, err := r.readAt(offset, dataEnd)
+	if err != nil {
+		return err
+	}
+	sums, err := r.readAt(offset+dataEnd, 4*chunks)
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < chunks; i++ {
+		chunk := covered[i*bytesPerChecksum:]
+		if uint64(len(chunk)) > bytesPerChecksum {
+			chunk = chunk[:bytesPerChecksum]
+		}
+		if crc32.Checksum(chunk, table) != binary.BigEndian.Uint32(sums[4*i:]) {
+			return fmt.Errorf("block at %d fails checksum for bytes %d-%d", offset, i*bytesPerChecksum, i*bytesPerChecksum+uint64(len(chunk)))
+		}
+	}
+	return nil
+}
+
+func (r *Reader) decompressV2(data []byte, size uint32) ([]byte, error) {
+	switch r.header.compressionCodec {
+	case 2: // No compression
+		if uint64(len(data)) != uint64(size) {
+			return nil, errors.New("mismatched uncompressed block size")
+		}
+		return data, nil
+	case 1: // Gzip, a plain gzip stream
+		uncompressed, err := gunzip(data, size)
+		if err == nil && uint64(len(uncompressed)) != uint64(size) {
+			err = errors.New("mismatched uncompressed block size")
+		}
+		return uncompressed, err
+	case 3: // Snappy
+		return decodeBlockStream(data, size, snappyDecode)
+	case 4: // LZ4, framed the same way; no chunk can hold more than the block
+		return decodeBlockStream(data, size, func(b []byte) ([]byte, error) {
+			return lz4Decode(b, size)
+		})
+	}
+	return nil, fmt.Errorf("unsupported compression codec %d", r.header.compressionCodec)
+}
+
+// decodeBlockStream undoes Hadoop's BlockCompressorStream framing: each run
+// of input is its uncompressed length followed by as many length-prefixed
+// compressed chunks as it took to hold it.
+func decodeBlockStream(data []byte, size uint32, decode func([]byte) ([]byte, error)) ([]byte, error) {
+	var out []byte
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errors.New("truncated compressed block")
+		}
+		rawLen := uint64(binary.BigEndian.Uint32(data[0:4]))
+		data = data[4:]
+
+		start := len(out)
+		for uint64(len(out)-start) < rawLen {
+			if len(data) < 4 {
+				return nil, errors.New("truncated compressed block")
+			}
+			chunkLen := uint64(binary.BigEndian.Uint32(data[0:4]))
+			data = data[4:]
+			if chunkLen > uint64(len(data)) {
+				return nil, errors.New("truncated compressed block")
+			}
+			chunk, err := decode(data[:chunkLen])
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, chunk...)
+			data = data[chunkLen:]
+		}
+	}
+	if uint64(len(out)) != uint64(size) {
+		return nil, errors.New("mismatched uncompressed block size")
+	}
+	return out, nil
+}
+
+// readVLong decodes a Hadoop WritableUtils variable length integer, returning
+// it and the number of bytes it took.
+func readVLong(b []byte) (int64, int, error) {
+	if len(b) < 1 {
+		return 0, 0, errors.New("truncated vlong")
+	}
+	first := int8(b[0])
+	if first >= -112 {
+		return int64(first), 1, nil
+	}
+
+	size, negative := int(-111-first), false
+	if first < -120 {
+		size, negative = int(-119-first), true
+	}
+	if len(b) < size {
+		return 0, 0, errors.New("truncated vlong")
+	}
+	var v int64
+	for _, c := range b[1:size] {
+		v = v<<8 | int64(c)
+	}
+	if negative {
+		v = ^v
+	}
+	return v, size, nil
+}
+
+// readByteArray decodes a vlong length prefixed byte array, returning it and
+// what follows it.
+func readByteArray(b []byte) ([]byte, []byte, error) {
+	n, size, err := readVLong(b)
+	if err != nil || n < 0 || uint64(n) > uint64(len(b)-size) {
+		return nil, nil, errors.New("truncated byte array")
+	}
+	return b[size : size+int(n)], b[size+int(n):], nil
+}
+
+// walkProto calls fn with each field of the protobuf message in data. Varint
+// fields arrive in v and length delimited fields in b. Fixed width fields
+// are skipped, as nothing this package reads uses them.
+func walkProto(data []byte, fn func(field uint64, v uint64, b []byte)) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("truncated protobuf")
+		}
+		data = data[n:]
+
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("truncated protobuf")
+			}
+			data = data[n:]
+			fn(key>>3, v, nil)
+		case 1:
+			if len(data) < 8 {
+				return errors.New("truncated protobuf")
+			}
+			data = data[8:]
+		case 2:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || l > uint64(len(data)-n) {
+				return errors.New("truncated protobuf")
+			}
+			fn(key>>3, 0, data[n:n+int(l)])
+			data = data[n+int(l):]
+		case 5:
+			if len(data) < 4 {
+				return errors.New("truncated protobuf")
+			}
+			data = data[4:]
+		default:
+			return fmt.Errorf("unknown protobuf wire type %d", key&7)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,422 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/pierrec/lz4"
+)
+
+// v2Options shapes a fixture written by writeV2.
+type v2Options struct {
+	minor    uint32 // 0 to 3; checksums from 1, a protobuf trailer from 2
+	codec    uint32 // 1 gzip, 2 none, 3 snappy, 4 lz4
+	memstore bool   // follow each entry with a memstore timestamp
+	pbInfo   bool   // write FileInfo as a protobuf, as minor 2 and later do
+	levels   uint32 // data index levels the trailer claims; 0 means 1
+	major    uint32 // 2 or 3; 0 means 2
+	tags     bool   // follow each value with its v3Tags, as v3 does
+}
+
+// v2Blocks are the entries of every v2 fixture, one slice for each block.
+var v2Blocks = [][]testEntry{
+	{{"a", "1"}, {"b", "2"}, {"c", "3"}},
+	{{"d", "4"}, {"e", "5"}},
+	{{"f", "6"}},
+}
+
+// v3Tags are the tags of v2Blocks' cells in fixtures that have them. The
+// cells not listed have none.
+var v3Tags = map[string][]Tag{
+	"b": {{2, []byte("secret&!probationary")}, {8, []byte{0, 0, 0, 0, 0, 0, 0x0e, 0x10}}},
+	"e": {{2, []byte("public")}},
+}
+
+// v2Writer assembles a version 2 file, which Writer cannot write.
+type v2Writer struct {
+	v2Options
+	out  bytes.Buffer
+	prev int64 // the offset of the previous block
+}
+
+// writeV2 returns a version 2 or 3 file holding v2Blocks, a meta block named
+// BLOOM and a FileInfo with a LASTKEY.
+func writeV2(opts v2Options) []byte {
+	w := &v2Writer{v2Options: opts, prev: -1}
+
+	type entry struct {
+		offset uint64
+		size   uint32
+		key    string
+	}
+	var index []entry
+	entries, total := 0, 0
+	for _, blk := range v2Blocks {
+		var body bytes.Buffer
+		for _, e := range blk {
+			binary.Write(&body, binary.BigEndian, uint32(len(e.key)))
+			binary.Write(&body, binary.BigEndian, uint32(len(e.value)))
+			body.WriteString(e.key)
+			body.WriteString(e.value)
+			if opts.tags {
+				var tags bytes.Buffer
+				for _, tag := range v3Tags[e.key] {
+					binary.Write(&tags, binary.BigEndian, uint16(1+len(tag.Value)))
+					tags.WriteByte(tag.Type)
+					tags.Write(tag.Value)
+				}
+				binary.Write(&body, binary.BigEndian, uint16(tags.Len()))
+				body.Write(tags.Bytes())
+			}
+			if opts.memstore {
+				putVInt(&body, 200)
+			}
+			entries++
+		}
+		total += body.Len()
+		offset, size := w.block("DATABLK*", body.Bytes())
+		index = append(index, entry{offset, size, blk[0].key})
+	}
+	first, last := index[0].offset, index[len(index)-1].offset
+	metaOffset, metaSize := w.block("METABLKc", []byte("bloombits"))
+
+	var rootIndex bytes.Buffer
+	for _, e := range index {
+		binary.Write(&rootIndex, binary.BigEndian, e.offset)
+		binary.Write(&rootIndex, binary.BigEndian, e.size)
+		putVInt(&rootIndex, len(e.key))
+		rootIndex.WriteString(e.key)
+	}
+	loadOnOpen, _ := w.block("IDXROOT2", rootIndex.Bytes())
+	var metaIndex bytes.Buffer
+	binary.Write(&metaIndex, binary.BigEndian, metaOffset)
+	binary.Write(&metaIndex, binary.BigEndian, metaSize)
+	putVInt(&metaIndex, len("BLOOM"))
+	metaIndex.WriteString("BLOOM")
+	w.block("IDXROOT2", metaIndex.Bytes())
+
+	kvVersion := []byte{0, 0, 0, 0}
+	if opts.memstore {
+		kvVersion = []byte{0, 0, 0, 1}
+	}
+	info := [][2][]byte{
+		{[]byte("hfile.LASTKEY"), []byte("f")},
+		{[]byte("KEY_VALUE_VERSION"), kvVersion},
+		{[]byte("DATA_BLOCK_ENCODING"), []byte("NONE")},
+	}
+	if opts.tags {
+		info = append(info, [2][]byte{[]byte("hfile.MAX_TAGS_LEN"), {0, 0, 0, 40}})
+	}
+	var fileInfo bytes.Buffer
+	if opts.pbInfo {
+		var msg bytes.Buffer
+		for _, kv := range info {
+			var pair bytes.Buffer
+			putField(&pair, 1, kv[0])
+			putField(&pair, 2, kv[1])
+			putField(&msg, 1, pair.Bytes())
+		}
+		fileInfo.WriteString("PBUF")
+		putUvarint(&fileInfo, uint64(msg.Len()))
+		fileInfo.Write(msg.Bytes())
+	} else {
+		binary.Write(&fileInfo, binary.BigEndian, uint32(len(info)))
+		for _, kv := range info {
+			putVInt(&fileInfo, len(kv[0]))
+			fileInfo.Write(kv[0])
+			fileInfo.WriteByte(1) // the value's type code
+			putVInt(&fileInfo, len(kv[1]))
+			fileInfo.Write(kv[1])
+		}
+	}
+	fileInfoOffset, _ := w.block("FILEINF2", fileInfo.Bytes())
+
+	levels := uint64(1)
+	if opts.levels > 0 {
+		levels = uint64(opts.levels)
+	}
+	start := w.out.Len()
+	w.out.WriteString("TRABLK\"$")
+	if opts.minor >= 2 {
+		var msg bytes.Buffer
+		for _, f := range []struct{ field, value uint64 }{
+			{1, fileInfoOffset}, {2, loadOnOpen}, {4, uint64(total)}, {5, uint64(len(index))},
+			{6, 1}, {7, uint64(entries)}, {8, levels}, {9, first}, {10, last}, {12, uint64(opts.codec)},
+		} {
+			putUvarint(&msg, f.field<<3)
+			putUvarint(&msg, f.value)
+		}
+		putField(&msg, 11, []byte("cmpr"))
+		putUvarint(&w.out, uint64(msg.Len()))
+		w.out.Write(msg.Bytes())
+	} else {
+		for _, v := range []interface{}{
+			fileInfoOffset, loadOnOpen, uint32(len(index)), uint64(rootIndex.Len()), uint32(1),
+			uint64(total), uint64(entries), opts.codec, uint32(levels), first, last,
+		} {
+			binary.Write(&w.out, binary.BigEndian, v)
+		}
+		comparator := make([]byte, 128)
+		copy(comparator, "cmpr")
+		w.out.Write(comparator)
+	}
+	major := uint32(2)
+	if opts.major > 0 {
+		major = opts.major
+	}
+	w.out.Write(make([]byte, start+208-w.out.Len()))
+	binary.Write(&w.out, binary.BigEndian, opts.minor<<24|major)
+	return w.out.Bytes()
+}
+
+// block writes a block with the header, and from minor 1 the checksums, of
+// the file's version, returning its offset and size on disk.
+func (w *v2Writer) block(magic string, raw []byte) (uint64, uint32) {
+	offset := uint64(w.out.Len())
+	data := w.compress(raw)
+	const bytesPerChecksum = 64
+	headerSize := 24
+	checksums := 0
+	if w.minor >= 1 {
+		headerSize = 33
+		checksums = 4 * ((headerSize + len(data) + bytesPerChecksum - 1) / bytesPerChecksum)
+	}
+	checksumType, table := byte(1), crc32.IEEETable
+	if w.codec == 1 {
+		checksumType, table = 2, crc32.MakeTable(crc32.Castagnoli)
+	}
+
+	w.out.WriteString(magic)
+	binary.Write(&w.out, binary.BigEndian, uint32(len(data)+checksums))
+	binary.Write(&w.out, binary.BigEndian, uint32(len(raw)))
+	binary.Write(&w.out, binary.BigEndian, w.prev)
+	if w.minor >= 1 {
+		w.out.WriteByte(checksumType)
+		binary.Write(&w.out, binary.BigEndian, uint32(bytesPerChecksum))
+		binary.Write(&w.out, binary.BigEndian, uint32(headerSize+len(data)))
+	}
+	w.out.Write(data)
+	if checksums > 0 {
+		covered := append([]byte(nil), w.out.Bytes()[offset:]...)
+		for len(covered) > 0 {
+			n := bytesPerChecksum
+			if n > len(covered) {
+				n = len(covered)
+			}
+			binary.Write(&w.out, binary.BigEndian, crc32.Checksum(covered[:n], table))
+			covered = covered[n:]
+		}
+	}
+	w.prev = int64(offset)
+	return offset, uint32(uint64(w.out.Len()) - offset)
+}
+
+// compress encodes raw with the file's codec. Snappy and LZ4 blocks are
+// written as two chunks, as Hadoop's block compression stream frames them.
+func (w *v2Writer) compress(raw []byte) []byte {
+	switch w.codec {
+	case 1:
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		zw.Write(raw)
+		zw.Close()
+		return b.Bytes()
+	case 2:
+		return raw
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint32(len(raw)))
+	half := len(raw) / 2
+	for _, chunk := range [][]byte{raw[:half], raw[half:]} {
+		var compressed []byte
+		if w.codec == 3 {
+			compressed = snappy.Encode(nil, chunk)
+		} else {
+			compressed = make([]byte, lz4.CompressBlockBound(len(chunk)))
+			n, _ := lz4.CompressBlock(chunk, compressed, nil)
+			compressed = compressed[:n]
+		}
+		binary.Write(&b, binary.BigEndian, uint32(len(compressed)))
+		b.Write(compressed)
+	}
+	return b.Bytes()
+}
+
+// putVInt writes n, which must be below 256, as a Hadoop vint.
+func putVInt(b *bytes.Buffer, n int) {
+	if n < 128 {
+		b.WriteByte(byte(n))
+		return
+	}
+	b.WriteByte(0x8f) // -113: one byte follows
+	b.WriteByte(byte(n))
+}
+
+func putUvarint(b *bytes.Buffer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+// putField writes a length-delimited protobuf field.
+func putField(b *bytes.Buffer, field uint64, value []byte) {
+	putUvarint(b, field<<3|2)
+	putUvarint(b, uint64(len(value)))
+	b.Write(value)
+}
+
+func TestV2(t *testing.T) {
+	var want []testEntry
+	for _, blk := range v2Blocks {
+		want = append(want, blk...)
+	}
+	for _, opts := range []v2Options{
+		{minor: 0, codec: 2},
+		{minor: 1, codec: 3, memstore: true},
+		{minor: 1, codec: 4, memstore: true},
+		{minor: 2, codec: 1, memstore: true, pbInfo: true},
+		{minor: 3, codec: 2, pbInfo: true},
+		{minor: 3, codec: 3, memstore: true, pbInfo: true},
+	} {
+		r, err := Parse(writeV2(opts))
+		if err != nil {
+			t.Errorf("%+v: %s", opts, err)
+			continue
+		}
+		if err := r.Validate(); err != nil {
+			t.Errorf("%+v: %s", opts, err)
+		}
+		if len(r.index) != len(v2Blocks) {
+			t.Errorf("%+v: got %d blocks, want %d", opts, len(r.index), len(v2Blocks))
+		}
+		if got := readAll(t, r); !reflect.DeepEqual(got, want) {
+			t.Errorf("%+v: got %v, want %v", opts, got, want)
+		}
+		s := NewScanner(r)
+		for _, e := range want {
+			if value, err, ok := s.GetFirst([]byte(e.key)); err != nil || !ok || string(value) != e.value {
+				t.Errorf("%+v: %s: got %q, %v, %v", opts, e.key, value, err, ok)
+			}
+		}
+		if got := string(r.FileInfo()["hfile.LASTKEY"]); got != "f" {
+			t.Errorf("%+v: got LASTKEY %q", opts, got)
+		}
+		if names, err := r.MetaBlockNames(); err != nil || !reflect.DeepEqual(names, []string{"BLOOM"}) {
+			t.Errorf("%+v: got meta blocks %v, %v", opts, names, err)
+		}
+	}
+}
+
+func TestV2Checksums(t *testing.T) {
+	for _, opts := range []v2Options{
+		{minor: 1, codec: 2},
+		{minor: 3, codec: 1, pbInfo: true}, // CRC32C
+	} {
+		data := writeV2(opts)
+		r, err := Parse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Flip a bit of block 1's checksums, leaving its data readable.
+		end := r.index[1].offset + uint64(r.index[1].size)
+		data[end-1] ^= 1
+
+		if _, err := r.GetBlock(1); err != nil {
+			t.Errorf("%+v: without VerifyChecksums: %s", opts, err)
+		}
+		if err := r.Validate(); err == nil || !strings.Contains(err.Error(), "block 1") {
+			t.Errorf("%+v: Validate: got %v, want a checksum error in block 1", opts, err)
+		}
+		r.VerifyChecksums(true)
+		if _, err := r.GetBlock(0); err != nil {
+			t.Errorf("%+v: block 0: %s", opts, err)
+		}
+		if _, err := r.GetBlock(1); err == nil {
+			t.Errorf("%+v: block 1: got no checksum error", opts)
+		}
+	}
+}
+
+func TestV2MultiLevelIndex(t *testing.T) {
+	for _, opts := range []v2Options{
+		{minor: 1, codec: 2, levels: 2},
+		{minor: 3, codec: 2, pbInfo: true, levels: 3},
+	} {
+		_, err := Parse(writeV2(opts))
+		if err == nil || !strings.Contains(err.Error(), "multi-level block index not supported") {
+			t.Errorf("%+v: got %v, want the levels rejected", opts, err)
+		}
+	}
+}
+
+func TestV3Tags(t *testing.T) {
+	var want []testEntry
+	for _, blk := range v2Blocks {
+		want = append(want, blk...)
+	}
+	for _, opts := range []v2Options{
+		{major: 3, minor: 3, codec: 2, pbInfo: true, tags: true},
+		{major: 3, minor: 3, codec: 3, memstore: true, pbInfo: true, tags: true},
+		{major: 3, minor: 1, codec: 4, memstore: true, tags: true},
+		{major: 3, minor: 3, codec: 2, memstore: true, pbInfo: true}, // no tags written
+	} {
+		r, err := Parse(writeV2(opts))
+		if err != nil {
+			t.Errorf("%+v: %s", opts, err)
+			continue
+		}
+		if err := r.Validate(); err != nil {
+			t.Errorf("%+v: %s", opts, err)
+		}
+		// The tags are left out of the entries.
+		if got := readAll(t, r); !reflect.DeepEqual(got, want) {
+			t.Errorf("%+v: got %v, want %v", opts, got, want)
+		}
+		s := NewScanner(r)
+		for _, e := range want {
+			if value, err, ok := s.GetFirst([]byte(e.key)); err != nil || !ok || string(value) != e.value {
+				t.Errorf("%+v: %s: got %q, %v, %v", opts, e.key, value, err, ok)
+			}
+			var wantTags []Tag
+			if opts.tags {
+				wantTags = v3Tags[e.key]
+			}
+			if tags, ok, err := s.GetFirstCellTags([]byte(e.key)); err != nil || !ok || !reflect.DeepEqual(tags, wantTags) {
+				t.Errorf("%+v: %s: got tags %v, %v, %v, want %v", opts, e.key, tags, ok, err, wantTags)
+			}
+		}
+		for _, key := range []string{"0", "bb", "z"} {
+			if tags, ok, err := s.GetFirstCellTags([]byte(key)); err != nil || ok || tags != nil {
+				t.Errorf("%+v: %s: got tags %v, %v, %v", opts, key, tags, ok, err)
+			}
+		}
+	}
+
+	// A tag running past the end of its cell's tags is an error.
+	data := writeV2(v2Options{major: 3, minor: 3, codec: 2, pbInfo: true, tags: true})
+	r, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b's first tag is 21 bytes long, after its entry and tags length.
+	off := r.index[0].offset + v2BlockHeaderSizeWithChecksum + (8 + 1 + 1 + 2) + (8 + 1 + 1)
+	binary.BigEndian.PutUint16(data[off+2:], 200)
+	s := NewScanner(r)
+	if _, _, err := s.GetFirstCellTags([]byte("b")); err == nil || err.Error() != "block 0: truncated tag" {
+		t.Errorf("got %v, want a truncated tag", err)
+	}
+
+	// Files of other versions have no tags.
+	r = parseEntries(t, WriterOptions{}, want)
+	s = NewScanner(r)
+	if tags, ok, err := s.GetFirstCellTags([]byte("c")); err != nil || !ok || tags != nil {
+		t.Errorf("v1: got %v, %v, %v", tags, ok, err)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+// mapWindowCount is how many windows of data blocks a windowed reader keeps
+// mapped at once, besides its index.
+const mapWindowCount = 4
+
+// mappedWindows reads a file through mappings of parts of it, for files too
+// big to map whole: the region from the data index to the end of the file,
+// pinned once the trailer says where that is, and up to mapWindowCount
+// windows of the data blocks before it, mapped as reads need them and
+// unmapped least recently used first. Reads copy out of the mappings, so
+// nothing handed out refers to a window that is later unmapped. It is safe
+// for concurrent use.
+type mappedWindows struct {
+	lock   sync.Mutex
+	file   *os.File
+	size   int64
+	window int64 // bytes per window, a multiple of the page size
+
+	pinned      mmap.MMap
+	pinnedStart int64
+
+	lru     *list.List // of *mappedWindow, most recently used at the front
+	windows map[int64]*list.Element
+	closed  bool
+}
+
+type mappedWindow struct {
+	start int64
+	data  mmap.MMap
+}
+
+// newMappedWindows reads the size bytes of file in windows of at least
+// window bytes, rounded up to whole pages.
+func newMappedWindows(file *os.File, size int64, window int) *mappedWindows {
+	page := int64(os.Getpagesize())
+	return &mappedWindows{
+		file:    file,
+		size:    size,
+		window:  (int64(window) + page - 1) / page * page,
+		lru:     list.New(),
+		windows: make(map[int64]*list.Element),
+	}
+}
+
+// pin maps the file from offset to its end for as long as w is open, so that
+// reads there never map a window.
+func (w *mappedWindows) pin(offset int64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.pinned != nil || offset < 0 || offset >= w.size {
+		return nil
+	}
+	start := offset / int64(os.Getpagesize()) * int64(os.Getpagesize())
+	if uint64(w.size-start) > maxInt {
+		return fmt.Errorf("index of %d bytes is too large to map", w.size-start)
+	}
+	data, err := mmap.MapRegion(w.file, int(w.size-start), mmap.RDONLY, 0, start)
+	if err != nil {
+		return err
+	}
+	w.pinned, w.pinnedStart = data, start
+	return nil
+}
+
+// ReadAt copies the file at off into buf, from the pinned index or from each
+// window buf spans, mapping those that are not already.
+func (w *mappedWindows) ReadAt(buf []byte, off int64) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return 0, ErrClosed
+	}
+	read := 0
+	for read < len(buf) {
+		pos := off + int64(read)
+		if pos >= w.size {
+			return read, io.EOF
+		}
+		if w.pinned != nil && pos >= w.pinnedStart {
+			read += copy(buf[read:], w.pinned[pos-w.pinnedStart:])
+			continue
+		}
+		data, start, err := w.mapWindow(pos)
+		if err != nil {
+			return read, err
+		}
+		read += copy(buf[read:], data[pos-start:])
+	}
+	return read, nil
+}
+
+// mapWindow returns the window holding pos and where it starts, unmapping
+// the least recently used window if that makes too many. w.lock must be
+// held.
+func (w *mappedWindows) mapWindow(pos int64) (mmap.MMap, int64, error) {
+	start := pos / w.window * w.window
+	if elem, ok := w.windows[start]; ok {
+		w.lru.MoveToFront(elem)
+		return elem.Value.(*mappedWindow).data, start, nil
+	}
+
+	length := w.window
+	if w.pinned != nil && start+length > w.pinnedStart {
+		length = w.pinnedStart - start
+	}
+	if start+length > w.size {
+		length = w.size - start
+	}
+	data, err := mmap.MapRegion(w.file, int(length), mmap.RDONLY, 0, start)
+	if err != nil {
+		return nil, 0, err
+	}
+	w.windows[start] = w.lru.PushFront(&mappedWindow{start, data})
+	for w.lru.Len() > mapWindowCount {
+		oldest := w.lru.Remove(w.lru.Back()).(*mappedWindow)
+		delete(w.windows, oldest.start)
+		if err := oldest.data.Unmap(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return data, start, nil
+}
+
+// mappedBytes returns how much of the file is mapped now.
+func (w *mappedWindows) mappedBytes() int64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	n := int64(len(w.pinned))
+	for elem := w.lru.Front(); elem != nil; elem = elem.Next() {
+		n += int64(len(elem.Value.(*mappedWindow).data))
+	}
+	return n
+}
+
+// close unmaps everything, after which reads fail with ErrClosed.
+func (w *mappedWindows) close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.closed = true
+	var err error
+	for elem := w.lru.Front(); elem != nil; elem = elem.Next() {
+		if e := elem.Value.(*mappedWindow).data.Unmap(); e != nil && err == nil {
+			err = e
+		}
+	}
+	w.lru.Init()
+	w.windows = nil
+	if w.pinned != nil {
+		if e := w.pinned.Unmap(); e != nil && err == nil {
+			err = e
+		}
+		w.pinned = nil
+	}
+	return err
+}
@@ -0,0 +1,59 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMapWindows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	entries := sequentialEntries(20000)
+	data := writeEntries(t, WriterOptions{Compression: "snappy", BlockSize: 4096}, entries)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	page := os.Getpagesize()
+	r, err := NewReaderWithOptions(file, ReaderOptions{MapWindowBytes: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := int64(len(data)) - int64(r.header.dataIndexOffset)/int64(page)*int64(page)
+	if int64(len(data)) <= index+mapWindowCount*int64(page) {
+		t.Fatalf("file of %d bytes would fit in the windows", len(data))
+	}
+
+	if got := readAll(t, r); !reflect.DeepEqual(got, entries) {
+		t.Errorf("got %d entries, want %d", len(got), len(entries))
+	}
+	s := NewScanner(r)
+	for _, i := range []int{19999, 0, 7000, 12345, 3} {
+		if got, err, ok := s.GetFirst([]byte(entries[i].key)); err != nil || !ok || string(got) != entries[i].value {
+			t.Errorf("GetFirst(%s): got %q %v %v", entries[i].key, got, err, ok)
+		}
+	}
+	if got, max := r.MappedBytes(), index+mapWindowCount*int64(page); got > max || got <= index {
+		t.Errorf("got %d mapped bytes, want between %d and %d", got, index, max)
+	}
+
+	r.Close()
+	if _, err, _ := s.GetFirst([]byte(entries[0].key)); err != ErrClosed {
+		t.Errorf("after Close: got %v, want %v", err, ErrClosed)
+	}
+	if got := r.MappedBytes(); got != 0 {
+		t.Errorf("after Close: got %d mapped bytes", got)
+	}
+	if _, err := r.windows.ReadAt(make([]byte, 1), 0); err != ErrClosed {
+		t.Errorf("ReadAt after Close: got %v, want %v", err, ErrClosed)
+	}
+}
@@ -0,0 +1,331 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/golang/snappy"
+	"github.com/pierrec/lz4"
+)
+
+// WriterOptions configures a Writer. The zero value writes uncompressed 64KB
+// blocks.
+type WriterOptions struct {
+	// Compression is "none", "snappy" or "lz4", the names Metrics reports
+	// codecs by. Empty means "none".
+	Compression string
+
+	// BlockSize is how many bytes of entries a data block collects before it
+	// is written out. A block always holds at least one entry, so one with a
+	// large value can be bigger. 0 means 64KB, as HBase uses.
+	BlockSize int
+
+	// FileInfo is written into the file's FileInfo block alongside the
+	// entries the Writer adds itself, and is returned by Reader.FileInfo.
+	FileInfo map[string][]byte
+
+	// Properties is application metadata, like a schema version, written to
+	// a meta block of this package's own and returned by Reader.Properties.
+	// Unlike FileInfo it shares no namespace with HBase. No meta block is
+	// written when it is empty.
+	Properties map[string]string
+}
+
+// Writer writes a version 1 HFile that Reader, and HBase, can read. Entries
+// must be added in key order; several may share a key.
+type Writer struct {
+	w     io.Writer
+	codec uint32
+	opts  WriterOptions
+
+	offset    uint64 // bytes written to w so far
+	block     bytes.Buffer
+	index     []Block
+	metaIndex []Block
+
+	lastKey                    []byte
+	keyWidth, valueWidth       int // of every entry so far, or -1 once they differ
+	entries                    uint64
+	totalKeyBytes              uint64
+	totalValueBytes            uint64
+	totalUncompressedDataBytes uint64
+
+	err    error // the first write error, returned from then on
+	closed bool
+}
+
+func NewWriter(w io.Writer, opts WriterOptions) (*Writer, error) {
+	var codec uint32
+	switch opts.Compression {
+	case "", "none":
+		codec = 2
+	case "snappy":
+		codec = 3
+	case "lz4":
+		codec = 4
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", opts.Compression)
+	}
+	if opts.BlockSize < 0 {
+		return nil, fmt.Errorf("bad block size %d", opts.BlockSize)
+	}
+	if opts.BlockSize == 0 {
+		opts.BlockSize = 64 * 1024
+	}
+	return &Writer{w: w, codec: codec, opts: opts}, nil
+}
+
+// Add appends an entry. key must not sort before the key of the entry added
+// before it.
+func (w *Writer) Add(key, value []byte) error {
+	if w.closed {
+		return errors.New("writer closed")
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if w.entries > 0 && bytes.Compare(key, w.lastKey) < 0 {
+		return fmt.Errorf("key %v added after %v", key, w.lastKey)
+	}
+	if w.entries == math.MaxUint32 {
+		return errors.New("version 1 files hold at most 2^32-1 entries")
+	}
+
+	if w.block.Len() == 0 {
+		w.index = append(w.index, Block{firstKeyBytes: append([]byte(nil), key...)})
+	}
+	var lens [8]byte
+	binary.BigEndian.PutUint32(lens[0:4], uint32(len(key)))
+	binary.BigEndian.PutUint32(lens[4:8], uint32(len(value)))
+	w.block.Write(lens[:])
+	w.block.Write(key)
+	w.block.Write(value)
+
+	w.lastKey = append(w.lastKey[:0], key...)
+	if w.entries == 0 {
+		w.keyWidth, w.valueWidth = len(key), len(value)
+	}
+	if len(key) != w.keyWidth {
+		w.keyWidth = -1
+	}
+	if len(value) != w.valueWidth {
+		w.valueWidth = -1
+	}
+	w.entries += 1
+	w.totalKeyBytes += uint64(len(key))
+	w.totalValueBytes += uint64(len(value))
+
+	if w.block.Len() >= w.opts.BlockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// flushBlock writes out the data block being filled, if it has any entries.
+func (w *Writer) flushBlock() error {
+	if w.block.Len() == 0 {
+		return nil
+	}
+	raw := make([]byte, 0, 8+w.block.Len())
+	raw = append(raw, "DATABLK*"...)
+	raw = append(raw, w.block.Bytes()...)
+	w.block.Reset()
+
+	blk := &w.index[len(w.index)-1]
+	blk.offset = w.offset
+	blk.size = w.writeBlock(raw)
+	w.totalUncompressedDataBytes += uint64(len(raw))
+	return w.err
+}
+
+// writeBlock compresses and writes out raw, a data or meta block starting
+// with its magic, returning the size to record for it in its index.
+func (w *Writer) writeBlock(raw []byte) uint32 {
+	switch w.codec {
+	case 3, 4: // Snappy or LZ4, framed with the uncompressed and compressed sizes
+		var compressed []byte
+		if w.codec == 3 {
+			compressed = snappy.Encode(nil, raw)
+		} else {
+			compressed = make([]byte, lz4.CompressBlockBound(len(raw)))
+			n, err := lz4.CompressBlock(raw, compressed, nil)
+			if err != nil {
+				if w.err == nil {
+					w.err = err
+				}
+				return 0
+			}
+			compressed = compressed[:n]
+		}
+		var framing [8]byte
+		binary.BigEndian.PutUint32(framing[0:4], uint32(len(raw)))
+		binary.BigEndian.PutUint32(framing[4:8], uint32(len(compressed)))
+		w.write(framing[:])
+		w.write(compressed)
+		return uint32(8 + len(compressed))
+	}
+	// No compression
+	w.write(raw)
+	return uint32(len(raw))
+}
+
+// write writes b to the underlying writer, remembering the first error.
+func (w *Writer) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	n, err := w.w.Write(b)
+	w.offset += uint64(n)
+	w.err = err
+}
+
+// Close writes out the last data block, the properties meta block if there
+// are any, the FileInfo block, the data and meta indexes and the trailer. It
+// does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return errors.New("writer closed")
+	}
+	w.closed = true
+	if err := w.flushBlock(); err != nil {
+		return err
+	}
+
+	// Meta blocks follow the data blocks, as HBase writes them.
+	if len(w.opts.Properties) > 0 {
+		props := make(map[string][]byte, len(w.opts.Properties))
+		for k, v := range w.opts.Properties {
+			props[k] = []byte(v)
+		}
+		raw := append([]byte("METABLKc"), writeInfo(props)...)
+		blk := Block{offset: w.offset, firstKeyBytes: []byte(propertiesBlockName)}
+		blk.size = w.writeBlock(raw)
+		w.metaIndex = append(w.metaIndex, blk)
+	}
+
+	fileInfoOffset := w.offset
+	w.write(w.fileInfo())
+
+	dataIndexOffset := w.offset
+	w.write(writeBlockIndex(w.index))
+
+	var metaIndexOffset uint64
+	if len(w.metaIndex) > 0 {
+		metaIndexOffset = w.offset
+		w.write(writeBlockIndex(w.metaIndex))
+	}
+
+	trailer := make([]byte, 60)
+	copy(trailer, "TRABLK\"$")
+	binary.BigEndian.PutUint64(trailer[8:16], fileInfoOffset)
+	binary.BigEndian.PutUint64(trailer[16:24], dataIndexOffset)
+	binary.BigEndian.PutUint32(trailer[24:28], uint32(len(w.index)))
+	binary.BigEndian.PutUint64(trailer[28:36], metaIndexOffset)
+	binary.BigEndian.PutUint32(trailer[36:40], uint32(len(w.metaIndex)))
+	binary.BigEndian.PutUint64(trailer[40:48], w.totalUncompressedDataBytes)
+	binary.BigEndian.PutUint32(trailer[48:52], uint32(w.entries))
+	binary.BigEndian.PutUint32(trailer[52:56], w.codec)
+	binary.BigEndian.PutUint32(trailer[56:60], 1)
+	w.write(trailer)
+	return w.err
+}
+
+// writeBlockIndex serializes an IDXBLK)+ region, as readBlockIndex parses.
+func writeBlockIndex(blocks []Block) []byte {
+	index := bytes.Buffer{}
+	index.WriteString("IDXBLK)+")
+	for _, blk := range blocks {
+		var entry [12 + binary.MaxVarintLen64]byte
+		binary.BigEndian.PutUint64(entry[0:8], blk.offset)
+		binary.BigEndian.PutUint32(entry[8:12], blk.size)
+		n := binary.PutUvarint(entry[12:], uint64(len(blk.firstKeyBytes)))
+		index.Write(entry[:12+n])
+		index.Write(blk.firstKeyBytes)
+	}
+	return index.Bytes()
+}
+
+// fileInfo serializes the FileInfo block: HBase's own entries, the widths of
+// the keys and of the values if each are all the same, and those in the
+// options.
+func (w *Writer) fileInfo() []byte {
+	info := map[string][]byte{
+		"hfile.COMPARATOR": []byte("org.apache.hadoop.hbase.util.Bytes$ByteArrayComparator"),
+	}
+	if w.entries > 0 {
+		info["hfile.LASTKEY"] = w.lastKey
+		info["hfile.AVG_KEY_LEN"] = uint32Bytes(uint32(w.totalKeyBytes / w.entries))
+		info["hfile.AVG_VALUE_LEN"] = uint32Bytes(uint32(w.totalValueBytes / w.entries))
+		if w.keyWidth >= 0 {
+			info[keyWidthInfo] = uint32Bytes(uint32(w.keyWidth))
+		}
+		if w.valueWidth >= 0 {
+			info[valueWidthInfo] = uint32Bytes(uint32(w.valueWidth))
+		}
+	}
+	for k, v := range w.opts.FileInfo {
+		info[k] = v
+	}
+	return writeInfo(info)
+}
+
+// writeInfo serializes info sorted by key, as HBase writes FileInfo, in the
+// Writable layout readFileInfo parses.
+func writeInfo(info map[string][]byte) []byte {
+	keys := make([]string, 0, len(info))
+	for k := range info {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := bytes.Buffer{}
+	buf.Write(uint32Bytes(uint32(len(keys))))
+	for _, k := range keys {
+		writeByteArray(&buf, []byte(k))
+		buf.WriteByte(1) // the Writable type code for a byte array
+		writeByteArray(&buf, info[k])
+	}
+	return buf.Bytes()
+}
+
+func uint32Bytes(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// writeByteArray writes b with a vlong length prefix, as readByteArray reads.
+func writeByteArray(buf *bytes.Buffer, b []byte) {
+	writeVLong(buf, int64(len(b)))
+	buf.Write(b)
+}
+
+// writeVLong writes v in Hadoop's WritableUtils vlong encoding, the inverse
+// of readVLong.
+func writeVLong(buf *bytes.Buffer, v int64) {
+	if v >= -112 && v <= 127 {
+		buf.WriteByte(byte(v))
+		return
+	}
+
+	first := int64(-112)
+	if v < 0 {
+		v = ^v
+		first = -120
+	}
+	size := 0
+	for tmp := v; tmp != 0; tmp >>= 8 {
+		size++
+	}
+	buf.WriteByte(byte(first - int64(size)))
+	for i := size - 1; i >= 0; i-- {
+		buf.WriteByte(byte(v >> (8 * uint(i))))
+	}
+}
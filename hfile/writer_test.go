@@ -0,0 +1,230 @@
+// Copyright (C) 2014 Daniel Harrison
+
+package hfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// roundTripEntries are awkward entries for a file to hold: an empty key and
+// value, binary bytes and a value larger than a block.
+func roundTripEntries() []testEntry {
+	entries := []testEntry{{"", "empty key"}, {"\x00", ""}, {"\x00\x01", "\xff\xfe"}}
+	entries = append(entries, sequentialEntries(500)...)
+	return append(entries, testEntry{"large", strings.Repeat("x", 10000)}, testEntry{"\xff", "last"})
+}
+
+// TestRoundTrip writes files with each codec and reads every entry back,
+// both in order and by key.
+func TestRoundTrip(t *testing.T) {
+	entries := roundTripEntries()
+	for _, codec := range []string{"none", "snappy", "lz4"} {
+		r := parseEntries(t, WriterOptions{Compression: codec, BlockSize: 1 << 10}, entries)
+		if r.CompressionCodec() != codec {
+			t.Errorf("%s: file written with %s", codec, r.CompressionCodec())
+		}
+		if err := r.Validate(); err != nil {
+			t.Errorf("%s: %s", codec, err)
+		}
+		if got := r.Stats().Entries; got != uint64(len(entries)) {
+			t.Errorf("%s: trailer counts %d entries, want %d", codec, got, len(entries))
+		}
+		if got := readAll(t, r); !reflect.DeepEqual(got, entries) {
+			t.Errorf("%s: read %d entries, want %d", codec, len(got), len(entries))
+		}
+		s := NewScanner(r)
+		for _, e := range entries {
+			if value, err, ok := s.GetFirst([]byte(e.key)); err != nil || !ok || string(value) != e.value {
+				t.Errorf("%s: %q: got %d bytes, %v, %v", codec, e.key, len(value), err, ok)
+			}
+		}
+	}
+}
+
+// TestBlockSize checks where the Writer cuts blocks: after the entry that
+// takes a block to BlockSize bytes, whatever the codec.
+func TestBlockSize(t *testing.T) {
+	entries := make([]testEntry, 100)
+	for i := range entries {
+		entries[i] = testEntry{fmt.Sprintf("key%03d", i), "value"} // 8+6+5 bytes each
+	}
+	for _, codec := range []string{"none", "snappy", "lz4"} {
+		for _, test := range []struct {
+			blockSize, perBlock int
+		}{
+			{1, 1},
+			{19, 1},
+			{20, 2},
+			{100, 6},
+			{0, 100}, // 64KB
+		} {
+			r := parseEntries(t, WriterOptions{Compression: codec, BlockSize: test.blockSize}, entries)
+			want := (len(entries) + test.perBlock - 1) / test.perBlock
+			if len(r.index) != want {
+				t.Errorf("%s, %d byte blocks: got %d blocks, want %d", codec, test.blockSize, len(r.index), want)
+				continue
+			}
+			for i, blk := range r.index {
+				if got, want := string(blk.firstKeyBytes), entries[i*test.perBlock].key; got != want {
+					t.Errorf("%s, %d byte blocks: block %d starts with %q, want %q", codec, test.blockSize, i, got, want)
+				}
+				if n, err := r.blockEntries(i); err != nil || (i < len(r.index)-1 && n != test.perBlock) {
+					t.Errorf("%s, %d byte blocks: block %d holds %d entries, %v, want %d", codec, test.blockSize, i, n, err, test.perBlock)
+				}
+			}
+		}
+	}
+
+	if _, err := NewWriter(&bytes.Buffer{}, WriterOptions{BlockSize: -1}); err == nil {
+		t.Error("created a writer with a negative block size")
+	}
+}
+
+// TestLZ4 round trips random values, which lz4 can barely shrink, and checks
+// that a damaged block is an error.
+func TestLZ4(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	entries := make([]testEntry, 50)
+	for i := range entries {
+		value := make([]byte, 100)
+		rnd.Read(value)
+		entries[i] = testEntry{fmt.Sprintf("key%03d", i), string(value)}
+	}
+	data := writeEntries(t, WriterOptions{Compression: "lz4", BlockSize: 1 << 10}, entries)
+	r, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, r); !reflect.DeepEqual(got, entries) {
+		t.Errorf("read %d entries, want %d", len(got), len(entries))
+	}
+
+	// Damage the start of block 0's compressed bytes after its framing.
+	for i := 8; i < 16; i++ {
+		data[i] = 0xff
+	}
+	r, err = Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetBlock(0); err == nil {
+		t.Error("read a damaged block")
+	}
+}
+
+func TestWriterRejects(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := NewWriter(&buf, WriterOptions{Compression: "gzip"}); err == nil {
+		t.Error("created a gzip writer")
+	}
+	w, err := NewWriter(&buf, WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add([]byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add([]byte("a"), nil); err == nil {
+		t.Error("added a key out of order")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add([]byte("c"), nil); err == nil {
+		t.Error("added a key after Close")
+	}
+	if err := w.Close(); err == nil {
+		t.Error("closed twice")
+	}
+}
+
+func TestProperties(t *testing.T) {
+	props := map[string]string{"schema.version": "3", "source": "ingest", "empty": ""}
+	for _, codec := range []string{"none", "snappy", "lz4"} {
+		entries := sequentialEntries(20)
+		opts := WriterOptions{Compression: codec, BlockSize: 64, Properties: props}
+		r := parseEntries(t, opts, entries)
+
+		got, err := r.Properties()
+		if err != nil {
+			t.Fatalf("%s: %s", codec, err)
+		}
+		if !reflect.DeepEqual(got, props) {
+			t.Errorf("%s: got properties %v, expected %v", codec, got, props)
+		}
+		if names, err := r.MetaBlockNames(); err != nil || !reflect.DeepEqual(names, []string{propertiesBlockName}) {
+			t.Errorf("%s: got meta blocks %v, %v", codec, names, err)
+		}
+		if err := r.Validate(); err != nil {
+			t.Errorf("%s: %s", codec, err)
+		}
+		if got := readAll(t, r); !reflect.DeepEqual(got, entries) {
+			t.Errorf("%s: entries changed with properties: %v", codec, got)
+		}
+	}
+
+	r := parseEntries(t, WriterOptions{}, sequentialEntries(20))
+	if got, err := r.Properties(); err != nil || len(got) != 0 {
+		t.Errorf("got %v, %v from a file without properties", got, err)
+	}
+}
+
+// TestMixedCodecMetaBlock reads a meta block compressed with gzip from a file
+// whose data blocks are compressed with snappy.
+func TestMixedCodecMetaBlock(t *testing.T) {
+	entries := sequentialEntries(20)
+	props := map[string]string{"source": "gzip"}
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, WriterOptions{Compression: "snappy", BlockSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if err := w.Add([]byte(e.key), []byte(e.value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.flushBlock(); err != nil {
+		t.Fatal(err)
+	}
+	// Close writes the meta index for blocks already in metaIndex.
+	raw := append([]byte("METABLKc"), writeInfo(map[string][]byte{"source": []byte("gzip")})...)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(raw)
+	zw.Close()
+	var framing [8]byte
+	binary.BigEndian.PutUint32(framing[0:4], uint32(len(raw)))
+	binary.BigEndian.PutUint32(framing[4:8], uint32(gz.Len()))
+	w.metaIndex = append(w.metaIndex, Block{offset: w.offset, size: uint32(8 + gz.Len()), firstKeyBytes: []byte(propertiesBlockName)})
+	w.write(framing[:])
+	w.write(gz.Bytes())
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Parse(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.CompressionCodec() != "snappy" {
+		t.Fatalf("file written with %s", r.CompressionCodec())
+	}
+	if got, err := r.Properties(); err != nil || !reflect.DeepEqual(got, props) {
+		t.Errorf("got properties %v, %v, expected %v", got, err, props)
+	}
+	if _, ok := r.MetaBlock(propertiesBlockName); !ok {
+		t.Error("could not read the meta block")
+	}
+	if got := readAll(t, r); !reflect.DeepEqual(got, entries) {
+		t.Errorf("read %d entries, expected %d", len(got), len(entries))
+	}
+}